@@ -0,0 +1,82 @@
+package pair
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	sendcmd "p2pcp/cmd/send"
+	"p2pcp/internal/auth"
+	"p2pcp/internal/identity"
+	"p2pcp/internal/prompt"
+	"p2pcp/internal/receive"
+	"p2pcp/internal/send"
+
+	"github.com/spf13/cobra"
+)
+
+var PairCmd = &cobra.Command{
+	Use:   "pair name [id]",
+	Short: "Pairs with another device under a nickname, allowing transfers without PIN/token",
+	Long: `Pairs with another device under a nickname, allowing transfers without PIN/token.
+
+Run without id on one device and follow the displayed instructions on the other one.
+Both devices use their persistent identity, afterwards use "send --to name" and "receive --from name".`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.RangeArgs(1, 2)(cmd, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Println()
+			cmd.Usage()
+			os.Exit(1)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		name := args[0]
+
+		private, _ := cmd.Flags().GetBool("private")
+		key, err := identity.Load()
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 1 {
+			pin, maxAttempts, err := sendcmd.GetPinOptions(cmd)
+			if err != nil {
+				return err
+			}
+			slog.Debug("Waiting for pairing...", "name", name, "private", private)
+			return send.Pair(ctx, name, send.Options{
+				Private:     private,
+				Pin:         pin,
+				MaxAttempts: maxAttempts,
+				Identity:    key,
+			})
+		}
+
+		id := args[1]
+		if len(id) < 7 {
+			return fmt.Errorf("id: must be at least 7 characters long")
+		}
+
+		fmt.Printf("Enter PIN: ")
+		secret := auth.NormalizePin(prompt.ReadLine())
+		if len(secret) < 6 {
+			return fmt.Errorf("PIN: must be at least 6 characters long")
+		}
+
+		skipVerify, _ := cmd.Flags().GetBool("skip-verify")
+
+		slog.Debug("Pairing...", "name", name, "id", id, "private", private)
+		return receive.Pair(ctx, name, id, secret, receive.Options{
+			Private:    private,
+			SkipVerify: skipVerify,
+			Identity:   key,
+		})
+	},
+}
+
+func init() {
+	sendcmd.AddPinFlags(PairCmd)
+	PairCmd.Flags().Bool("skip-verify", false, "skip the random art confirmation of the other device, relying on mutual authentication")
+}
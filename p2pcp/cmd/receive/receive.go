@@ -4,17 +4,34 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"p2pcp/internal/auth"
+	"p2pcp/internal/filter"
+	"p2pcp/internal/identity"
 	"p2pcp/internal/path"
+	"p2pcp/internal/prompt"
+	"p2pcp/internal/qr"
 	"p2pcp/internal/receive"
+	"p2pcp/internal/ticket"
+	"p2pcp/internal/transfer"
+	"p2pcp/internal/trust"
+	"p2pcp/internal/wordcode"
 
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
 	"github.com/spf13/cobra"
 )
 
 var ReceiveCmd = &cobra.Command{
-	Use:   "receive id [path]",
+	Use:   "receive {id | ticket | --from name | --qr-image png} [path]",
 	Short: "Receives file/directory from remote peer to specified directory",
 	Args: func(cmd *cobra.Command, args []string) error {
-		if err := cobra.RangeArgs(1, 2)(cmd, args); err != nil {
+		validateArgs := cobra.RangeArgs(1, 2)
+		from, _ := cmd.Flags().GetString("from")
+		qrImage, _ := cmd.Flags().GetString("qr-image")
+		if from != "" || qrImage != "" {
+			validateArgs = cobra.MaximumNArgs(1)
+		}
+		if err := validateArgs(cmd, args); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			fmt.Println()
 			cmd.Usage()
@@ -25,17 +42,41 @@ var ReceiveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 
-		id := args[0]
-		if len(id) < 7 {
-			return fmt.Errorf("id: must be at least 7 characters long")
+		from, _ := cmd.Flags().GetString("from")
+		if qrImage, _ := cmd.Flags().GetString("qr-image"); qrImage != "" && from == "" {
+			content, err := qr.Decode(qrImage)
+			if err != nil {
+				return fmt.Errorf("qr-image: %w", err)
+			}
+			args = append([]string{content}, args...)
 		}
 
-		var basePath string
+		var id string
+		var t *ticket.Ticket
 		var err error
-		if len(args) == 1 {
+		if from == "" && ticket.IsTicket(args[0]) {
+			parsed, err := ticket.Parse(args[0])
+			if err != nil {
+				return fmt.Errorf("ticket: %w", err)
+			}
+			t = &parsed
+			args = args[1:]
+		} else if from == "" {
+			id, err = parseID(args[0])
+			if err != nil {
+				return err
+			}
+			if len(id) < 7 {
+				return fmt.Errorf("id: must be at least 7 characters long")
+			}
+			args = args[1:]
+		}
+
+		var basePath string
+		if len(args) == 0 {
 			basePath = path.GetCurrentDirectory()
 		} else {
-			basePath = path.GetAbsolutePath(args[1])
+			basePath = path.GetAbsolutePath(args[0])
 		}
 		info, err := os.Lstat(basePath)
 		if err != nil {
@@ -45,16 +86,163 @@ var ReceiveCmd = &cobra.Command{
 			return fmt.Errorf("path: %s is not a directory", basePath)
 		}
 
+		private, _ := cmd.Flags().GetBool("private")
+		yes, _ := cmd.Flags().GetBool("yes")
+		pick, _ := cmd.Flags().GetBool("pick")
+		resume, _ := cmd.Flags().GetBool("resume")
+		sync, _ := cmd.Flags().GetBool("sync")
+		mirror, _ := cmd.Flags().GetBool("mirror")
+		if deleteExtraneous, _ := cmd.Flags().GetBool("delete"); deleteExtraneous {
+			mirror = true
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun && !mirror {
+			return fmt.Errorf("dry-run: only supported with --mirror")
+		}
+		var preserve transfer.Preserve
+		preserve.Owner, _ = cmd.Flags().GetBool("owner")
+		preserve.Xattrs, _ = cmd.Flags().GetBool("xattrs")
+		preserve.ACLs, _ = cmd.Flags().GetBool("acls")
+		preserve.SymlinkTimes, _ = cmd.Flags().GetBool("symlink-times")
+		preserve.Specials, _ = cmd.Flags().GetBool("specials")
+		onConflict, _ := cmd.Flags().GetString("on-conflict")
+		conflictPolicy, err := transfer.ParseConflictPolicy(onConflict)
+		if err != nil {
+			return fmt.Errorf("on-conflict: %w", err)
+		}
+		if mirror && conflictPolicy != transfer.ConflictOverwrite {
+			return fmt.Errorf("on-conflict: only overwrite is supported with --mirror")
+		}
+		atomic, _ := cmd.Flags().GetBool("atomic")
+		if atomic && resume {
+			return fmt.Errorf("atomic: not supported with --resume")
+		}
+		include, _ := cmd.Flags().GetStringArray("include")
+		exclude, _ := cmd.Flags().GetStringArray("exclude")
+		entryFilter := filter.Filter{Include: include, Exclude: exclude}
+		if err := entryFilter.Validate(); err != nil {
+			return fmt.Errorf("include/exclude: %w", err)
+		}
+		var maxSize int64
+		if value, _ := cmd.Flags().GetString("max-size"); value != "" {
+			maxSize, err = transfer.ParseSize(value)
+			if err != nil {
+				return fmt.Errorf("max-size: %w", err)
+			}
+		}
+
+		if from != "" {
+			paired, err := trust.LoadPaired(from)
+			if err != nil {
+				return fmt.Errorf("from: %w", err)
+			}
+			// Pairing is bound to the persistent identity.
+			key, err := identity.Load()
+			if err != nil {
+				return err
+			}
+			slog.Debug("Receiving...", "from", from, "path", basePath, "private", private)
+			return receive.ReceivePaired(ctx, paired, basePath, receive.Options{
+				Private:    private,
+				Identity:   key,
+				Yes:        yes,
+				MaxSize:    maxSize,
+				Filter:     entryFilter,
+				Pick:       pick,
+				Resume:     resume,
+				Sync:       sync,
+				Mirror:     mirror,
+				DryRun:     dryRun,
+				Preserve:   preserve,
+				OnConflict: conflictPolicy,
+				Atomic:     atomic,
+			})
+		}
+
+		legacyAuth, _ := cmd.Flags().GetBool("legacy-auth")
+		skipVerify, _ := cmd.Flags().GetBool("skip-verify")
+		if skipVerify && legacyAuth {
+			return fmt.Errorf("skip-verify: not supported with --legacy-auth, which doesn't authenticate the sender")
+		}
+		useIdentity, _ := cmd.Flags().GetBool("identity")
+		key, err := identity.Get(useIdentity)
+		if err != nil {
+			return err
+		}
+		options := receive.Options{
+			Private:    private,
+			LegacyAuth: legacyAuth,
+			SkipVerify: skipVerify,
+			Identity:   key,
+			Yes:        yes,
+			MaxSize:    maxSize,
+			Filter:     entryFilter,
+			Pick:       pick,
+			Resume:     resume,
+			Sync:       sync,
+			Mirror:     mirror,
+			DryRun:     dryRun,
+			Preserve:   preserve,
+			OnConflict: conflictPolicy,
+			Atomic:     atomic,
+		}
+
+		if t != nil {
+			slog.Debug("Receiving...", "sender", t.Peer, "addrs", t.Addrs, "path", basePath, "private", private)
+			return receive.ReceiveTicket(ctx, *t, basePath, options)
+		}
+
 		fmt.Printf("Enter PIN/token: ")
-		var secret string
-		fmt.Scanln(&secret)
+		secret, err := auth.ParseSecret(prompt.ReadLine())
+		if err != nil {
+			return fmt.Errorf("PIN/token: %w", err)
+		}
 		if len(secret) < 6 {
 			return fmt.Errorf("PIN/token: must be at least 6 characters long")
 		}
+		if _, err := peer.Decode(id); err != nil {
+			secret = auth.NormalizePin(secret) // Tokens of strict mode come with the full node ID.
+		}
 
-		private, _ := cmd.Flags().GetBool("private")
-
-		slog.Debug("Receiving...", "id", id, "path", basePath, "private", private)
-		return receive.Receive(ctx, id, secret, basePath, private)
+		slog.Debug("Receiving...", "id", id, "path", basePath, "private", private, "legacyAuth", legacyAuth)
+		return receive.Receive(ctx, id, secret, basePath, options)
 	},
 }
+
+// Accepts the strict mode ID in its word form.
+func parseID(id string) (string, error) {
+	if wordcode.Length(id) <= 1 {
+		return id, nil
+	}
+	bytes, err := wordcode.Decode(id)
+	if err != nil {
+		return "", fmt.Errorf("id: %w", err)
+	}
+	if len(bytes) != 32 {
+		return "", fmt.Errorf("id: invalid node ID")
+	}
+	return b58.Encode(bytes), nil
+}
+
+func init() {
+	ReceiveCmd.Flags().Bool("skip-verify", false, "skip the random art confirmation of the sender, relying on mutual authentication")
+	ReceiveCmd.Flags().String("qr-image", "", "read the ID or ticket from the QR code in a PNG/JPEG image")
+	ReceiveCmd.Flags().BoolP("yes", "y", false, "accept the transfer without asking after showing its summary")
+	ReceiveCmd.Flags().String("max-size", "", "reject transfers larger than this size, e.g. 500MB or 2GiB")
+	ReceiveCmd.Flags().StringArray("include", nil, "only receive entries matching the glob, e.g. '*.log' or 'logs/**', can be repeated")
+	ReceiveCmd.Flags().StringArray("exclude", nil, "skip entries matching the glob, can be repeated")
+	ReceiveCmd.Flags().Bool("pick", false, "pick the entries to receive from the listing of the sender")
+	ReceiveCmd.Flags().Bool("resume", false, "keep a journal in the target directory to resume an interrupted transfer of the same content")
+	ReceiveCmd.Flags().Bool("sync", false, "only receive what changed compared to the files already in the target directory")
+	ReceiveCmd.Flags().Bool("mirror", false, "delete the entries of the received directories that the sender doesn't have")
+	ReceiveCmd.Flags().Bool("delete", false, "same as --mirror")
+	ReceiveCmd.Flags().Bool("atomic", false, "stage the whole transfer and move it into the target directory only once it succeeded")
+	ReceiveCmd.Flags().String("on-conflict", "overwrite", "how to handle entries that already exist: overwrite, skip, rename, newer, fail or ask")
+	ReceiveCmd.Flags().Bool("dry-run", false, "only list what --mirror would delete, without receiving anything")
+	ReceiveCmd.Flags().Bool("owner", false, "preserve the user and group IDs of the sender, only when running as root")
+	ReceiveCmd.Flags().Bool("xattrs", false, "preserve extended attributes, except those of the security, system and trusted namespaces")
+	ReceiveCmd.Flags().Bool("acls", false, "preserve POSIX ACLs")
+	ReceiveCmd.Flags().Bool("symlink-times", false, "preserve the times of symbolic links themselves, times of files and directories always are")
+	ReceiveCmd.Flags().Bool("specials", false, "recreate FIFOs, and device nodes when running as root")
+	ReceiveCmd.Flags().String("from", "", "receive from the paired device with the specified nickname, without PIN/token")
+}
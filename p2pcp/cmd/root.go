@@ -6,8 +6,10 @@ import (
 	"os"
 	"project/pkg/project"
 
+	"p2pcp/cmd/pair"
 	"p2pcp/cmd/receive"
 	"p2pcp/cmd/send"
+	"p2pcp/cmd/trust"
 	"p2pcp/internal/errors"
 	"p2pcp/pkg/config"
 
@@ -37,6 +39,8 @@ func init() {
 
 	RootCmd.PersistentFlags().BoolP("debug", "d", false, "show debug logs")
 	RootCmd.PersistentFlags().BoolP("private", "p", false, "only connect to private networks")
+	RootCmd.PersistentFlags().Bool("legacy-auth", false, "allow the insecure hash-of-PIN authentication and unbound transfers of older versions, without manifest, hashes or receive options")
+	RootCmd.PersistentFlags().Bool("identity", false, "use the persistent identity key stored in the config directory")
 	RootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		config.LoadConfig()
 
@@ -50,5 +54,7 @@ func init() {
 
 	RootCmd.AddCommand(send.SendCmd)
 	RootCmd.AddCommand(receive.ReceiveCmd)
+	RootCmd.AddCommand(trust.TrustCmd)
+	RootCmd.AddCommand(pair.PairCmd)
 	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
 }
@@ -0,0 +1,41 @@
+package send
+
+import (
+	"fmt"
+	"p2pcp/internal/auth"
+	"p2pcp/pkg/config"
+
+	"github.com/spf13/cobra"
+)
+
+// Adds the flags of the PIN policy, which override the config.
+func AddPinFlags(cmd *cobra.Command) {
+	defaults := config.NewConfig()
+	cmd.Flags().Int("pin-length", defaults.PinLength, "number of digits, words or characters of the PIN")
+	cmd.Flags().String("pin-alphabet", defaults.PinAlphabet, "alphabet of the PIN: digits, words or base32")
+	cmd.Flags().Int("attempts", defaults.MaxAttempts, "number of PIN attempts allowed before aborting")
+}
+
+func GetPinOptions(cmd *cobra.Command) (auth.PinPolicy, int, error) {
+	cfg := config.GetConfig()
+	policy := auth.PinPolicy{Length: cfg.PinLength, Alphabet: auth.PinAlphabet(cfg.PinAlphabet)}
+	maxAttempts := cfg.MaxAttempts
+	if cmd.Flags().Changed("pin-length") {
+		policy.Length, _ = cmd.Flags().GetInt("pin-length")
+	}
+	if cmd.Flags().Changed("pin-alphabet") {
+		alphabet, _ := cmd.Flags().GetString("pin-alphabet")
+		policy.Alphabet = auth.PinAlphabet(alphabet)
+	}
+	if cmd.Flags().Changed("attempts") {
+		maxAttempts, _ = cmd.Flags().GetInt("attempts")
+	}
+
+	if err := policy.Validate(); err != nil {
+		return policy, maxAttempts, fmt.Errorf("pin: %w", err)
+	}
+	if maxAttempts < 1 {
+		return policy, maxAttempts, fmt.Errorf("attempts: must be at least 1")
+	}
+	return policy, maxAttempts, nil
+}
@@ -2,47 +2,172 @@ package send
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"p2pcp/internal/filter"
+	"p2pcp/internal/identity"
 	"p2pcp/internal/path"
 	"p2pcp/internal/send"
+	"p2pcp/internal/transfer"
+	"p2pcp/internal/trust"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
 
 var SendCmd = &cobra.Command{
-	Use:   "send [path]",
-	Short: "Sends the specified file/directory to remote peer",
-	Args: func(cmd *cobra.Command, args []string) error {
-		if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Println()
-			cmd.Usage()
-			os.Exit(1)
-		}
-		return nil
-	},
+	Use:   "send [path]... [-]",
+	Short: "Sends the specified files/directories, and stdin for -, to remote peer",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 
-		var basePath string
+		// Paths are sent under their base names, stdin as a file of the specified name.
+		var basePaths []string
+		stdin := false
+		for _, arg := range args {
+			if arg == "-" {
+				if stdin {
+					return fmt.Errorf("-: stdin can only be sent once")
+				}
+				stdin = true
+				continue
+			}
+			basePath := path.GetAbsolutePath(arg)
+			if _, err := os.Lstat(basePath); err != nil {
+				return err
+			}
+			basePaths = append(basePaths, basePath)
+		}
 		if len(args) == 0 {
-			basePath = path.GetCurrentDirectory()
-		} else {
-			basePath = path.GetAbsolutePath(args[0])
+			basePaths = []string{path.GetCurrentDirectory()}
 		}
-		if _, err := os.Lstat(basePath); err != nil {
-			return err
+		stdinName, _ := cmd.Flags().GetString("name")
+		if cmd.Flags().Changed("name") && !stdin {
+			return fmt.Errorf("name: only used when sending stdin with -")
 		}
 
 		strict, _ := cmd.Flags().GetBool("strict")
+		words, _ := cmd.Flags().GetBool("words")
+		showQR, _ := cmd.Flags().GetBool("qr")
+		if words && !strict {
+			return fmt.Errorf("words: only available in strict mode, see --pin-alphabet otherwise")
+		}
 		private, _ := cmd.Flags().GetBool("private")
+		legacyAuth, _ := cmd.Flags().GetBool("legacy-auth")
+		useIdentity, _ := cmd.Flags().GetBool("identity")
+		to, _ := cmd.Flags().GetString("to")
+		include, _ := cmd.Flags().GetStringArray("include")
+		exclude, _ := cmd.Flags().GetStringArray("exclude")
+		ignoreFiles, _ := cmd.Flags().GetStringArray("ignore-file")
+		entryFilter := filter.Filter{Include: include, Exclude: exclude}
+		if err := entryFilter.Validate(); err != nil {
+			return fmt.Errorf("include/exclude: %w", err)
+		}
+		value, _ := cmd.Flags().GetString("compression")
+		compression, err := transfer.ParseCompression(value)
+		if err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+		streams, _ := cmd.Flags().GetInt("streams")
+		if streams < 1 || streams > transfer.MaxStreams {
+			return fmt.Errorf("streams: must be between 1 and %d", transfer.MaxStreams)
+		}
+		value, _ = cmd.Flags().GetString("symlinks")
+		symlinks, err := transfer.ParseSymlinkPolicy(value)
+		if err != nil {
+			return fmt.Errorf("symlinks: %w", err)
+		}
+		receivers, _ := cmd.Flags().GetInt("receivers")
+		untilCancel, _ := cmd.Flags().GetBool("until-cancel")
+		concurrent, _ := cmd.Flags().GetBool("concurrent")
+		if receivers < 1 {
+			return fmt.Errorf("receivers: must be at least 1")
+		}
+		if untilCancel {
+			receivers = 0
+		}
+		if to != "" && receivers != 1 {
+			return fmt.Errorf("to: only a single receiver is supported")
+		}
+		if stdin && receivers != 1 {
+			return fmt.Errorf("-: stdin can only be sent to a single receiver")
+		}
+		var stdinReader io.Reader
+		if stdin {
+			stdinReader = os.Stdin
+		}
+
+		if to != "" {
+			paired, err := trust.LoadPaired(to)
+			if err != nil {
+				return fmt.Errorf("to: %w", err)
+			}
+			// Pairing is bound to the persistent identity.
+			key, err := identity.Load()
+			if err != nil {
+				return err
+			}
+			slog.Debug(fmt.Sprintf("Sending %s to %s...", strings.Join(basePaths, ", "), to), "stdin", stdin, "private", private)
+			return send.SendPaired(ctx, basePaths, paired, send.Options{
+				Private:     private,
+				Identity:    key,
+				Filter:      entryFilter,
+				IgnoreFiles: ignoreFiles,
+				Compression: compression,
+				Streams:     streams,
+				Symlinks:    symlinks,
+				Stdin:       stdinReader,
+				StdinName:   stdinName,
+			})
+		}
+
+		key, err := identity.Get(useIdentity)
+		if err != nil {
+			return err
+		}
+		pin, maxAttempts, err := GetPinOptions(cmd)
+		if err != nil {
+			return err
+		}
 
-		slog.Debug(fmt.Sprintf("Sending %s...", basePath), "strict", strict, "private", private)
-		return send.Send(ctx, basePath, strict, private)
+		slog.Debug(fmt.Sprintf("Sending %s...", strings.Join(basePaths, ", ")), "stdin", stdin, "strict", strict, "private", private, "legacyAuth", legacyAuth)
+		return send.Send(ctx, basePaths, send.Options{
+			Strict:      strict,
+			Words:       words,
+			QR:          showQR,
+			Private:     private,
+			Pin:         pin,
+			MaxAttempts: maxAttempts,
+			LegacyAuth:  legacyAuth,
+			Identity:    key,
+			Receivers:   receivers,
+			Concurrent:  concurrent,
+			Filter:      entryFilter,
+			IgnoreFiles: ignoreFiles,
+			Compression: compression,
+			Streams:     streams,
+			Symlinks:    symlinks,
+			Stdin:       stdinReader,
+			StdinName:   stdinName,
+		})
 	},
 }
 
 func init() {
 	SendCmd.Flags().BoolP("strict", "s", false, "use strict mode, this will generate a long secret for authentication")
+	SendCmd.Flags().Bool("words", false, "show the ID and token of strict mode as words with checksum, easier to read out")
+	SendCmd.Flags().Bool("qr", false, "show the ticket for the receiver as QR code")
+	AddPinFlags(SendCmd)
+	SendCmd.Flags().String("to", "", "send to the paired device with the specified nickname, without PIN/token")
+	SendCmd.Flags().StringArray("include", nil, "only send entries matching the glob, e.g. '*.go' or 'src/**', can be repeated")
+	SendCmd.Flags().StringArray("exclude", nil, "skip entries matching the glob, e.g. node_modules, can be repeated")
+	SendCmd.Flags().StringArray("ignore-file", nil, "also honor ignore files with this name in every directory besides .p2pcpignore, e.g. .gitignore")
+	SendCmd.Flags().String("compression", "zstd", "codec and optional level, e.g. zstd:19, one of zstd, lz4, gzip or none, files that look compressed already are sent as is")
+	SendCmd.Flags().Int("streams", 1, "number of parallel streams for the content of files, for high-bandwidth links")
+	SendCmd.Flags().String("symlinks", "preserve", "how to send symbolic links: preserve those within the path, follow them, skip them or error on those pointing outside")
+	SendCmd.Flags().String("name", "stdin", "name of the file stdin is received as when sending -")
+	SendCmd.Flags().Int("receivers", 1, "number of receivers to send to, all using the same PIN/token")
+	SendCmd.Flags().Bool("until-cancel", false, "send to receivers until canceled with Ctrl+C")
+	SendCmd.Flags().Bool("concurrent", false, "send to several receivers concurrently instead of one after another")
 }
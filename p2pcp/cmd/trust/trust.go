@@ -0,0 +1,71 @@
+package trust
+
+import (
+	"fmt"
+	"p2pcp/internal/trust"
+
+	"github.com/spf13/cobra"
+)
+
+var TrustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Manages trusted peers, whose random art confirmation is skipped when receiving",
+}
+
+var addCmd = &cobra.Command{
+	Use:   "add name id",
+	Short: "Trusts the peer with the specified node ID under a nickname",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := trust.Load()
+		if err != nil {
+			return err
+		}
+		if err := store.Add(args[0], args[1]); err != nil {
+			return err
+		}
+		return store.Save()
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists trusted peers",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := trust.Load()
+		if err != nil {
+			return err
+		}
+		for _, peer := range store.Peers {
+			if peer.IsPaired() {
+				fmt.Printf("%s\t%s\t(paired)\n", peer.Name, peer.ID)
+			} else {
+				fmt.Printf("%s\t%s\n", peer.Name, peer.ID)
+			}
+		}
+		return nil
+	},
+}
+
+var removeCmd = &cobra.Command{
+	Use:   "remove name",
+	Short: "Removes a trusted peer",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := trust.Load()
+		if err != nil {
+			return err
+		}
+		if err := store.Remove(args[0]); err != nil {
+			return err
+		}
+		return store.Save()
+	},
+}
+
+func init() {
+	TrustCmd.AddCommand(addCmd)
+	TrustCmd.AddCommand(listCmd)
+	TrustCmd.AddCommand(removeCmd)
+}
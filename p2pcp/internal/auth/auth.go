@@ -3,11 +3,11 @@ package auth
 import (
 	"crypto/rand"
 	"crypto/subtle"
+	"encoding/base32"
 	"fmt"
 	"io"
-	"math/big"
 	"p2pcp/internal/errors"
-	"strings"
+	"p2pcp/internal/wordcode"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -15,30 +15,45 @@ import (
 	"moul.io/drunken-bishop/drunkenbishop"
 )
 
-const Protocol protocol.ID = "/p2pcp/auth/1.0.0"
+// Hash-of-secret authentication, only negotiated on explicit opt-in for older peers.
+const LegacyProtocol protocol.ID = "/p2pcp/auth/1.0.0"
 
 const authenticationTimeout = 10 * time.Second
 
-const pinLength = 6
-
 func ComputeHash(input []byte) []byte {
 	hash := blake2b.Sum256(input)
 	return hash[:]
 }
 
-// 6-digit PIN
-func GetOneTimeSecret() string {
-	digits := make([]string, pinLength)
-	for i := range digits {
-		n, err := rand.Int(rand.Reader, big.NewInt(10))
-		errors.Unexpected(err, "GetOneTimeSecret: rand.Int")
-		digits[i] = n.String()
-	}
-	return strings.Join(digits, "")
-}
+const strongSecretSize = 16
 
+var strongSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// 128-bit base32 token
 func GetStrongSecret() string {
-	return rand.Text()
+	secret := make([]byte, strongSecretSize)
+	_, err := rand.Read(secret)
+	errors.Unexpected(err, "GetStrongSecret: rand.Read")
+	return strongSecretEncoding.EncodeToString(secret)
+}
+
+// Renders a token as words with checksum, easier to read out.
+func StrongSecretToWords(secret string) string {
+	bytes, err := strongSecretEncoding.DecodeString(secret)
+	errors.Unexpected(err, "StrongSecretToWords: DecodeString")
+	return wordcode.Encode(bytes)
+}
+
+// Accepts a PIN, a token or the word form of a token, whose checksum is validated.
+func ParseSecret(input string) (string, error) {
+	if wordcode.Length(input) != wordcode.EncodedLength(strongSecretSize) {
+		return NormalizeSecret(input), nil
+	}
+	bytes, err := wordcode.Decode(input)
+	if err != nil {
+		return "", err
+	}
+	return strongSecretEncoding.EncodeToString(bytes), nil
 }
 
 func RandomArt(bytes []byte) string {
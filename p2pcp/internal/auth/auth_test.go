@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,7 +27,7 @@ func TestGetOneTimeSecret(t *testing.T) {
 	secrets := make(map[string]bool)
 	chars := make(map[string]bool)
 	for range 1000 {
-		secret := GetOneTimeSecret()
+		secret := GetOneTimeSecret(DefaultPinPolicy())
 		require.Len(t, secret, 6)
 		secrets[secret] = true
 		for _, char := range secret {
@@ -144,3 +145,31 @@ func TestAuthenticate_ErrorRead(t *testing.T) {
 	assert.True(t, stream.readClosed)
 	assert.True(t, stream.writeClosed)
 }
+
+func TestStrongSecretWords(t *testing.T) {
+	secret := GetStrongSecret()
+	words := StrongSecretToWords(secret)
+	assert.Len(t, strings.Split(words, "-"), 18)
+
+	parsed, err := ParseSecret(words)
+	require.NoError(t, err)
+	assert.Equal(t, secret, parsed)
+	parsed, err = ParseSecret(strings.ToUpper(strings.ReplaceAll(words, "-", " ")))
+	require.NoError(t, err)
+	assert.Equal(t, secret, parsed)
+
+	// Typos are caught by the checksum.
+	parts := strings.Split(words, "-")
+	parts[0], parts[1] = parts[1], parts[0]
+	if parts[0] != parts[1] {
+		_, err = ParseSecret(strings.Join(parts, "-"))
+		assert.ErrorContains(t, err, "checksum mismatch")
+	}
+
+	parsed, err = ParseSecret(secret)
+	require.NoError(t, err)
+	assert.Equal(t, secret, parsed)
+	parsed, err = ParseSecret("apple banana cherry")
+	require.NoError(t, err)
+	assert.Equal(t, "APPLE-BANANA-CHERRY", parsed)
+}
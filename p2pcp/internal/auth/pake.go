@@ -0,0 +1,203 @@
+package auth
+
+// spell-checker: ignore CPace circl
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"p2pcp/internal/errors"
+	"time"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Password-authenticated key exchange following CPace over ristretto255.
+// Neither a failed nor a spoofed exchange reveals anything useful for an
+// offline attack on the secret, and the result is bound to both peer IDs.
+// Both sides prove knowledge of the secret with a key confirmation tag.
+const Protocol protocol.ID = "/p2pcp/auth/2.0.0"
+
+const pakeDomain = "p2pcp/auth/CPace-ristretto255"
+
+const sessionIDSize = 16
+
+var curve = group.Ristretto255
+
+var shareSize = int(curve.Params().CompressedElementLength)
+
+var tagSize = blake2b.Size256
+
+var ErrSenderAuthentication = fmt.Errorf("sender failed to prove knowledge of the secret")
+
+func appendPrefixed(buffer []byte, data []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+// Keyed BLAKE2b over the length-prefixed data.
+func computeMAC(key []byte, data ...[]byte) []byte {
+	mac, err := blake2b.New256(key)
+	errors.Unexpected(err, "computeMAC: blake2b.New256")
+	for _, d := range data {
+		mac.Write(appendPrefixed(nil, d))
+	}
+	return mac.Sum(nil)
+}
+
+type pake struct {
+	isReceiver bool
+	sessionID  []byte
+	scalar     group.Scalar
+	share      []byte
+}
+
+func newPake(isReceiver bool, secret []byte, sessionID []byte, receiver peer.ID, sender peer.ID) *pake {
+	var input []byte
+	input = appendPrefixed(input, secret)
+	input = appendPrefixed(input, []byte(receiver))
+	input = appendPrefixed(input, []byte(sender))
+	input = appendPrefixed(input, sessionID)
+	generator := curve.HashToElement(input, []byte(pakeDomain))
+
+	scalar := curve.RandomNonZeroScalar(rand.Reader)
+	share, err := curve.NewElement().Mul(generator, scalar).MarshalBinaryCompress()
+	errors.Unexpected(err, "newPake: MarshalBinaryCompress")
+	return &pake{isReceiver: isReceiver, sessionID: sessionID, scalar: scalar, share: share}
+}
+
+// Derives the intermediate key from the share of the other side.
+func (p *pake) deriveKey(peerShare []byte) ([]byte, error) {
+	receiverShare, senderShare := p.share, peerShare
+	if !p.isReceiver {
+		receiverShare, senderShare = peerShare, p.share
+	}
+	element := curve.NewElement()
+	if err := element.UnmarshalBinary(peerShare); err != nil {
+		return nil, fmt.Errorf("invalid key share: %w", err)
+	}
+	sharedElement := curve.NewElement().Mul(element, p.scalar)
+	if sharedElement.IsIdentity() {
+		return nil, fmt.Errorf("invalid key share: identity element")
+	}
+	shared, err := sharedElement.MarshalBinaryCompress()
+	errors.Unexpected(err, "deriveKey: MarshalBinaryCompress")
+
+	var transcript []byte
+	transcript = appendPrefixed(transcript, []byte(pakeDomain))
+	transcript = appendPrefixed(transcript, p.sessionID)
+	transcript = appendPrefixed(transcript, shared)
+	transcript = appendPrefixed(transcript, receiverShare)
+	transcript = appendPrefixed(transcript, senderShare)
+	hash := blake2b.Sum256(transcript)
+	return hash[:], nil
+}
+
+func receiverTag(key []byte) []byte {
+	return computeMAC(key, []byte("receiver"))
+}
+
+func senderTag(key []byte) []byte {
+	return computeMAC(key, []byte("sender"))
+}
+
+func computeSessionKey(key []byte) []byte {
+	return computeMAC(key, []byte("session"))
+}
+
+func handleKeyExchange(stream io.ReadWriter, secret []byte, receiver peer.ID, sender peer.ID) ([]byte, *bool, error) {
+	buffer := make([]byte, sessionIDSize+shareSize)
+	if _, err := io.ReadFull(stream, buffer); err != nil {
+		return nil, nil, err
+	}
+	sessionID, receiverShare := buffer[:sessionIDSize], buffer[sessionIDSize:]
+
+	p := newPake(false, secret, sessionID, receiver, sender)
+	key, err := p.deriveKey(receiverShare)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := stream.Write(p.share); err != nil {
+		return nil, nil, err
+	}
+
+	tag := make([]byte, tagSize)
+	if _, err := io.ReadFull(stream, tag); err != nil {
+		return nil, nil, err
+	}
+	result := subtle.ConstantTimeCompare(tag, receiverTag(key))
+	success := result == 1
+	if _, err = stream.Write([]byte{byte(result)}); err != nil {
+		return nil, &success, err
+	}
+	if !success {
+		return nil, &success, nil
+	}
+	if _, err = stream.Write(senderTag(key)); err != nil {
+		return nil, &success, err
+	}
+	return computeSessionKey(key), &success, nil
+}
+
+// Runs the sender's side of the key exchange.
+// Returns a nil result if the exchange did not complete, otherwise whether the receiver knows the secret.
+func HandleKeyExchange(stream io.ReadWriteCloser, secret []byte, receiver peer.ID, sender peer.ID) ([]byte, *bool, error) {
+	timer := time.AfterFunc(authenticationTimeout, func() {
+		stream.Close()
+	})
+	defer stream.Close()
+
+	sessionKey, success, err := handleKeyExchange(stream, secret, receiver, sender)
+	if !timer.Stop() {
+		return nil, nil, fmt.Errorf("authentication timed out")
+	}
+	return sessionKey, success, err
+}
+
+// Runs the receiver's side of the key exchange, returns the session key on success.
+// Fails with an error if the sender cannot prove knowledge of the secret.
+func KeyExchange(stream io.ReadWriteCloser, secret []byte, receiver peer.ID, sender peer.ID) ([]byte, bool, error) {
+	defer stream.Close()
+
+	sessionID := make([]byte, sessionIDSize)
+	_, err := rand.Read(sessionID)
+	errors.Unexpected(err, "KeyExchange: rand.Read")
+
+	p := newPake(true, secret, sessionID, receiver, sender)
+	if _, err := stream.Write(append(sessionID, p.share...)); err != nil {
+		return nil, false, err
+	}
+
+	senderShare := make([]byte, shareSize)
+	if _, err := io.ReadFull(stream, senderShare); err != nil {
+		return nil, false, err
+	}
+	key, err := p.deriveKey(senderShare)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err := stream.Write(receiverTag(key)); err != nil {
+		return nil, false, err
+	}
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(stream, result); err != nil {
+		return nil, false, err
+	}
+	if result[0] != 1 {
+		return nil, false, nil
+	}
+	tag := make([]byte, tagSize)
+	if _, err := io.ReadFull(stream, tag); err != nil {
+		return nil, false, err
+	}
+	if subtle.ConstantTimeCompare(tag, senderTag(key)) != 1 {
+		return nil, false, ErrSenderAuthentication
+	}
+	return computeSessionKey(key), true, nil
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyExchangeResult struct {
+	sessionKey []byte
+	success    *bool
+	err        error
+}
+
+func runKeyExchange(
+	receiverSecret []byte, senderSecret []byte,
+	receiverView [2]peer.ID, senderView [2]peer.ID,
+) (receiverResult keyExchangeResult, senderResult keyExchangeResult) {
+	receiverConn, senderConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		senderResult.sessionKey, senderResult.success, senderResult.err = HandleKeyExchange(
+			senderConn, senderSecret, senderView[0], senderView[1])
+	}()
+	sessionKey, success, err := KeyExchange(receiverConn, receiverSecret, receiverView[0], receiverView[1])
+	receiverResult = keyExchangeResult{sessionKey: sessionKey, success: &success, err: err}
+	<-done
+	return receiverResult, senderResult
+}
+
+func TestKeyExchange(t *testing.T) {
+	peers := [2]peer.ID{"receiver", "sender"}
+	receiverResult, senderResult := runKeyExchange([]byte("123456"), []byte("123456"), peers, peers)
+	require.NoError(t, receiverResult.err)
+	require.NoError(t, senderResult.err)
+	require.NotNil(t, senderResult.success)
+	assert.True(t, *senderResult.success)
+	assert.True(t, *receiverResult.success)
+	assert.Len(t, receiverResult.sessionKey, 32)
+	assert.Equal(t, receiverResult.sessionKey, senderResult.sessionKey)
+
+	// Session keys are fresh for each exchange.
+	otherResult, _ := runKeyExchange([]byte("123456"), []byte("123456"), peers, peers)
+	assert.NotEqual(t, receiverResult.sessionKey, otherResult.sessionKey)
+}
+
+func TestKeyExchange_WrongSecret(t *testing.T) {
+	peers := [2]peer.ID{"receiver", "sender"}
+	receiverResult, senderResult := runKeyExchange([]byte("123456"), []byte("654321"), peers, peers)
+	require.NoError(t, receiverResult.err)
+	require.NoError(t, senderResult.err)
+	require.NotNil(t, senderResult.success)
+	assert.False(t, *senderResult.success)
+	assert.False(t, *receiverResult.success)
+	assert.Nil(t, receiverResult.sessionKey)
+	assert.Nil(t, senderResult.sessionKey)
+}
+
+func TestKeyExchange_PeerBinding(t *testing.T) {
+	receiverView := [2]peer.ID{"receiver", "sender"}
+	senderView := [2]peer.ID{"receiver", "impostor"}
+	receiverResult, senderResult := runKeyExchange([]byte("123456"), []byte("123456"), receiverView, senderView)
+	require.NoError(t, receiverResult.err)
+	require.NoError(t, senderResult.err)
+	assert.False(t, *senderResult.success)
+	assert.False(t, *receiverResult.success)
+}
+
+func TestHandleKeyExchange_InvalidShare(t *testing.T) {
+	receiverConn, senderConn := net.Pipe()
+	defer receiverConn.Close()
+	go func() {
+		receiverConn.Write(make([]byte, sessionIDSize+shareSize)) // Identity element
+	}()
+	sessionKey, success, err := HandleKeyExchange(senderConn, []byte("123456"), "receiver", "sender")
+	assert.Error(t, err)
+	assert.Nil(t, success)
+	assert.Nil(t, sessionKey)
+}
+
+func TestHandleKeyExchange_Timeout(t *testing.T) {
+	stream := &testStream{}
+	timer := time.AfterFunc(authenticationTimeout, func() {})
+
+	sessionKey, success, err := HandleKeyExchange(stream, []byte("test"), "receiver", "sender")
+	assert.Nil(t, sessionKey)
+	assert.Nil(t, success)
+	assert.Error(t, err)
+	assert.True(t, stream.readClosed)
+	assert.True(t, stream.writeClosed)
+	assert.False(t, timer.Stop())
+}
+
+func TestKeyExchange_ErrorWrite(t *testing.T) {
+	stream := &testStream{}
+	stream.writeClosed = true
+	sessionKey, success, err := KeyExchange(stream, []byte("test"), "receiver", "sender")
+	assert.Nil(t, sessionKey)
+	assert.False(t, success)
+	assert.Error(t, err)
+	assert.True(t, stream.readClosed)
+}
+
+func TestKeyExchange_ImpostorSender(t *testing.T) {
+	receiverConn, senderConn := net.Pipe()
+	go func() {
+		defer senderConn.Close()
+		buffer := make([]byte, sessionIDSize+shareSize+tagSize)
+		io.ReadFull(senderConn, buffer[:sessionIDSize+shareSize])
+		share, _ := curve.Generator().MarshalBinaryCompress()
+		senderConn.Write(share)
+		io.ReadFull(senderConn, buffer[:tagSize])
+		senderConn.Write([]byte{1})
+		senderConn.Write(make([]byte, tagSize))
+	}()
+
+	sessionKey, success, err := KeyExchange(receiverConn, []byte("123456"), "receiver", "sender")
+	assert.Equal(t, ErrSenderAuthentication, err)
+	assert.False(t, success)
+	assert.Nil(t, sessionKey)
+}
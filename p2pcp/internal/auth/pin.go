@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"p2pcp/internal/errors"
+	"p2pcp/internal/wordcode"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type PinAlphabet string
+
+const (
+	PinDigits PinAlphabet = "digits"
+	PinWords  PinAlphabet = "words"
+	PinBase32 PinAlphabet = "base32" // Crockford's base32
+)
+
+var PinAlphabets = []PinAlphabet{PinDigits, PinWords, PinBase32}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const maxPinLength = 32
+
+// Keeps word PINs distinguishable from the word form of strong secrets.
+const maxPinWords = 16
+
+type PinPolicy struct {
+	Length   int // Number of digits, words or characters.
+	Alphabet PinAlphabet
+}
+
+func DefaultPinPolicy() PinPolicy {
+	return PinPolicy{Length: 6, Alphabet: PinDigits}
+}
+
+func ParsePinAlphabet(alphabet string) (PinAlphabet, error) {
+	if !slices.Contains(PinAlphabets, PinAlphabet(alphabet)) {
+		return "", fmt.Errorf("unknown PIN alphabet %s, expected one of %v", alphabet, PinAlphabets)
+	}
+	return PinAlphabet(alphabet), nil
+}
+
+// Minimum length keeping the PIN at least as strong as the default one.
+func (p PinPolicy) minLength() int {
+	if p.Alphabet == PinWords {
+		return 3 // 24 bits
+	}
+	return 6
+}
+
+func (p PinPolicy) maxLength() int {
+	if p.Alphabet == PinWords {
+		return maxPinWords
+	}
+	return maxPinLength
+}
+
+func (p PinPolicy) Validate() error {
+	if _, err := ParsePinAlphabet(string(p.Alphabet)); err != nil {
+		return err
+	}
+	if p.Length < p.minLength() || p.Length > p.maxLength() {
+		return fmt.Errorf("PIN length of %s must be between %d and %d", p.Alphabet, p.minLength(), p.maxLength())
+	}
+	return nil
+}
+
+func randomIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	errors.Unexpected(err, "GetOneTimeSecret: rand.Int")
+	return int(i.Int64())
+}
+
+func GetOneTimeSecret(policy PinPolicy) string {
+	symbols := make([]string, policy.Length)
+	for i := range symbols {
+		switch policy.Alphabet {
+		case PinWords:
+			symbols[i] = wordcode.Word(byte(randomIndex(256)))
+		case PinBase32:
+			symbols[i] = string(crockfordBase32[randomIndex(len(crockfordBase32))])
+		default:
+			symbols[i] = fmt.Sprint(randomIndex(10))
+		}
+	}
+	if policy.Alphabet == PinWords {
+		return strings.Join(symbols, "-")
+	}
+	return strings.Join(symbols, "")
+}
+
+// Characters Crockford's base32 reads as the digits they resemble.
+var crockfordAliases = strings.NewReplacer("I", "1", "L", "1", "O", "0")
+
+// Brings a typed secret into the form used for authentication,
+// tolerating case differences and spaces instead of dashes between words.
+func NormalizeSecret(secret string) string {
+	return strings.ToUpper(strings.Join(strings.FieldsFunc(secret, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-'
+	}), "-"))
+}
+
+// Normalizes a typed PIN like a secret, also reading the letters Crockford's base32 leaves out
+// as the digits they resemble. Word PINs always have several words, which are left as they are.
+func NormalizePin(pin string) string {
+	pin = NormalizeSecret(pin)
+	if strings.Contains(pin, "-") {
+		return pin
+	}
+	return crockfordAliases.Replace(pin)
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"p2pcp/internal/wordcode"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOneTimeSecret_Words(t *testing.T) {
+	secret := GetOneTimeSecret(PinPolicy{Length: 4, Alphabet: PinWords})
+	parts := strings.Split(secret, "-")
+	require.Len(t, parts, 4)
+	// All words are known, PINs have no checksum though.
+	if _, err := wordcode.Decode(secret); err != nil {
+		assert.NotContains(t, err.Error(), "unknown word")
+	}
+}
+
+func TestGetOneTimeSecret_Base32(t *testing.T) {
+	chars := make(map[rune]bool)
+	for range 1000 {
+		secret := GetOneTimeSecret(PinPolicy{Length: 8, Alphabet: PinBase32})
+		require.Len(t, secret, 8)
+		for _, char := range secret {
+			chars[char] = true
+		}
+	}
+	assert.Len(t, chars, 32)
+	for c := range chars {
+		assert.Contains(t, crockfordBase32, string(c))
+	}
+}
+
+func TestPinPolicyValidate(t *testing.T) {
+	assert.NoError(t, DefaultPinPolicy().Validate())
+	assert.NoError(t, PinPolicy{Length: 3, Alphabet: PinWords}.Validate())
+	assert.NoError(t, PinPolicy{Length: 10, Alphabet: PinBase32}.Validate())
+	assert.Error(t, PinPolicy{Length: 4, Alphabet: PinDigits}.Validate())
+	assert.Error(t, PinPolicy{Length: 2, Alphabet: PinWords}.Validate())
+	assert.Error(t, PinPolicy{Length: 17, Alphabet: PinWords}.Validate())
+	assert.Error(t, PinPolicy{Length: 33, Alphabet: PinDigits}.Validate())
+	assert.ErrorContains(t, PinPolicy{Length: 6, Alphabet: "emoji"}.Validate(), "unknown PIN alphabet")
+}
+
+func TestNormalizeSecret(t *testing.T) {
+	assert.Equal(t, "123456", NormalizeSecret(" 123456\n"))
+	assert.Equal(t, "APPLE-BANANA-CHERRY", NormalizeSecret("apple banana  cherry"))
+	assert.Equal(t, "APPLE-BANANA-CHERRY", NormalizeSecret("Apple-banana--cherry"))
+	assert.Equal(t, "7K3QZ0", NormalizeSecret("7k3qz0"))
+	token := GetStrongSecret()
+	assert.Equal(t, token, NormalizeSecret(token))
+}
+
+func TestNormalizePin(t *testing.T) {
+	assert.Equal(t, "123456", NormalizePin(" 123456\n"))
+	assert.Equal(t, "7K3QZ01", NormalizePin("7k3qzoi"))
+	assert.Equal(t, "1100AB", NormalizePin("Il0oab"))
+	assert.Equal(t, "APPLE-OLIVE-LIME", NormalizePin("apple olive lime"))
+	for range 100 {
+		pin := GetOneTimeSecret(PinPolicy{Length: 10, Alphabet: PinBase32})
+		assert.Equal(t, pin, NormalizePin(strings.ToLower(pin)))
+	}
+}
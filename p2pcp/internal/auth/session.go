@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	b58 "github.com/mr-tron/base58/base58"
+)
+
+// An authenticated peer and the key shared with it for the rest of the session.
+type Session struct {
+	Peer peer.ID
+	Key  []byte
+	// Authenticated with the legacy protocol, which derives no key. Nothing binds
+	// the later streams of the peer to the session, so it's insecure.
+	Legacy bool
+}
+
+// Computes a tag binding data to the session.
+func (s Session) Tag(data ...[]byte) []byte {
+	return computeMAC(s.Key, data...)
+}
+
+func (s Session) Verify(tag []byte, data ...[]byte) bool {
+	return subtle.ConstantTimeCompare(tag, s.Tag(data...)) == 1
+}
+
+// Tags a newly opened stream as belonging to the session.
+func (s Session) WriteStreamTag(stream io.Writer, protocol protocol.ID) error {
+	_, err := stream.Write(s.Tag([]byte("stream"), []byte(protocol)))
+	return err
+}
+
+func (s Session) VerifyStreamTag(stream io.Reader, protocol protocol.ID) (bool, error) {
+	tag := make([]byte, tagSize)
+	if _, err := io.ReadFull(stream, tag); err != nil {
+		return false, err
+	}
+	return s.Verify(tag, []byte("stream"), []byte(protocol)), nil
+}
+
+// Derives the discovery topic of paired peers from their long-term key.
+func PairingTopic(key []byte) string {
+	return b58.Encode(computeMAC(key, []byte("pairing topic")))
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTag(t *testing.T) {
+	session := Session{Peer: "peer", Key: []byte("key")}
+	tag := session.Tag([]byte("a"), []byte("bc"))
+	assert.Len(t, tag, 32)
+	assert.True(t, session.Verify(tag, []byte("a"), []byte("bc")))
+	assert.False(t, session.Verify(tag, []byte("ab"), []byte("c")))
+	assert.False(t, Session{Peer: "peer", Key: []byte("other")}.Verify(tag, []byte("a"), []byte("bc")))
+}
+
+func TestSessionStreamTag(t *testing.T) {
+	session := Session{Peer: "peer", Key: []byte("key")}
+	var buffer bytes.Buffer
+	err := session.WriteStreamTag(&buffer, "/test/1.0.0")
+	require.NoError(t, err)
+	tag := buffer.Bytes()
+
+	valid, err := session.VerifyStreamTag(bytes.NewReader(tag), "/test/1.0.0")
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = session.VerifyStreamTag(bytes.NewReader(tag), "/other/1.0.0")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	valid, err = Session{Peer: "peer", Key: []byte("stale")}.VerifyStreamTag(bytes.NewReader(tag), "/test/1.0.0")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	_, err = session.VerifyStreamTag(bytes.NewReader(tag[:10]), "/test/1.0.0")
+	assert.Error(t, err)
+}
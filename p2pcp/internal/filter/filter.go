@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Include and exclude glob patterns for slash separated paths relative to the transferred root.
+// Patterns without a slash match a name at any level, like in .gitignore, and "**" matches any
+// number of directories. A matching directory also matches everything below it.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f Filter) IsEmpty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+func (f Filter) Validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if err := validatePattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the path is included and not excluded by the patterns.
+func (f Filter) Match(name string) bool {
+	return f.Includes(name) && !f.Excludes(name)
+}
+
+// Whether the path matches an include pattern, or there are none.
+func (f Filter) Includes(name string) bool {
+	return len(f.Include) == 0 || matchAny(f.Include, name)
+}
+
+func (f Filter) Excludes(name string) bool {
+	return matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizePattern(pattern string) string {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if trimmed, ok := strings.CutPrefix(pattern, "/"); ok {
+		return trimmed // Anchored to the root.
+	}
+	if !strings.Contains(pattern, "/") {
+		return "**/" + pattern
+	}
+	return pattern
+}
+
+func validatePattern(pattern string) error {
+	normalized := normalizePattern(pattern)
+	if normalized == "" || normalized == "**/" {
+		return fmt.Errorf("empty pattern")
+	}
+	for segment := range strings.SplitSeq(normalized, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Whether the pattern matches the path or one of its parent directories.
+func Match(pattern string, name string) bool {
+	patternSegments := strings.Split(normalizePattern(pattern), "/")
+	nameSegments := strings.Split(strings.Trim(name, "/"), "/")
+	for i := 1; i <= len(nameSegments); i++ {
+		if matchSegments(patternSegments, nameSegments[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
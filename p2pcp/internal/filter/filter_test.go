@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "logs/app.log", true},
+		{"*.log", "logs/app.txt", false},
+		{"logs", "logs", true},
+		{"logs", "logs/app.txt", true},
+		{"logs", "var/logs/app.txt", true},
+		{"logs/", "logs/app.txt", true},
+		{"/logs", "logs/app.txt", true},
+		{"/logs", "var/logs/app.txt", false},
+		{"var/logs", "var/logs/app.txt", true},
+		{"var/logs", "other/var/logs/app.txt", false},
+		{"var/*.txt", "var/a.txt", true},
+		{"var/*.txt", "var/sub/a.txt", false},
+		{"var/**/*.txt", "var/a.txt", true},
+		{"var/**/*.txt", "var/sub/deep/a.txt", true},
+		{"**/build", "src/build/out", true},
+		{"a?c", "abc", true},
+		{"[ab]c", "cc", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s, %s", tt.pattern, tt.name), func(t *testing.T) {
+			assert.Equal(t, tt.expected, Match(tt.pattern, tt.name))
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := Filter{}
+	assert.True(t, f.IsEmpty())
+	assert.True(t, f.Match("anything"))
+
+	f = Filter{Include: []string{"*.log", "docs"}, Exclude: []string{"debug.log", "docs/private"}}
+	assert.False(t, f.IsEmpty())
+	assert.True(t, f.Match("app.log"))
+	assert.True(t, f.Match("sub/app.log"))
+	assert.False(t, f.Match("debug.log"))
+	assert.False(t, f.Match("app.txt"))
+	assert.True(t, f.Match("docs/readme.md"))
+	assert.False(t, f.Match("docs/private/key"))
+
+	f = Filter{Exclude: []string{"node_modules"}}
+	assert.True(t, f.Match("src/main.go"))
+	assert.False(t, f.Match("web/node_modules/lib/index.js"))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Filter{Include: []string{"*.log", "a/**/b"}, Exclude: []string{"/build/"}}.Validate())
+	assert.Error(t, Filter{Include: []string{""}}.Validate())
+	assert.Error(t, Filter{Exclude: []string{"[a"}}.Validate())
+}
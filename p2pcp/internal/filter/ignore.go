@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Name of the ignore files always honored by the sender.
+const IgnoreFileName = ".p2pcpignore"
+
+type ignoreRule struct {
+	base     string // Directory of the ignore file relative to the root, empty for the root.
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// Patterns of ignore files with .gitignore semantics: the last matching pattern wins,
+// "!" re-includes, a trailing slash only matches directories and a leading or inner
+// slash anchors the pattern to the directory of the ignore file.
+type Ignore struct {
+	rules []ignoreRule
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// Adds the patterns of an ignore file in the directory base, relative to the root.
+func (i *Ignore) Add(base string, content string) {
+	base = strings.Trim(path.Clean("/"+base), "/")
+	for line := range strings.SplitSeq(content, "\n") {
+		if rule, ok := parseIgnoreLine(line); ok {
+			rule.base = base
+			i.rules = append(i.rules, rule)
+		}
+	}
+}
+
+// Adds the patterns of the ignore file at filePath if it exists.
+func (i *Ignore) AddFile(base string, filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading ignore file %s: %w", filePath, err)
+	}
+	i.Add(base, string(content))
+	return nil
+}
+
+// Whether the path relative to the root is ignored, its parent directories are expected
+// to be checked first, as excluded directories can't be re-included.
+func (i *Ignore) IsIgnored(name string, isDir bool) bool {
+	ignored := false
+	for _, rule := range i.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		relative := name
+		if rule.base != "" {
+			var ok bool
+			relative, ok = strings.CutPrefix(name, rule.base+"/")
+			if !ok {
+				continue
+			}
+		}
+		if matchSegments(rule.segments, strings.Split(relative, "/")) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnore(t *testing.T) {
+	var ignore Ignore
+	ignore.Add("", `
+# comment
+node_modules/
+*.log
+!keep.log
+/build
+docs/*.tmp
+\#literal
+trailing   
+`)
+	ignore.Add("sub", "local.txt\n/anchored\n")
+
+	tests := []struct {
+		name     string
+		isDir    bool
+		expected bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false},
+		{"app.log", false, true},
+		{"logs/app.log", false, true},
+		{"keep.log", false, false},
+		{"logs/keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"docs/a.tmp", false, true},
+		{"docs/sub/a.tmp", false, false},
+		{"#literal", false, true},
+		{"trailing", false, true},
+		{"local.txt", false, false},
+		{"sub/local.txt", false, true},
+		{"sub/deep/local.txt", false, true},
+		{"sub/anchored", false, true},
+		{"sub/deep/anchored", false, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ignore.IsIgnored(tt.name, tt.isDir))
+		})
+	}
+}
+
+func TestIgnoreAddFile(t *testing.T) {
+	dir := t.TempDir()
+	var ignore Ignore
+	require.NoError(t, ignore.AddFile("", filepath.Join(dir, "missing")))
+	assert.False(t, ignore.IsIgnored("a.log", false))
+
+	ignoreFile := filepath.Join(dir, IgnoreFileName)
+	require.NoError(t, os.WriteFile(ignoreFile, []byte("*.log\r\n"), 0o644))
+	require.NoError(t, ignore.AddFile("", ignoreFile))
+	assert.True(t, ignore.IsIgnored("a.log", false))
+}
@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"p2pcp/internal/errors"
+	"p2pcp/pkg/config"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const keyFileName = "identity.key"
+
+func getKeyPath() string {
+	return filepath.Join(config.GetConfigDir(), keyFileName)
+}
+
+// Loads the persistent identity key, creating one on first use.
+func Load() (crypto.PrivKey, error) {
+	path := getKeyPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return create(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading identity key %s: %w", path, err)
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func create(path string) (crypto.PrivKey, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	errors.Unexpected(err, "create identity: GenerateEd25519Key")
+	data, err := crypto.MarshalPrivateKey(key)
+	errors.Unexpected(err, "create identity: MarshalPrivateKey")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating config directory: %w", err)
+	}
+	// Fails if another process created the key in the meantime.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return Load()
+		}
+		return nil, fmt.Errorf("error creating identity key %s: %w", path, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return nil, fmt.Errorf("error writing identity key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// Returns the persistent identity key if enabled by flag or config, nil for a fresh identity.
+func Get(enabled bool) (crypto.PrivKey, error) {
+	if enabled || config.GetConfig().PersistentIdentity {
+		return Load()
+	}
+	return nil, nil
+}
@@ -0,0 +1,43 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	configPath := filepath.Join(os.TempDir(), "p2pcp/test/identity")
+	workspace.ResetDir(configPath)
+	restore := workspace.SetEnv("XDG_CONFIG_HOME", configPath)
+	defer restore()
+	xdg.Reload()
+	defer xdg.Reload()
+
+	key1, err := Load()
+	require.NoError(t, err)
+	info, err := os.Stat(getKeyPath())
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	key2, err := Load()
+	require.NoError(t, err)
+	assert.True(t, key1.Equals(key2))
+
+	disabled, err := Get(false)
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+	enabled, err := Get(true)
+	require.NoError(t, err)
+	assert.True(t, key1.Equals(enabled))
+
+	err = os.WriteFile(getKeyPath(), []byte("invalid"), 0600)
+	require.NoError(t, err)
+	_, err = Load()
+	assert.ErrorContains(t, err, "invalid identity key")
+}
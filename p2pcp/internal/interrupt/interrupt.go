@@ -5,26 +5,55 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 )
 
+type registration struct {
+	ctx     context.Context
+	handler func()
+}
+
 var lock sync.Once
 
+var mutex sync.Mutex
+
+var registrations []registration
+
+// Registers a handler for the next interrupt, as long as the context is not done.
+// Handlers of concurrent transfers all run. Handlers registered while handling an interrupt
+// run on the following one, a further interrupt without any exits immediately.
 func RegisterInterruptHandler(ctx context.Context, handler func()) {
 	lock.Do(func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt)
 		go func() {
-			count := 0
+			interrupted := false
 			for range sigChan {
-				count++
-				if count == 1 {
-					fmt.Println("\nCanceling...")
-					go handler()
-				} else {
+				mutex.Lock()
+				live := slices.DeleteFunc(registrations, func(r registration) bool {
+					return r.ctx.Err() != nil
+				})
+				registrations = nil
+				mutex.Unlock()
+				if interrupted && len(live) == 0 {
 					os.Exit(1)
 				}
+				if !interrupted {
+					fmt.Println("\nCanceling...")
+				}
+				interrupted = true
+				for _, r := range live {
+					go r.handler()
+				}
 			}
 		}()
 	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	registrations = slices.DeleteFunc(registrations, func(r registration) bool {
+		return r.ctx.Err() != nil
+	})
+	registrations = append(registrations, registration{ctx: ctx, handler: handler})
 }
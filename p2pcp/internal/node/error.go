@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"p2pcp/internal/auth"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
@@ -14,42 +16,108 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
-const errorProtocol protocol.ID = "/p2pcp/error/0.1.0"
+const errorProtocol protocol.ID = "/p2pcp/error/0.2.0"
 
-func writeString(writer io.Writer, str string) error {
+// Carries plain strings, only spoken with peers of legacy sessions, which have no key to tag them.
+const legacyErrorProtocol protocol.ID = "/p2pcp/error/0.1.0"
+
+// Error messages are tagged with the session key, so only the authenticated peer of the current session can abort it.
+type errorMessage struct {
+	Message string
+	Tag     []byte
+}
+
+func writeString(writer io.Writer, session auth.Session, str string) error {
 	encoder := gob.NewEncoder(writer)
-	return encoder.Encode(str)
+	if session.Legacy {
+		return encoder.Encode(str)
+	}
+	return encoder.Encode(errorMessage{Message: str, Tag: session.Tag([]byte(errorProtocol), []byte(str))})
 }
 
-func readString(reader io.Reader) (string, error) {
+func readString(reader io.Reader, session auth.Session) (string, error) {
 	decoder := gob.NewDecoder(reader)
-	var str string
-	err := decoder.Decode(&str)
-	return str, err
+	if session.Legacy {
+		var str string
+		err := decoder.Decode(&str)
+		return str, err
+	}
+	var message errorMessage
+	err := decoder.Decode(&message)
+	if err == nil && !session.Verify(message.Tag, []byte(errorProtocol), []byte(message.Message)) {
+		err = fmt.Errorf("invalid error message tag")
+	}
+	return message.Message, err
 }
 
-func registerErrorHandler(host host.Host, peerID peer.ID, handler func(string)) {
-	host.SetStreamHandler(errorProtocol, func(stream network.Stream) {
-		defer stream.Close()
-		if stream.Conn().RemotePeer() == peerID {
-			errStr, err := readString(stream)
-			if err == nil {
-				_, err = stream.Write([]byte{1})
-			}
-			if err != nil {
-				slog.Error(fmt.Sprintf("Error processing error message: %v", err))
-			} else {
-				handler(errStr)
-			}
+type errorHandler struct {
+	session auth.Session
+	handle  func(string)
+}
+
+// Error handlers of concurrent sessions, dispatched by the remote peer.
+type errorHandlers struct {
+	mutex    sync.Mutex
+	handlers map[peer.ID]*errorHandler
+}
+
+func newErrorHandlers() *errorHandlers {
+	return &errorHandlers{handlers: make(map[peer.ID]*errorHandler)}
+}
+
+// Registers the handler of the session, replacing a previous one of the same peer.
+// Returns a function unregistering it once the session is over.
+func (h *errorHandlers) register(host host.Host, session auth.Session, handle func(string)) func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.handlers) == 0 {
+		host.SetStreamHandler(errorProtocol, h.handleStream)
+		host.SetStreamHandler(legacyErrorProtocol, h.handleStream)
+	}
+	handler := &errorHandler{session: session, handle: handle}
+	h.handlers[session.Peer] = handler
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.handlers[session.Peer] != handler {
+			return // Replaced by a later session of the peer.
+		}
+		delete(h.handlers, session.Peer)
+		if len(h.handlers) == 0 {
+			host.RemoveStreamHandler(errorProtocol)
+			host.RemoveStreamHandler(legacyErrorProtocol)
 		}
-	})
+	}
 }
 
-func sendError(ctx context.Context, host host.Host, peerID peer.ID, errStr string) {
+func (h *errorHandlers) handleStream(stream network.Stream) {
+	defer stream.Close()
+	h.mutex.Lock()
+	handler, ok := h.handlers[stream.Conn().RemotePeer()]
+	h.mutex.Unlock()
+	if !ok || handler.session.Legacy != (stream.Protocol() == legacyErrorProtocol) {
+		return
+	}
+	errStr, err := readString(stream, handler.session)
+	if err == nil {
+		_, err = stream.Write([]byte{1})
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error processing error message: %v", err))
+	} else {
+		handler.handle(errStr)
+	}
+}
+
+func sendError(ctx context.Context, host host.Host, session auth.Session, errStr string) {
 	ctx, cancel := context.WithTimeout(ctx, 6*time.Second)
 	defer cancel()
+	protocol := errorProtocol
+	if session.Legacy {
+		protocol = legacyErrorProtocol
+	}
 	for ctx.Err() == nil {
-		stream, err := host.NewStream(ctx, peerID, errorProtocol)
+		stream, err := host.NewStream(ctx, session.Peer, protocol)
 		if err != nil {
 			if ctx.Err() == nil {
 				slog.Debug("Error creating stream for error notification", "error", err)
@@ -59,7 +127,7 @@ func sendError(ctx context.Context, host host.Host, peerID peer.ID, errStr strin
 		}
 		err = func() error {
 			defer stream.Close()
-			err := writeString(stream, errStr)
+			err := writeString(stream, session, errStr)
 			if err == nil {
 				var n int
 				n, err = stream.Read(make([]byte, 1))
@@ -2,6 +2,9 @@ package node
 
 import (
 	"context"
+	"encoding/gob"
+	"io"
+	"p2pcp/internal/auth"
 	"testing"
 	"time"
 
@@ -17,6 +20,7 @@ func TestSendErrorTimeout(t *testing.T) {
 	net := mocknet.New()
 	defer net.Close()
 
+	key := []byte("key")
 	h1, err := net.GenPeer()
 	require.NoError(t, err)
 	h2, err := net.GenPeer()
@@ -28,7 +32,7 @@ func TestSendErrorTimeout(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendError(ctx, h1, h2.ID(), "test")
+		sendError(ctx, h1, auth.Session{Peer: h2.ID(), Key: key}, "test")
 		done <- struct{}{}
 	}()
 
@@ -48,13 +52,14 @@ func TestSendErrorRetry(t *testing.T) {
 	net := mocknet.New()
 	defer net.Close()
 
+	key := []byte("key")
 	h1, err := net.GenPeer()
 	require.NoError(t, err)
 	h2, err := net.GenPeer()
 	require.NoError(t, err)
 
 	handled := make(chan struct{})
-	registerErrorHandler(h2, h1.ID(), func(errStr string) {
+	newErrorHandlers().register(h2, auth.Session{Peer: h1.ID(), Key: key}, func(errStr string) {
 		handled <- struct{}{}
 	})
 
@@ -63,7 +68,7 @@ func TestSendErrorRetry(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendError(ctx, h1, h2.ID(), "test")
+		sendError(ctx, h1, auth.Session{Peer: h2.ID(), Key: key}, "test")
 		done <- struct{}{}
 	}()
 
@@ -92,6 +97,7 @@ func TestSendErrorDisconnect(t *testing.T) {
 	net := mocknet.New()
 	defer net.Close()
 
+	key := []byte("key")
 	h1, err := net.GenPeer()
 	require.NoError(t, err)
 	h2, err := net.GenPeer()
@@ -106,7 +112,7 @@ func TestSendErrorDisconnect(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
 	defer cancel()
 
-	sendError(ctx, h1, h2.ID(), "test")
+	sendError(ctx, h1, auth.Session{Peer: h2.ID(), Key: key}, "test")
 	assert.Error(t, ctx.Err())
 	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
 }
@@ -117,13 +123,14 @@ func TestReceiveErrorDisconnect(t *testing.T) {
 	net := mocknet.New()
 	defer net.Close()
 
+	key := []byte("key")
 	h1, err := net.GenPeer()
 	require.NoError(t, err)
 	h2, err := net.GenPeer()
 	require.NoError(t, err)
 
 	handled := make(chan struct{})
-	registerErrorHandler(h2, h1.ID(), func(errStr string) {
+	newErrorHandlers().register(h2, auth.Session{Peer: h1.ID(), Key: key}, func(errStr string) {
 		handled <- struct{}{}
 	})
 	err = net.LinkAll()
@@ -144,10 +151,144 @@ func TestReceiveErrorDisconnect(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
 	defer cancel()
 
-	sendError(ctx, h1, h2.ID(), "test")
+	sendError(ctx, h1, auth.Session{Peer: h2.ID(), Key: key}, "test")
 	select {
 	case <-handled:
 	case <-ctx.Done():
 		t.Fatal(ctx.Err())
 	}
 }
+
+func TestReceiveErrorOtherSession(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	handled := make(chan struct{}, 1)
+	newErrorHandlers().register(h2, auth.Session{Peer: h1.ID(), Key: []byte("current")}, func(errStr string) {
+		handled <- struct{}{}
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+	defer cancel()
+
+	sendError(ctx, h1, auth.Session{Peer: h2.ID(), Key: []byte("stale")}, "test")
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+	select {
+	case <-handled:
+		t.Fatal("error from another session should be rejected")
+	default:
+	}
+}
+
+// Peers of legacy sessions exchange the plain strings of older versions.
+func TestReceiveErrorLegacySession(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	handled := make(chan string, 1)
+	newErrorHandlers().register(h2, auth.Session{Peer: h1.ID(), Legacy: true}, func(errStr string) {
+		handled <- errStr
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	// As sent by older versions.
+	stream, err := h1.NewStream(ctx, h2.ID(), "/p2pcp/error/0.1.0")
+	require.NoError(t, err)
+	require.NoError(t, gob.NewEncoder(stream).Encode("legacy"))
+	_, err = io.ReadFull(stream, make([]byte, 1))
+	require.NoError(t, err)
+	stream.Close()
+	assert.Equal(t, "legacy", <-handled)
+
+	// The tagged protocol isn't accepted from the peer of a legacy session, the tag is made without key.
+	sendCtx, cancelSend := context.WithTimeout(ctx, time.Second)
+	defer cancelSend()
+	sendError(sendCtx, h1, auth.Session{Peer: h2.ID()}, "tagged")
+	select {
+	case <-handled:
+		t.Fatal("tagged error should be rejected in a legacy session")
+	default:
+	}
+
+	sendError(ctx, h1, auth.Session{Peer: h2.ID(), Legacy: true}, "plain")
+	assert.Equal(t, "plain", <-handled)
+}
+
+func TestReceiveErrorConcurrentSessions(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	h3, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	handlers := newErrorHandlers()
+	handled2 := make(chan string, 1)
+	handlers.register(h1, auth.Session{Peer: h2.ID(), Key: []byte("key2")}, func(errStr string) {
+		handled2 <- errStr
+	})
+	handled3 := make(chan string, 1)
+	handlers.register(h1, auth.Session{Peer: h3.ID(), Key: []byte("key3")}, func(errStr string) {
+		handled3 <- errStr
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	sendError(ctx, h3, auth.Session{Peer: h1.ID(), Key: []byte("key3")}, "error3")
+	sendError(ctx, h2, auth.Session{Peer: h1.ID(), Key: []byte("key2")}, "error2")
+	assert.Equal(t, "error2", <-handled2)
+	assert.Equal(t, "error3", <-handled3)
+}
+
+func TestUnregisterErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+
+	handlers := newErrorHandlers()
+	unregisterFirst := handlers.register(h1, auth.Session{Peer: h2.ID(), Key: []byte("first")}, func(errStr string) {})
+	unregisterSecond := handlers.register(h1, auth.Session{Peer: h2.ID(), Key: []byte("second")}, func(errStr string) {})
+
+	// A finished session doesn't remove the handler of a later one of the same peer.
+	unregisterFirst()
+	assert.Len(t, handlers.handlers, 1)
+	assert.Contains(t, h1.Mux().Protocols(), errorProtocol)
+
+	unregisterSecond()
+	assert.Empty(t, handlers.handlers)
+	assert.NotContains(t, h1.Mux().Protocols(), errorProtocol)
+}
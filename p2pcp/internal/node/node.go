@@ -38,8 +38,8 @@ type Node interface {
 	AdvertiseLAN(ctx context.Context, topic string) error
 	AdvertiseWAN(ctx context.Context, topic string) error
 	FindPeers(ctx context.Context, topic string) (<-chan peer.AddrInfo, error)
-	RegisterErrorHandler(peerID peer.ID, handler func(string))
-	SendError(ctx context.Context, peerID peer.ID, errStr string)
+	RegisterErrorHandler(session auth.Session, handler func(string)) func()
+	SendError(ctx context.Context, session auth.Session, errStr string)
 	Close()
 }
 
@@ -63,6 +63,7 @@ type node struct {
 	mdnsService     mdns.Service
 	peerSource      chan peer.AddrInfo
 	peerSourceLimit chan int
+	errorHandlers   *errorHandlers
 }
 
 func (n *node) ID() NodeID {
@@ -170,12 +171,12 @@ func findPeersForAutoRelay(ctx context.Context, n node) {
 	}
 }
 
-func (n *node) RegisterErrorHandler(peerID peer.ID, handler func(string)) {
-	registerErrorHandler(n.host, peerID, handler)
+func (n *node) RegisterErrorHandler(session auth.Session, handler func(string)) func() {
+	return n.errorHandlers.register(n.host, session, handler)
 }
 
-func (n *node) SendError(ctx context.Context, peerID peer.ID, errStr string) {
-	sendError(ctx, n.host, peerID, errStr)
+func (n *node) SendError(ctx context.Context, session auth.Session, errStr string) {
+	sendError(ctx, n.host, session, errStr)
 }
 
 func (n *node) Close() {
@@ -240,6 +241,7 @@ func NewNode(ctx context.Context, privateMode bool, options ...libp2p.Option) No
 		mdnsService:     mdnsService,
 		peerSource:      peerSource,
 		peerSourceLimit: peerSourceLimit,
+		errorHandlers:   newErrorHandlers(),
 	}
 
 	go findPeersForAutoRelay(ctx, *node)
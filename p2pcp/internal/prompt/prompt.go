@@ -0,0 +1,30 @@
+package prompt
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// Reads a line from stdin without buffering ahead, so later reads still see the following lines.
+func ReadLine() string {
+	return readLine(os.Stdin)
+}
+
+func readLine(reader io.Reader) string {
+	var line strings.Builder
+	buffer := make([]byte, 1)
+	for {
+		n, err := reader.Read(buffer)
+		if n == 1 {
+			if buffer[0] == '\n' {
+				break
+			}
+			line.WriteByte(buffer[0])
+		}
+		if err != nil {
+			break
+		}
+	}
+	return strings.TrimSpace(line.String())
+}
@@ -0,0 +1,16 @@
+package prompt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLine(t *testing.T) {
+	reader := strings.NewReader("apple banana\r\ny\nlast")
+	assert.Equal(t, "apple banana", readLine(reader))
+	assert.Equal(t, "y", readLine(reader))
+	assert.Equal(t, "last", readLine(reader))
+	assert.Equal(t, "", readLine(reader))
+}
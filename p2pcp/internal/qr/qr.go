@@ -0,0 +1,80 @@
+package qr
+
+// spell-checker: ignore gozxing makiuchi
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+const quietZone = 2
+
+// Renders a QR code with half blocks, two modules per character.
+// Light modules are drawn, so the code reads correctly on dark terminals.
+func Render(content string) (string, error) {
+	hints := map[gozxing.EncodeHintType]any{
+		gozxing.EncodeHintType_MARGIN:           quietZone,
+		gozxing.EncodeHintType_ERROR_CORRECTION: "L",
+	}
+	matrix, err := qrcode.NewQRCodeWriter().Encode(content, gozxing.BarcodeFormat_QR_CODE, 0, 0, hints)
+	if err != nil {
+		return "", err
+	}
+
+	isLight := func(x, y int) bool {
+		return y < matrix.GetHeight() && !matrix.Get(x, y)
+	}
+	var builder strings.Builder
+	for y := 0; y < matrix.GetHeight(); y += 2 {
+		if y > 0 {
+			builder.WriteString("\n")
+		}
+		for x := 0; x < matrix.GetWidth(); x++ {
+			top, bottom := isLight(x, y), isLight(x, y+1)
+			switch {
+			case top && bottom:
+				builder.WriteString("█")
+			case top:
+				builder.WriteString("▀")
+			case bottom:
+				builder.WriteString("▄")
+			default:
+				builder.WriteString(" ")
+			}
+		}
+	}
+	return builder.String(), nil
+}
+
+// Decodes the QR code in a PNG or JPEG image.
+func Decode(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading image %s: %w", path, err)
+	}
+
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", fmt.Errorf("error reading image %s: %w", path, err)
+	}
+	hints := map[gozxing.DecodeHintType]any{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints)
+	if err != nil {
+		return "", fmt.Errorf("no QR code found in %s: %w", path, err)
+	}
+	return result.GetText(), nil
+}
@@ -0,0 +1,75 @@
+package qr
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func savePNG(t *testing.T, img image.Image) string {
+	path := filepath.Join(t.TempDir(), "qr.png")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, png.Encode(file, img))
+	return path
+}
+
+// Reverses the rendering into an image, scaled for the decoder.
+func renderToImage(rendered string, scale int) image.Image {
+	lines := strings.Split(rendered, "\n")
+	width := len([]rune(lines[0]))
+	img := image.NewGray(image.Rect(0, 0, width*scale, len(lines)*2*scale))
+	for y, line := range lines {
+		for x, char := range []rune(line) {
+			top := char == '█' || char == '▀'
+			bottom := char == '█' || char == '▄'
+			for dy := range scale {
+				for dx := range scale {
+					if top {
+						img.SetGray(x*scale+dx, y*2*scale+dy, color.Gray{255})
+					}
+					if bottom {
+						img.SetGray(x*scale+dx, (y*2+1)*scale+dy, color.Gray{255})
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+func TestRenderDecode(t *testing.T) {
+	content := "p2pcp1" + strings.Repeat("3mJr7AoUXx2Wqd", 20)
+	rendered, err := Render(content)
+	require.NoError(t, err)
+
+	lines := strings.Split(rendered, "\n")
+	for _, line := range lines {
+		assert.Len(t, []rune(line), len([]rune(lines[0])))
+	}
+
+	decoded, err := Decode(savePNG(t, renderToImage(rendered, 4)))
+	require.NoError(t, err)
+	assert.Equal(t, content, decoded)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, err := Decode(filepath.Join(t.TempDir(), "missing.png"))
+	assert.Error(t, err)
+
+	_, err = Decode(savePNG(t, image.NewGray(image.Rect(0, 0, 64, 64))))
+	assert.ErrorContains(t, err, "no QR code found")
+
+	path := filepath.Join(t.TempDir(), "invalid.png")
+	require.NoError(t, os.WriteFile(path, []byte("not an image"), 0644))
+	_, err = Decode(path)
+	assert.ErrorContains(t, err, "error reading image")
+}
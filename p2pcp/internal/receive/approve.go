@@ -0,0 +1,156 @@
+package receive
+
+import (
+	"fmt"
+	"p2pcp/internal/prompt"
+	"p2pcp/internal/transfer"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Number of top-level names listed in the summary of a transfer.
+const summaryNames = 5
+
+func summarize(manifest transfer.Manifest) string {
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Incoming: %d files, %d directories", manifest.Count(transfer.EntryFile), manifest.Count(transfer.EntryDir))
+	if links := manifest.Count(transfer.EntrySymlink); links > 0 {
+		fmt.Fprintf(&summary, ", %d symbolic links", links)
+	}
+	if specials := manifest.Count(transfer.EntryFifo) + manifest.Count(transfer.EntryDevice); specials > 0 {
+		fmt.Fprintf(&summary, ", %d special files", specials)
+	}
+	fmt.Fprintf(&summary, ", %s in total", transfer.FormatSize(manifest.TotalSize()))
+	if manifest.HasPiped() {
+		summary.WriteString(" and piped content of unknown size")
+	}
+
+	names := manifest.TopLevelNames()
+	if len(names) > summaryNames {
+		names = append(names[:summaryNames], fmt.Sprintf("and %d more", len(names)-summaryNames))
+	}
+	fmt.Fprintf(&summary, "\nContents: %s", strings.Join(names, ", "))
+	return summary.String()
+}
+
+// Path of the entry relative to the transferred root, empty for the root directory itself.
+func relativeName(e transfer.ManifestEntry) string {
+	root, rest, found := strings.Cut(e.Name, "/")
+	if found {
+		return rest
+	}
+	if e.Type == transfer.EntryDir {
+		return ""
+	}
+	return root // Single file
+}
+
+// Parses a list of numbers and ranges like "1,3-5" into indexes of the entries, all if empty.
+func parsePicks(input string, count int) ([]int, error) {
+	var picks []int
+	fields := strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) == 0 {
+		for i := range count {
+			picks = append(picks, i)
+		}
+		return picks, nil
+	}
+	for _, field := range fields {
+		first, last, isRange := strings.Cut(field, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 1 || end > count || start > end {
+			return nil, fmt.Errorf("invalid selection %q, expected numbers between 1 and %d", field, count)
+		}
+		for i := start; i <= end; i++ {
+			picks = append(picks, i-1)
+		}
+	}
+	return picks, nil
+}
+
+// Lets the user pick entries of the manifest, a picked directory includes everything below it.
+func pick(manifest transfer.Manifest) (func(name string) bool, error) {
+	var entries []transfer.ManifestEntry
+	for _, e := range manifest.Entries {
+		if relativeName(e) != "" {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return func(string) bool { return true }, nil
+	}
+
+	for i, e := range entries {
+		switch e.Type {
+		case transfer.EntryDir:
+			fmt.Printf("%4d. %s/\n", i+1, e.Name)
+		case transfer.EntryFile:
+			fmt.Printf("%4d. %s (%s)\n", i+1, e.Name, transfer.FormatSize(e.Size))
+		default:
+			fmt.Printf("%4d. %s\n", i+1, e.Name)
+		}
+	}
+	fmt.Printf("Select entries to receive, e.g. 1,3-5 (empty for all): ")
+	picks, err := parsePicks(prompt.ReadLine(), len(entries))
+	if err != nil {
+		return nil, err
+	}
+
+	picked := make(map[string]bool)
+	for _, i := range picks {
+		picked[entries[i].Name] = true
+	}
+	return func(name string) bool {
+		for ; name != "."; name = path.Dir(name) {
+			if picked[name] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Selects the entries to receive by the filter and picker, shows the summary of the selection
+// and asks for confirmation, unless accepted by the options.
+func (r *receiver) approve(manifest transfer.Manifest) (transfer.Selection, error) {
+	match := func(e transfer.ManifestEntry) bool {
+		name := relativeName(e)
+		if name == "" {
+			return r.options.Filter.IsEmpty() // The root is kept as parent of selected entries.
+		}
+		return r.options.Filter.Match(name)
+	}
+	if r.options.Pick {
+		isPicked, err := pick(manifest.Select(manifest.Filter(match)))
+		if err != nil {
+			return transfer.Selection{}, err
+		}
+		filterMatch := match
+		match = func(e transfer.ManifestEntry) bool {
+			return filterMatch(e) && isPicked(e.Name)
+		}
+	}
+	selection := manifest.Filter(match)
+	selected := manifest.Select(selection)
+
+	fmt.Println(summarize(selected))
+	if r.options.MaxSize > 0 && selected.TotalSize() > r.options.MaxSize {
+		return selection, fmt.Errorf("%w: exceeds the maximum size of %s", transfer.ErrRejected, transfer.FormatSize(r.options.MaxSize))
+	}
+	if r.options.MaxSize > 0 && selected.HasPiped() {
+		return selection, fmt.Errorf("%w: piped content of unknown size may exceed the maximum size of %s", transfer.ErrRejected, transfer.FormatSize(r.options.MaxSize))
+	}
+	if r.options.Yes || r.options.Pick {
+		return selection, nil
+	}
+	fmt.Printf("Accept the transfer? [y/N] ")
+	if strings.ToLower(prompt.ReadLine()) != "y" {
+		return selection, transfer.ErrRejected
+	}
+	return selection, nil
+}
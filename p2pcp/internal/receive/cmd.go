@@ -5,48 +5,133 @@ import (
 	"fmt"
 	"p2pcp/internal/auth"
 	"p2pcp/internal/node"
+	"p2pcp/internal/ticket"
+	"p2pcp/internal/trust"
 	"time"
 
 	"github.com/briandowns/spinner"
+	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func Receive(ctx context.Context, id string, secret string, basePath string, private bool) error {
-	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
-
-	n := node.NewNode(ctx, private)
-	defer n.Close()
-
+func startReceiver(ctx context.Context, options Options) (node.Node, Receiver) {
+	var libp2pOptions []libp2p.Option
+	if options.Identity != nil {
+		libp2pOptions = append(libp2pOptions, libp2p.Identity(options.Identity))
+	}
+	n := node.NewNode(ctx, options.Private, libp2pOptions...)
 	n.StartMdns()
-	receiver := NewReceiver(n)
+	return n, NewReceiver(n, options)
+}
 
+func findSender(ctx context.Context, receiver Receiver, id string) (peer.ID, error) {
 	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
 	s.Suffix = " Finding sender..."
 	s.Start()
 	peer, err := receiver.FindPeer(ctx, id)
 	s.Stop()
 	if err != nil {
-		return fmt.Errorf("error finding sender: %w", err)
+		return peer, fmt.Errorf("error finding sender: %w", err)
 	}
+	return peer, nil
+}
 
+// Asks the user to compare the random art of the sender, unless it's trusted or was found by its full node ID.
+func confirmSender(id string, peer peer.ID, options Options) (bool, error) {
 	nodeID := node.GetNodeID(peer)
-	if id != nodeID.String() { // non-strict mode
-		fmt.Println("Sender ID:", nodeID.String())
-		fmt.Println("Please verify that the following random art matches the one displayed on the sender's side.")
-		fmt.Println(auth.RandomArt(nodeID.Bytes()))
-		fmt.Println("Are you sure you want to connect to this sender? [y/N]")
-		var confirm string
-		fmt.Scanln(&confirm)
-		if confirm != "y" {
-			return nil
-		}
+	if id == nodeID.String() { // strict mode
+		return true, nil
+	}
+	// The legacy protocol doesn't authenticate the sender, only the random art does.
+	if options.SkipVerify && !options.LegacyAuth {
+		return true, nil
+	}
+	trustStore, err := trust.Load()
+	if err != nil {
+		return false, err
+	}
+	if trusted, ok := trustStore.FindByID(nodeID.String()); ok {
+		fmt.Println("Sender:", trusted.Name, "(trusted)")
+		return true, nil
 	}
+	fmt.Println("Sender ID:", nodeID.String())
+	fmt.Println("Please verify that the following random art matches the one displayed on the sender's side.")
+	fmt.Println(auth.RandomArt(nodeID.Bytes()))
+	fmt.Println("Are you sure you want to connect to this sender? [y/N]")
+	var confirm string
+	fmt.Scanln(&confirm)
+	return confirm == "y", nil
+}
 
+func receiveFrom(ctx context.Context, receiver Receiver, sender peer.ID, secret []byte, basePath string) error {
 	fmt.Println("Receiving...")
-	secretHash := auth.ComputeHash([]byte(secret))
-	err = receiver.Receive(ctx, peer, secretHash, basePath)
+	session, err := receiver.Authenticate(ctx, sender, secret)
+	if err != nil {
+		return err
+	}
+	err = receiver.Receive(ctx, session, basePath)
 	if err == nil {
 		fmt.Println("Done.")
 	}
 	return err
 }
+
+func Receive(ctx context.Context, id string, secret string, basePath string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	n, receiver := startReceiver(ctx, options)
+	defer n.Close()
+
+	peer, err := findSender(ctx, receiver, id)
+	if err != nil {
+		return err
+	}
+	if confirmed, err := confirmSender(id, peer, options); !confirmed {
+		return err
+	}
+
+	return receiveFrom(ctx, receiver, peer, []byte(secret), basePath)
+}
+
+// Connects to the addresses of the ticket, falling back to discovery if none is reachable.
+func ReceiveTicket(ctx context.Context, t ticket.Ticket, basePath string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	options.Sender = t.Peer
+	n, receiver := startReceiver(ctx, options)
+	defer n.Close()
+
+	peer := t.Peer
+	if !connectDirectly(ctx, n.GetHost(), t) {
+		var err error
+		peer, err = findSender(ctx, receiver, t.Topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	return receiveFrom(ctx, receiver, peer, []byte(t.Secret), basePath)
+}
+
+// Receives from a paired peer, authenticating with the pairing key instead of a PIN/token.
+func ReceivePaired(ctx context.Context, paired trust.Peer, basePath string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	sender, err := paired.GetPeerID()
+	if err != nil {
+		return err
+	}
+	options.Sender = sender
+
+	n, receiver := startReceiver(ctx, options)
+	defer n.Close()
+
+	fmt.Printf("Waiting for %s...\n", paired.Name)
+	peer, err := findSender(ctx, receiver, paired.GetTopic())
+	if err != nil {
+		return err
+	}
+
+	return receiveFrom(ctx, receiver, peer, paired.Key, basePath)
+}
@@ -0,0 +1,72 @@
+package receive
+
+import (
+	"fmt"
+	"p2pcp/internal/prompt"
+	"p2pcp/internal/transfer"
+	"strings"
+)
+
+// Answers to the conflict prompt, uppercase ones apply to the remaining conflicts too.
+var conflictAnswers = map[string]transfer.ConflictPolicy{
+	"o": transfer.ConflictOverwrite,
+	"s": transfer.ConflictSkip,
+	"r": transfer.ConflictRename,
+	"n": transfer.ConflictNewer,
+	"f": transfer.ConflictFail,
+}
+
+func parseConflictAnswer(answer string) (transfer.ConflictPolicy, bool, bool) {
+	if answer == "" {
+		return transfer.ConflictSkip, false, true
+	}
+	policy, ok := conflictAnswers[strings.ToLower(answer)]
+	return policy, answer != strings.ToLower(answer), ok
+}
+
+// Asks how to resolve each conflict until an answer applies to all of them.
+type conflictPrompt struct {
+	all transfer.ConflictPolicy
+}
+
+func (p *conflictPrompt) ask(conflict transfer.Conflict) (transfer.ConflictPolicy, error) {
+	if p.all != "" {
+		return p.all, nil
+	}
+	for {
+		fmt.Printf("%s already exists. [o]verwrite, [s]kip, [r]ename, if [n]ewer or [f]ail, uppercase for all (default: skip)? ", conflict.Entry.Name)
+		policy, all, ok := parseConflictAnswer(prompt.ReadLine())
+		if !ok {
+			continue
+		}
+		if all {
+			p.all = policy
+		}
+		return policy, nil
+	}
+}
+
+// Lists the entries skipped or renamed by the conflict policy, empty if none.
+func summarizeConflicts(conflicts []transfer.Conflict) string {
+	var skipped, renamed []string
+	for _, c := range conflicts {
+		switch c.Resolution {
+		case transfer.ConflictSkip:
+			skipped = append(skipped, c.Entry.Name)
+		case transfer.ConflictRename:
+			renamed = append(renamed, fmt.Sprintf("%s -> %s", c.Entry.Name, c.Renamed))
+		}
+	}
+	var summary []string
+	if len(skipped) > 0 {
+		count := len(skipped)
+		if count > summaryNames {
+			skipped = append(skipped[:summaryNames], fmt.Sprintf("and %d more", count-summaryNames))
+		}
+		summary = append(summary, fmt.Sprintf("Skipped %d existing entries: %s", count, strings.Join(skipped, ", ")))
+	}
+	if len(renamed) > 0 {
+		summary = append(summary, fmt.Sprintf("Renamed %d entries:\n  %s", len(renamed), strings.Join(renamed, "\n  ")))
+	}
+	return strings.Join(summary, "\n")
+}
@@ -0,0 +1,36 @@
+package receive
+
+import (
+	"context"
+	"fmt"
+	"p2pcp/internal/trust"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Joins the pairing of another device with its PIN, then records it as paired under the specified name.
+func Pair(ctx context.Context, name string, id string, secret string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	n, receiver := startReceiver(ctx, options)
+	defer n.Close()
+
+	peer, err := findSender(ctx, receiver, id)
+	if err != nil {
+		return err
+	}
+	if confirmed, err := confirmSender(id, peer, options); !confirmed {
+		return err
+	}
+
+	session, err := receiver.Authenticate(ctx, peer, []byte(secret))
+	if err != nil {
+		return err
+	}
+
+	if err := trust.RecordPairing(name, session.Peer, session.Key); err != nil {
+		return err
+	}
+	fmt.Println("Paired with", name+".")
+	return nil
+}
@@ -2,32 +2,59 @@ package receive
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
 	"math/rand"
 	"p2pcp/internal/auth"
+	"p2pcp/internal/filter"
 	"p2pcp/internal/interrupt"
 	"p2pcp/internal/node"
+	"p2pcp/internal/prompt"
+	"p2pcp/internal/ticket"
 	"p2pcp/internal/transfer"
 	"p2pcp/internal/transfer/channel"
 	"strings"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 )
 
+type Options struct {
+	Private    bool
+	LegacyAuth bool           // Fall back to the insecure hash-of-secret authentication and transfers of older senders.
+	SkipVerify bool           // Skip the random art confirmation and rely on mutual authentication, not with LegacyAuth.
+	Identity   crypto.PrivKey // Persistent identity, a fresh one is generated if nil.
+	Sender     peer.ID        // Only accept this sender if set, e.g. a paired peer.
+	Yes        bool           // Accept transfers without asking, within MaxSize.
+	MaxSize    int64          // Reject transfers larger than this many bytes if positive.
+	Filter     filter.Filter  // Only receive the matching entries of the sender.
+	Pick       bool           // Pick the entries to receive interactively.
+	Resume     bool           // Keep a journal to resume an interrupted transfer.
+	Sync       bool           // Receive only the changes to the files in the target directory.
+	Mirror     bool           // Delete the entries of the received directories that the sender doesn't have.
+	DryRun     bool           // Only list the entries Mirror would delete.
+	Preserve   transfer.Preserve
+	OnConflict transfer.ConflictPolicy // How entries already in the target directory are handled.
+	Atomic     bool                    // Move the received tree into the target directory only once complete.
+}
+
 type Receiver interface {
 	FindPeer(ctx context.Context, id string) (peer.ID, error)
-	Receive(ctx context.Context, sender peer.ID, secretHash []byte, basePath string) error
+	Authenticate(ctx context.Context, sender peer.ID, secret []byte) (auth.Session, error)
+	Receive(ctx context.Context, sender auth.Session, basePath string) error
 }
 
 type receiver struct {
-	node node.Node
+	node    node.Node
+	options Options
 }
 
 func isValidPeer(peer peer.AddrInfo, id string) bool {
@@ -39,6 +66,13 @@ func isValidPeer(peer peer.AddrInfo, id string) bool {
 	return valid
 }
 
+func (r *receiver) isExpectedPeer(peer peer.AddrInfo, id string) bool {
+	if r.options.Sender != "" {
+		return peer.ID == r.options.Sender
+	}
+	return isValidPeer(peer, id)
+}
+
 func (r *receiver) FindPeer(ctx context.Context, id string) (peer.ID, error) {
 	var sender peer.ID
 	for ctx.Err() == nil {
@@ -50,7 +84,7 @@ func (r *receiver) FindPeer(ctx context.Context, id string) (peer.ID, error) {
 			slog.Debug("Error finding sender from DHT, retrying...", "error", err)
 		} else {
 			for addrInfo := range peers {
-				if isValidPeer(addrInfo, id) {
+				if r.isExpectedPeer(addrInfo, id) {
 					sender = addrInfo.ID
 					slog.Info("Found sender.", "sender", sender)
 					// Mark sender as candidate for DHT routing.
@@ -82,13 +116,32 @@ func connectToSender(ctx context.Context, host host.Host, peerID peer.ID) error
 	return ctx.Err()
 }
 
-func getStream(ctx context.Context, host host.Host, peerID peer.ID, protocol protocol.ID) (io.ReadWriteCloser, error) {
+const directConnectTimeout = 5 * time.Second
+
+// Tries the addresses of the ticket, skipping discovery on success.
+func connectDirectly(ctx context.Context, host host.Host, t ticket.Ticket) bool {
+	if len(t.Addrs) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, directConnectTimeout)
+	defer cancel()
+	slog.Debug("Connecting to sender directly...", "sender", t.Peer, "addrs", t.Addrs)
+	err := host.Connect(ctx, peer.AddrInfo{ID: t.Peer, Addrs: t.Addrs})
+	if err != nil {
+		slog.Debug("Error connecting to sender directly, falling back to discovery.", "error", err)
+		return false
+	}
+	slog.Info("Connected to sender directly.", "sender", t.Peer)
+	return true
+}
+
+func getStream(ctx context.Context, host host.Host, peerID peer.ID, protocols ...protocol.ID) (network.Stream, error) {
 	b := backoff.NewExponentialBackoff(
 		0, 3*time.Second, backoff.FullJitter,
 		100*time.Millisecond, math.Sqrt2, 0,
 		rand.NewSource(0))()
 	for ctx.Err() == nil {
-		stream, err := host.NewStream(ctx, peerID, protocol)
+		stream, err := host.NewStream(ctx, peerID, protocols...)
 		if err != nil {
 			if ctx.Err() == nil {
 				slog.Debug("Error creating stream", "error", err)
@@ -101,74 +154,243 @@ func getStream(ctx context.Context, host host.Host, peerID peer.ID, protocol pro
 	return nil, ctx.Err()
 }
 
-func authenticate(ctx context.Context, host host.Host, peerID peer.ID, secretHash []byte) error {
-	authStream, err := getStream(ctx, host, peerID, auth.Protocol)
+func authenticate(ctx context.Context, host host.Host, peerID peer.ID, secret []byte, legacyAuth bool) (auth.Session, error) {
+	session := auth.Session{Peer: peerID}
+	protocols := []protocol.ID{auth.Protocol}
+	if legacyAuth {
+		protocols = append(protocols, auth.LegacyProtocol)
+	}
+	authStream, err := getStream(ctx, host, peerID, protocols...)
 	if err != nil {
-		return fmt.Errorf("error creating auth stream: %w", err)
+		return session, fmt.Errorf("error creating auth stream: %w", err)
 	} else {
-		success, err := auth.Authenticate(authStream, secretHash)
+		var success bool
+		if authStream.Protocol() == auth.LegacyProtocol {
+			slog.Warn("INSECURE: Sender only supports legacy authentication, the transfer won't be bound to it.")
+			success, err = auth.Authenticate(authStream, auth.ComputeHash(secret))
+			session.Legacy = true
+		} else {
+			session.Key, success, err = auth.KeyExchange(authStream, secret, host.ID(), peerID)
+			if err == auth.ErrSenderAuthentication {
+				return session, err
+			}
+		}
 		if err != nil {
 			slog.Error("Error authenticating.", "error", err)
 		}
 		if !success {
-			return fmt.Errorf("authentication failed")
+			return session, fmt.Errorf("authentication failed")
 		}
-		return err
+		return session, err
 	}
 }
 
-func (r *receiver) Receive(ctx context.Context, sender peer.ID, secretHash []byte, basePath string) (err error) {
-	n := r.node
-	host := n.GetHost()
+// Opens a stream of the first protocol the sender supports, tagged as belonging to the session.
+func getSessionStream(ctx context.Context, host host.Host, session auth.Session, protocols ...protocol.ID) (network.Stream, error) {
+	for ctx.Err() == nil {
+		stream, err := getStream(ctx, host, session.Peer, protocols...)
+		if err != nil {
+			return nil, err
+		}
+		err = session.WriteStreamTag(stream, stream.Protocol())
+		if err == nil {
+			return stream, nil
+		}
+		slog.Debug("Error writing stream tag.", "error", err)
+		stream.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, ctx.Err()
+}
+
+// Opens a transfer stream of the first protocol the sender supports, the untagged
+// insecure protocol in legacy sessions.
+func getTransferStream(ctx context.Context, host host.Host, session auth.Session, protocols ...protocol.ID) (network.Stream, error) {
+	if session.Legacy {
+		return getStream(ctx, host, session.Peer, transfer.InsecureProtocol)
+	}
+	return getSessionStream(ctx, host, session, protocols...)
+}
+
+// Opens a parallel stream, writing its index after the tag.
+func getParallelStream(ctx context.Context, host host.Host, session auth.Session, index int) (network.Stream, error) {
+	for ctx.Err() == nil {
+		stream, err := getSessionStream(ctx, host, session, transfer.ParallelProtocol)
+		if err != nil {
+			return nil, err
+		}
+		_, err = stream.Write([]byte{byte(index)})
+		if err == nil {
+			return stream, nil
+		}
+		slog.Debug("Error writing parallel stream index.", "error", err)
+		stream.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, ctx.Err()
+}
 
-	err = connectToSender(ctx, host, sender)
+func (r *receiver) Authenticate(ctx context.Context, sender peer.ID, secret []byte) (auth.Session, error) {
+	host := r.node.GetHost()
+	err := connectToSender(ctx, host, sender)
 	if err != nil {
-		return err
+		return auth.Session{}, err
 	}
+	return authenticate(ctx, host, sender, secret, r.options.LegacyAuth)
+}
 
-	err = authenticate(ctx, host, sender, secretHash)
+// Requests the selected entries from the sender.
+func sendSelection(ctx context.Context, host host.Host, session auth.Session, selection transfer.Selection) error {
+	stream, err := getSessionStream(ctx, host, session, transfer.SelectProtocol)
 	if err != nil {
+		return fmt.Errorf("error creating selection stream: %w", err)
+	}
+	defer stream.Close()
+	if err := transfer.WriteSelection(stream, selection); err != nil {
 		return err
 	}
+	if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+		return fmt.Errorf("error reading selection ack: %w", err)
+	}
+	return nil
+}
+
+func (r *receiver) Receive(ctx context.Context, session auth.Session, basePath string) (err error) {
+	n := r.node
+	host := n.GetHost()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	n.RegisterErrorHandler(sender, func(errStr string) {
+	unregister := n.RegisterErrorHandler(session, func(errStr string) {
 		slog.Error("Sender error", "error", errStr)
 		cancel()
 	})
+	defer unregister()
 	canceling := false
 	interrupt.RegisterInterruptHandler(ctx, func() {
 		canceling = true
-		n.SendError(ctx, sender, "Transfer canceled.")
+		n.SendError(ctx, session, "Transfer canceled.")
 		cancel()
 	})
+	if session.Legacy {
+		if err := r.checkLegacyOptions(); err != nil {
+			n.SendError(ctx, session, "Transfer rejected.")
+			return err
+		}
+	}
+
+	// The version of the first stream decides the format, later ones keep it.
+	first, err := getTransferStream(ctx, host, session, transfer.Protocol, transfer.LegacyProtocol)
+	if err != nil {
+		return fmt.Errorf("error creating transfer stream: %w", err)
+	}
+	protocol := first.Protocol()
+	slog.Debug("Connected to sender.", "protocol", protocol)
 
 	reader := channel.NewChannelReader(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		if first != nil {
+			stream := first
+			first = nil
+			return stream, nil
+		}
 		if canceling {
 			<-ctx.Done()
 			return nil, ctx.Err()
 		} else {
-			return getStream(ctx, host, sender, transfer.Protocol)
+			return getTransferStream(ctx, host, session, protocol)
 		}
 	})
+	openStream := func(index int) io.ReadCloser {
+		return channel.NewChannelReader(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+			if canceling {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return getParallelStream(ctx, host, session, index)
+		})
+	}
 	defer func() {
 		if err := reader.Close(); err != nil {
 			slog.Debug("Error closing channel.", "error", err)
 		}
 	}()
 
-	err = transfer.ReadZip(reader, basePath)
-	if err != nil {
-		n.SendError(ctx, sender, "")
+	var conflicts []transfer.Conflict
+	conflictPrompt := &conflictPrompt{}
+	err = transfer.ReadZip(reader, basePath, transfer.ReadOptions{
+		Approve: r.approve,
+		Request: func(selection transfer.Selection) error {
+			return sendSelection(ctx, host, session, selection)
+		},
+		OpenStream: openStream,
+		Legacy:     protocol == transfer.LegacyProtocol,
+		Insecure:   session.Legacy,
+		Resume:     r.options.Resume,
+		Sync:       r.options.Sync,
+		Mirror:     r.options.Mirror,
+		DryRun:     r.options.DryRun,
+		Preserve:   r.options.Preserve,
+		OnConflict: r.options.OnConflict,
+		Atomic:     r.options.Atomic,
+		Ask:        conflictPrompt.ask,
+		Conflicted: func(conflict transfer.Conflict) {
+			conflicts = append(conflicts, conflict)
+		},
+		Deleted: func(name string) {
+			if r.options.DryRun {
+				fmt.Println("Would delete", name)
+			} else {
+				fmt.Println("Deleted", name)
+			}
+		},
+	})
+	if errors.Is(err, transfer.ErrRejected) {
+		n.SendError(ctx, session, "Transfer rejected.")
+		cancel()
+		return err
+	} else if errors.Is(err, transfer.ErrConflict) {
+		n.SendError(ctx, session, "Entry already exists on the receiver.")
+		cancel()
+		return err
+	} else if err != nil {
+		n.SendError(ctx, session, "")
 		cancel()
 		return fmt.Errorf("error receiving zip: %w", err)
 	}
 
+	if summary := summarizeConflicts(conflicts); summary != "" {
+		fmt.Println(summary)
+	}
 	slog.Info("Transfer complete.")
 	return nil
 }
 
-func NewReceiver(node node.Node) Receiver {
-	return &receiver{node: node}
+// Rejects the options relying on the manifest, which legacy senders don't send,
+// and asks to accept whatever they send unless accepted by the options.
+func (r *receiver) checkLegacyOptions() error {
+	o := r.options
+	switch {
+	case o.MaxSize > 0:
+		return fmt.Errorf("max-size: not supported by the legacy sender, which sends no manifest")
+	case !o.Filter.IsEmpty() || o.Pick:
+		return fmt.Errorf("selecting entries is not supported by the legacy sender, which sends no manifest")
+	case o.Resume || o.Sync || o.Mirror || o.DryRun || o.Atomic:
+		return fmt.Errorf("resume, sync, mirror, dry-run and atomic are not supported by the legacy sender, which sends no manifest")
+	case o.OnConflict != "" && o.OnConflict != transfer.ConflictOverwrite:
+		return fmt.Errorf("on-conflict: only overwrite is supported by the legacy sender, which sends no manifest")
+	case o.Preserve != transfer.Preserve{}:
+		return fmt.Errorf("preserve: not supported by the legacy sender")
+	}
+	if o.Yes {
+		return nil
+	}
+	fmt.Printf("The legacy sender sends no summary and its transfer is insecure. Accept whatever it sends? [y/N] ")
+	if strings.ToLower(prompt.ReadLine()) != "y" {
+		return transfer.ErrRejected
+	}
+	return nil
+}
+
+func NewReceiver(node node.Node, options Options) Receiver {
+	return &receiver{node: node, options: options}
 }
@@ -1,15 +1,28 @@
 package receive
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
+	"os"
 	"p2pcp/internal/auth"
+	"p2pcp/internal/filter"
 	"p2pcp/internal/node"
+	"p2pcp/internal/ticket"
+	"p2pcp/internal/transfer"
+	"p2pcp/internal/transfer/channel"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
 	"testing"
 	"time"
 
+	"github.com/adrg/xdg"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -37,6 +50,22 @@ func TestSenderSuffixCheck(t *testing.T) {
 	assert.False(t, isValidPeer(node2.Peerstore().PeerInfo(node2.ID()), id))
 }
 
+func TestExpectedSenderCheck(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+
+	receiver := &receiver{options: Options{Sender: h1.ID()}}
+	assert.True(t, receiver.isExpectedPeer(peer.AddrInfo{ID: h1.ID()}, "topic"))
+	assert.False(t, receiver.isExpectedPeer(peer.AddrInfo{ID: h2.ID()}, "topic"))
+}
+
 type mockNode struct {
 	host           host.Host
 	peers          chan peer.AddrInfo
@@ -63,9 +92,11 @@ func (m *mockNode) GetHost() host.Host { return m.host }
 
 func (m *mockNode) ID() node.NodeID { return node.GetNodeID(m.host.ID()) }
 
-func (m *mockNode) RegisterErrorHandler(peerID peer.ID, handler func(string)) {}
+func (m *mockNode) RegisterErrorHandler(session auth.Session, handler func(string)) func() {
+	return func() {}
+}
 
-func (m *mockNode) SendError(ctx context.Context, peerID peer.ID, errStr string) {}
+func (m *mockNode) SendError(ctx context.Context, session auth.Session, errStr string) {}
 
 func (m *mockNode) StartMdns() {}
 
@@ -142,7 +173,7 @@ func TestFindPeersTimeout(t *testing.T) {
 	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
 }
 
-func TestReceiveTimeout(t *testing.T) {
+func TestConnectAndAuthenticateTimeout(t *testing.T) {
 	t.Parallel()
 
 	psk := make([]byte, 32)
@@ -162,7 +193,7 @@ func TestReceiveTimeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
 	defer cancel()
 
-	err = receiver.Receive(ctx, host2.ID(), nil, "")
+	_, err = receiver.Authenticate(ctx, host2.ID(), nil)
 	require.Error(t, err)
 	assert.Equal(t, context.DeadlineExceeded, err)
 	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
@@ -304,6 +335,27 @@ func TestGetStreamRetry(t *testing.T) {
 	assert.True(t, newStream)
 }
 
+func TestConnectDirectly(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	h3, err := net.GenPeer()
+	require.NoError(t, err)
+	_, err = net.LinkPeers(h1.ID(), h2.ID())
+	require.NoError(t, err)
+
+	assert.True(t, connectDirectly(t.Context(), h1, ticket.Ticket{Peer: h2.ID(), Addrs: h2.Addrs()}))
+	// Unreachable or no addresses fall back to discovery.
+	assert.False(t, connectDirectly(t.Context(), h1, ticket.Ticket{Peer: h3.ID(), Addrs: h3.Addrs()}))
+	assert.False(t, connectDirectly(t.Context(), h1, ticket.Ticket{Peer: h3.ID()}))
+}
+
 func TestAuthenticateTimeout(t *testing.T) {
 	t.Parallel()
 
@@ -320,7 +372,7 @@ func TestAuthenticateTimeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
 	defer cancel()
 
-	err = authenticate(ctx, h1, h2.ID(), []byte("test"))
+	_, err = authenticate(ctx, h1, h2.ID(), []byte("test"), false)
 	assert.Error(t, err)
 	assert.Error(t, ctx.Err())
 	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
@@ -343,7 +395,239 @@ func TestAuthenticateDisconnect(t *testing.T) {
 		stream.Close()
 	})
 
-	err = authenticate(t.Context(), h1, h2.ID(), []byte("test"))
+	_, err = authenticate(t.Context(), h1, h2.ID(), []byte("test"), false)
 	assert.Error(t, err)
 	assert.Equal(t, err.Error(), "authentication failed")
 }
+
+// Receives from a sender speaking the wire format of the versions authenticating with the hash of the secret.
+func TestReceiveLegacySender(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	secret := []byte("123456")
+	h2.SetStreamHandler("/p2pcp/auth/1.0.0", func(stream network.Stream) {
+		auth.HandleAuthenticate(stream, auth.ComputeHash(secret))
+	})
+	streams := make(chan io.ReadWriteCloser, 1)
+	h2.SetStreamHandler("/p2pcp/transfer/1.0.0", func(stream network.Stream) {
+		streams <- stream
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		writer := channel.NewChannelWriter(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+			select {
+			case stream := <-streams:
+				return stream, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+		defer writer.Close()
+		sent <- func() error {
+			zipWriter := gzip.NewWriter(writer)
+			tarWriter := tar.NewWriter(zipWriter)
+			if err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir", Mode: 0o755}); err != nil {
+				return err
+			}
+			if err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0o644, Size: 4}); err != nil {
+				return err
+			}
+			if _, err := tarWriter.Write([]byte("file")); err != nil {
+				return err
+			}
+			if err := tarWriter.Close(); err != nil {
+				return err
+			}
+			if err := zipWriter.Close(); err != nil {
+				return err
+			}
+			return writer.Flush(true)
+		}()
+	}()
+
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "legacy_sender")
+	workspace.ResetDir(targetPath)
+	r := &receiver{node: &mockNode{host: h1}, options: Options{LegacyAuth: true, Yes: true, OnConflict: transfer.ConflictOverwrite}}
+	session, err := authenticate(ctx, h1, h2.ID(), secret, true)
+	require.NoError(t, err)
+	assert.True(t, session.Legacy)
+	require.NoError(t, r.Receive(ctx, session, targetPath))
+	require.NoError(t, <-sent)
+
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(content))
+
+	// Options relying on the manifest are rejected up front.
+	r.options.Resume = true
+	err = r.Receive(ctx, session, targetPath)
+	assert.ErrorContains(t, err, "not supported by the legacy sender")
+}
+
+func TestApproveTransfer(t *testing.T) {
+	manifest := transfer.Manifest{Entries: []transfer.ManifestEntry{
+		{Name: "dir", Type: transfer.EntryDir},
+		{Name: "dir/file", Type: transfer.EntryFile, Size: 1500},
+	}}
+	for i := range 6 {
+		manifest.Entries = append(manifest.Entries, transfer.ManifestEntry{Name: fmt.Sprintf("file%d", i), Type: transfer.EntryFile})
+	}
+	assert.Equal(t, "Incoming: 7 files, 1 directories, 1.5 kB in total\n"+
+		"Contents: dir, file0, file1, file2, file3, and 2 more", summarize(manifest))
+
+	r := &receiver{options: Options{Yes: true}}
+	selection, err := r.approve(manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, transfer.Selection{All: true}, selection)
+
+	r = &receiver{options: Options{Yes: true, MaxSize: 1000}}
+	_, err = r.approve(manifest)
+	assert.ErrorIs(t, err, transfer.ErrRejected)
+	assert.ErrorContains(t, err, "exceeds the maximum size of 1.0 kB")
+
+	// The size limit applies to the selected entries.
+	r = &receiver{options: Options{Yes: true, MaxSize: 1000, Filter: filter.Filter{Exclude: []string{"/file"}}}}
+	selection, err = r.approve(manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, transfer.Selection{Names: []string{"file0", "file1", "file2", "file3", "file4", "file5"}}, selection)
+}
+
+func TestApprovePiped(t *testing.T) {
+	manifest := transfer.Manifest{Entries: []transfer.ManifestEntry{
+		{Name: "file", Type: transfer.EntryFile, Size: 100},
+		{Name: "stdin", Type: transfer.EntryFile, Piped: true},
+	}}
+	assert.Equal(t, "Incoming: 2 files, 0 directories, 100 B in total and piped content of unknown size\n"+
+		"Contents: file, stdin", summarize(manifest))
+
+	r := &receiver{options: Options{Yes: true, MaxSize: 1000}}
+	_, err := r.approve(manifest)
+	assert.ErrorIs(t, err, transfer.ErrRejected)
+	assert.ErrorContains(t, err, "piped content of unknown size")
+}
+
+func TestApproveSelection(t *testing.T) {
+	manifest := transfer.Manifest{Entries: []transfer.ManifestEntry{
+		{Name: "dir", Type: transfer.EntryDir},
+		{Name: "dir/app.log", Type: transfer.EntryFile, Size: 10},
+		{Name: "dir/logs", Type: transfer.EntryDir},
+		{Name: "dir/logs/old.log", Type: transfer.EntryFile, Size: 10},
+		{Name: "dir/src", Type: transfer.EntryDir},
+		{Name: "dir/src/main.go", Type: transfer.EntryFile, Size: 10},
+	}}
+
+	r := &receiver{options: Options{Yes: true, Filter: filter.Filter{Include: []string{"*.log"}, Exclude: []string{"logs"}}}}
+	selection, err := r.approve(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, transfer.Selection{Names: []string{"dir", "dir/app.log"}}, selection)
+
+	r = &receiver{options: Options{Yes: true, Filter: filter.Filter{Include: []string{"src"}}}}
+	selection, err = r.approve(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, transfer.Selection{Names: []string{"dir", "dir/src", "dir/src/main.go"}}, selection)
+
+	assert.Equal(t, "", relativeName(manifest.Entries[0]))
+	assert.Equal(t, "logs/old.log", relativeName(manifest.Entries[3]))
+	assert.Equal(t, "file", relativeName(transfer.ManifestEntry{Name: "file", Type: transfer.EntryFile}))
+}
+
+func TestParsePicks(t *testing.T) {
+	picks, err := parsePicks("", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, picks)
+
+	picks, err = parsePicks("1, 3-4 6", 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 2, 3, 5}, picks)
+
+	for _, input := range []string{"0", "7", "a", "3-2", "1-", "-1"} {
+		_, err = parsePicks(input, 6)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseConflictAnswer(t *testing.T) {
+	tests := []struct {
+		answer string
+		policy transfer.ConflictPolicy
+		all    bool
+		ok     bool
+	}{
+		{"", transfer.ConflictSkip, false, true},
+		{"o", transfer.ConflictOverwrite, false, true},
+		{"R", transfer.ConflictRename, true, true},
+		{"n", transfer.ConflictNewer, false, true},
+		{"F", transfer.ConflictFail, true, true},
+		{"x", "", false, false},
+	}
+	for _, tt := range tests {
+		policy, all, ok := parseConflictAnswer(tt.answer)
+		assert.Equal(t, tt.ok, ok, tt.answer)
+		if tt.ok {
+			assert.Equal(t, tt.policy, policy, tt.answer)
+			assert.Equal(t, tt.all, all, tt.answer)
+		}
+	}
+}
+
+func TestSummarizeConflicts(t *testing.T) {
+	assert.Equal(t, "", summarizeConflicts(nil))
+
+	var conflicts []transfer.Conflict
+	for i := range 7 {
+		conflicts = append(conflicts, transfer.Conflict{
+			Entry:      transfer.ManifestEntry{Name: fmt.Sprintf("dir/file%d", i)},
+			Resolution: transfer.ConflictSkip,
+		})
+	}
+	conflicts = append(conflicts,
+		transfer.Conflict{Entry: transfer.ManifestEntry{Name: "dir/new"}, Resolution: transfer.ConflictOverwrite},
+		transfer.Conflict{Entry: transfer.ManifestEntry{Name: "dir/a.txt"}, Resolution: transfer.ConflictRename, Renamed: "dir/a (1).txt"},
+	)
+	assert.Equal(t, "Skipped 7 existing entries: dir/file0, dir/file1, dir/file2, dir/file3, dir/file4, and 2 more\n"+
+		"Renamed 1 entries:\n  dir/a.txt -> dir/a (1).txt", summarizeConflicts(conflicts))
+}
+
+func TestConfirmSenderLegacy(t *testing.T) {
+	configPath := filepath.Join(os.TempDir(), project.Name, "test", "confirm_sender")
+	workspace.ResetDir(configPath)
+	restore := workspace.SetEnv("XDG_CONFIG_HOME", configPath)
+	defer restore()
+	xdg.Reload()
+	defer xdg.Reload()
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	sender, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+
+	confirmed, err := confirmSender("topic", sender, Options{SkipVerify: true})
+	require.NoError(t, err)
+	assert.True(t, confirmed)
+
+	// The random art is the only check of the sender with the legacy protocol.
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = writer.WriteString("n\n")
+	require.NoError(t, err)
+	writer.Close()
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+	confirmed, err = confirmSender("topic", sender, Options{SkipVerify: true, LegacyAuth: true})
+	require.NoError(t, err)
+	assert.False(t, confirmed)
+}
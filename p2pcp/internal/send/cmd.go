@@ -4,68 +4,269 @@ import (
 	"context"
 	"fmt"
 	"p2pcp/internal/auth"
+	"p2pcp/internal/interrupt"
+	"p2pcp/internal/qr"
+	"p2pcp/internal/ticket"
+	"p2pcp/internal/trust"
+	"p2pcp/internal/wordcode"
 	"project/pkg/project"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/briandowns/spinner"
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func Send(ctx context.Context, basePath string, strict bool, private bool) error {
-	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
-
+func startSender(ctx context.Context, options Options) (Sender, error) {
 	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
 	s.Suffix = " Preparing sender..."
 	s.Start()
-	sender, err := NewAdvertisedSender(ctx, strict, private)
+	sender, err := NewAdvertisedSender(ctx, options)
 	s.Stop()
 	if err != nil {
-		return fmt.Errorf("error creating sender: %w", err)
+		return nil, fmt.Errorf("error creating sender: %w", err)
+	}
+	sender.GetNode().StartMdns()
+	return sender, nil
+}
+
+func printCommand(options Options, args ...any) {
+	args = append([]any{project.Name}, args...)
+	if options.Private {
+		args = append(args, "--private")
+	}
+	fmt.Println(args...)
+}
+
+// Generates a PIN to display and its normalized form used for authentication.
+func newPin(options Options) (string, []byte) {
+	policy := options.Pin
+	if policy == (auth.PinPolicy{}) {
+		policy = auth.DefaultPinPolicy()
+	}
+	pin := auth.GetOneTimeSecret(policy)
+	return pin, []byte(auth.NormalizePin(pin))
+}
+
+// Joins the lines of two blocks of text horizontally.
+func sideBySide(left string, right string) string {
+	leftLines := strings.Split(left, "\n")
+	rightLines := strings.Split(right, "\n")
+	width := 0
+	for _, line := range leftLines {
+		width = max(width, utf8.RuneCountInString(line))
+	}
+	lines := make([]string, max(len(leftLines), len(rightLines)))
+	for i := range lines {
+		var l, r string
+		if i < len(leftLines) {
+			l = leftLines[i]
+		}
+		if i < len(rightLines) {
+			r = rightLines[i]
+		}
+		if r == "" {
+			lines[i] = l
+		} else {
+			lines[i] = l + strings.Repeat(" ", width-utf8.RuneCountInString(l)+2) + r
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sendToReceiver(ctx context.Context, sender Sender, secret []byte, basePaths []string) error {
+	receiver, err := sender.WaitForReceiver(ctx, secret)
+	if err != nil {
+		return fmt.Errorf("error waiting for receiver: %w", err)
+	}
+
+	fmt.Println("Sending...")
+	err = sender.Send(ctx, receiver, basePaths)
+	if err == nil {
+		fmt.Println("Done.")
+	}
+	return err
+}
+
+// Serves the configured number of receivers, or all until canceled, and reports each result separately.
+func sendToReceivers(ctx context.Context, sender Sender, secret []byte, basePaths []string, options Options) error {
+	if options.Receivers == 1 {
+		return sendToReceiver(ctx, sender, secret, basePaths)
+	}
+
+	// The first interrupt stops accepting receivers, the next one cancels the running transfers.
+	transferCtx, cancelTransfers := context.WithCancel(ctx)
+	defer cancelTransfers()
+	acceptCtx, stopAccepting := context.WithCancel(transferCtx)
+	defer stopAccepting()
+	interrupt.RegisterInterruptHandler(acceptCtx, func() {
+		interrupt.RegisterInterruptHandler(transferCtx, cancelTransfers)
+		stopAccepting()
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	started, succeeded := 0, 0
+	serve := func(number int, receiver auth.Session) {
+		start := time.Now()
+		err := sender.Send(transferCtx, receiver, basePaths)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			fmt.Printf("Receiver %d (%s) failed: %v\n", number, receiver.Peer, err)
+		} else {
+			succeeded++
+			fmt.Printf("Receiver %d (%s): done in %s.\n", number, receiver.Peer, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	if options.Receivers == 0 {
+		fmt.Println("Waiting for receivers, press Ctrl+C to stop accepting new ones and again to cancel running transfers...")
+	}
+	var waitErr error
+	for options.Receivers == 0 || started < options.Receivers {
+		if options.Receivers > 0 {
+			fmt.Printf("Waiting for receiver %d of %d...\n", started+1, options.Receivers)
+		}
+		receiver, err := sender.WaitForReceiver(acceptCtx, secret)
+		if err != nil {
+			// Stopping to accept is the regular end when serving receivers until canceled.
+			stopped := options.Receivers == 0 && acceptCtx.Err() != nil && ctx.Err() == nil
+			if !stopped {
+				waitErr = fmt.Errorf("error waiting for receiver: %w", err)
+			}
+			break
+		}
+		started++
+		number := started
+		fmt.Printf("Sending to receiver %d (%s)...\n", number, receiver.Peer)
+		if options.Concurrent {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(number, receiver)
+			}()
+		} else {
+			serve(number, receiver)
+		}
+	}
+	// Once no more receivers are accepted, the next interrupt cancels the running transfers.
+	stopAccepting()
+	interrupt.RegisterInterruptHandler(transferCtx, cancelTransfers)
+	wg.Wait()
+
+	fmt.Printf("Sent to %d of %d receivers.\n", succeeded, started)
+	if waitErr != nil {
+		return waitErr
+	}
+	if succeeded < started {
+		return fmt.Errorf("failed to send to %d of %d receivers", started-succeeded, started)
+	}
+	return nil
+}
+
+func Send(ctx context.Context, basePaths []string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	sender, err := startSender(ctx, options)
+	if err != nil {
+		return err
 	}
 	defer sender.Close()
 	n := sender.GetNode()
 
-	n.StartMdns()
+	var secret []byte
+	var secretLine string
+	if !options.Strict {
+		var pin string
+		pin, secret = newPin(options)
+		secretLine = fmt.Sprintf("PIN: %s", pin)
+	} else {
+		token := auth.GetStrongSecret()
+		if options.Words {
+			secretLine = fmt.Sprintf("token: %s", auth.StrongSecretToWords(token))
+		} else {
+			secretLine = fmt.Sprintf("token: %s", token)
+		}
+		secret = []byte(token)
+	}
 
-	if !strict {
+	t := ticket.Ticket{
+		Peer:   n.GetHost().ID(),
+		Addrs:  n.GetHost().Addrs(),
+		Topic:  sender.GetAdvertiseTopic(),
+		Secret: string(secret),
+	}
+
+	var art string
+	if !options.Strict {
 		fmt.Println("Node ID:", n.ID())
-		fmt.Println(auth.RandomArt(n.ID().Bytes()))
+		art = auth.RandomArt(n.ID().Bytes())
+	}
+	if options.QR {
+		qrCode, err := qr.Render(t.String())
+		if err != nil {
+			return fmt.Errorf("error rendering QR code: %w", err)
+		}
+		if art == "" {
+			art = qrCode
+		} else {
+			art = sideBySide(art, qrCode)
+		}
+	}
+	if art != "" {
+		fmt.Println(art)
 	}
 
 	var id string
-	if strict {
+	if options.Strict {
 		id = n.ID().String()
+		if options.Words {
+			id = wordcode.Encode(n.ID().Bytes())
+		}
 	} else {
 		id = sender.GetAdvertiseTopic()
 	}
 	fmt.Println("Please run the following command on the receiver's side:")
 	fmt.Println()
-	if private {
-		fmt.Println(project.Name, "receive", id, "--private")
-	} else {
-		fmt.Println(project.Name, "receive", id)
-	}
+	printCommand(options, "receive", id)
+	fmt.Println(secretLine)
+	fmt.Println()
 
-	var secret string
-	if !strict {
-		secret = auth.GetOneTimeSecret()
-		fmt.Printf("PIN: %s\n", secret)
-	} else {
-		secret = auth.GetStrongSecret()
-		fmt.Printf("token: %s\n", secret)
-	}
+	fmt.Println("Or run the following command, which includes the secret and connects directly if possible:")
+	fmt.Println()
+	printCommand(options, "receive", t.String())
 	fmt.Println()
 
-	secretHash := auth.ComputeHash([]byte(secret))
-	receiver, err := sender.WaitForReceiver(ctx, secretHash)
+	return sendToReceivers(ctx, sender, secret, basePaths, options)
+}
+
+// Sends to a paired peer, authenticating with the pairing key instead of a PIN/token.
+func SendPaired(ctx context.Context, basePaths []string, paired trust.Peer, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	receiver, err := paired.GetPeerID()
 	if err != nil {
-		return fmt.Errorf("error waiting for receiver: %w", err)
+		return err
 	}
+	// Failed attempts of other peers must not abort the transfer.
+	options.Strict = true
+	options.Receiver = receiver
+	options.Receivers = 1
+	options.Topic = paired.GetTopic()
 
-	fmt.Println("Sending...")
-	err = sender.Send(ctx, receiver, basePath)
-	if err == nil {
-		fmt.Println("Done.")
+	sender, err := startSender(ctx, options)
+	if err != nil {
+		return err
 	}
-	return err
+	defer sender.Close()
+
+	fmt.Printf("Waiting for %s, please run the following command on their side:\n", paired.Name)
+	fmt.Println()
+	printCommand(options, "receive", "--from", "<nickname of this device>")
+	fmt.Println()
+
+	return sendToReceiver(ctx, sender, paired.Key, basePaths)
 }
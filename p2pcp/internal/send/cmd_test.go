@@ -3,16 +3,93 @@ package send
 import (
 	"context"
 	"errors"
+	"os"
+	"p2pcp/internal/auth"
+	"p2pcp/internal/node"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCancelSend(t *testing.T) {
 	ctx, cancel := context.WithCancel(t.Context())
 	cancel()
 
-	err := Send(ctx, "", false, false)
+	err := Send(ctx, nil, Options{})
 	assert.Error(t, err)
 	assert.True(t, errors.Is(err, context.Canceled))
 }
+
+func TestSideBySide(t *testing.T) {
+	assert.Equal(t, "ab  █\nc   ▀\n    ▄", sideBySide("ab\nc", "█\n▀\n▄"))
+	assert.Equal(t, "a  █\nb", sideBySide("a\nb", "█"))
+}
+
+// Accepts a single receiver and sends until canceled.
+type mockSender struct {
+	accepted bool
+	sending  chan struct{} // Closed once sending started.
+	stopped  chan struct{} // Closed once no more receivers are accepted.
+	canceled chan struct{} // Closed once sending was canceled.
+}
+
+func (s *mockSender) GetNode() node.Node        { return nil }
+func (s *mockSender) GetAdvertiseTopic() string { return "" }
+func (s *mockSender) Close()                    {}
+
+func (s *mockSender) WaitForReceiver(ctx context.Context, secret []byte) (auth.Session, error) {
+	if !s.accepted {
+		s.accepted = true
+		return auth.Session{Peer: "receiver"}, nil
+	}
+	<-ctx.Done()
+	close(s.stopped)
+	return auth.Session{}, ctx.Err()
+}
+
+func (s *mockSender) Send(ctx context.Context, receiver auth.Session, basePaths []string) error {
+	close(s.sending)
+	<-ctx.Done()
+	close(s.canceled)
+	return ctx.Err()
+}
+
+func TestInterruptReceivers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Interrupts can't be sent to the own process on Windows.")
+	}
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+
+	s := &mockSender{sending: make(chan struct{}), stopped: make(chan struct{}), canceled: make(chan struct{})}
+	result := make(chan error, 1)
+	go func() {
+		result <- sendToReceivers(t.Context(), s, nil, nil, Options{Concurrent: true})
+	}()
+	<-s.sending
+
+	// The first interrupt only stops accepting receivers.
+	require.NoError(t, process.Signal(os.Interrupt))
+	select {
+	case <-s.stopped:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "still accepting receivers")
+	}
+	select {
+	case <-s.canceled:
+		require.Fail(t, "running transfer canceled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The next one cancels the running transfers.
+	require.NoError(t, process.Signal(os.Interrupt))
+	select {
+	case err := <-result:
+		assert.ErrorContains(t, err, "failed to send to 1 of 1 receivers")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "running transfer not canceled")
+	}
+}
@@ -0,0 +1,58 @@
+package send
+
+import (
+	"context"
+	"fmt"
+	"p2pcp/internal/auth"
+	"p2pcp/internal/trust"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const disconnectTimeout = 10 * time.Second
+
+// Gives the peer time to read the end of the exchange before closing the connection.
+func waitForDisconnect(ctx context.Context, host host.Host, peerID peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, disconnectTimeout)
+	defer cancel()
+	for ctx.Err() == nil && host.Network().Connectedness(peerID) == network.Connected {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Waits for another device to join with the displayed PIN, then records it as paired under the specified name.
+func Pair(ctx context.Context, name string, options Options) error {
+	ctx = network.WithAllowLimitedConn(ctx, "hole-punching")
+
+	sender, err := startSender(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	n := sender.GetNode()
+
+	fmt.Println("Node ID:", n.ID())
+	fmt.Println(auth.RandomArt(n.ID().Bytes()))
+	fmt.Println("Please run the following command on the other device:")
+	fmt.Println()
+	printCommand(options, "pair", "<nickname of this device>", sender.GetAdvertiseTopic())
+
+	pin, secret := newPin(options)
+	fmt.Printf("PIN: %s\n", pin)
+	fmt.Println()
+
+	session, err := sender.WaitForReceiver(ctx, secret)
+	if err != nil {
+		return fmt.Errorf("error waiting for peer: %w", err)
+	}
+	waitForDisconnect(ctx, n.GetHost(), session.Peer)
+
+	if err := trust.RecordPairing(name, session.Peer, session.Key); err != nil {
+		return err
+	}
+	fmt.Println("Paired with", name+".")
+	return nil
+}
@@ -7,31 +7,67 @@ import (
 	"log/slog"
 	"p2pcp/internal/auth"
 	"p2pcp/internal/errors"
+	"p2pcp/internal/filter"
 	"p2pcp/internal/interrupt"
 	"p2pcp/internal/node"
 	"p2pcp/internal/transfer"
 	"p2pcp/internal/transfer/channel"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
 )
 
+const streamTagTimeout = 10 * time.Second
+
+// Delay after the first failed PIN attempt, doubled for every further one.
+const attemptDelay = time.Second
+
+type Options struct {
+	Strict      bool
+	Words       bool // Render the ID and token of strict mode as words.
+	QR          bool // Show the ticket as QR code.
+	Private     bool
+	Pin         auth.PinPolicy // PIN generated in non-strict mode.
+	MaxAttempts int            // Failed PIN attempts allowed before aborting in non-strict mode.
+	LegacyAuth  bool           // Also accept the insecure hash-of-secret authentication and transfers of older receivers.
+	Identity    crypto.PrivKey // Persistent identity, a fresh one is generated if nil.
+	Receiver    peer.ID        // Only accept this receiver if set, e.g. a paired peer.
+	Topic       string         // Overrides the advertised topic if set.
+	Receivers   int            // Number of receivers to serve, 0 for all until canceled.
+	Concurrent  bool           // Serve receivers concurrently instead of one after another.
+	Filter      filter.Filter  // Only send the matching entries of a directory.
+	IgnoreFiles []string       // Names of ignore files honored in addition to .p2pcpignore.
+	Compression transfer.Compression
+	Streams     int                    // Parallel streams for the content of files, none if below 2.
+	Symlinks    transfer.SymlinkPolicy // How symbolic links in a directory are sent.
+	Stdin       io.Reader              // Sent as a file named StdinName along with the paths if set, to a single receiver.
+	StdinName   string
+}
+
 type Sender interface {
 	GetNode() node.Node
 	GetAdvertiseTopic() string
-	WaitForReceiver(ctx context.Context, secretHash []byte) (peer.ID, error)
-	Send(ctx context.Context, receiver peer.ID, basePath string) error
+	WaitForReceiver(ctx context.Context, secret []byte) (auth.Session, error)
+	Send(ctx context.Context, receiver auth.Session, basePaths []string) error
 	Close()
 }
 
 type sender struct {
 	node       node.Node
-	strictMode bool
+	options    Options
+	streams    *sessionStreams
+	insecure   *sessionStreams // Untagged transfer streams of legacy sessions.
+	selections *sessionStreams
+	parallel   *sessionStreams
 }
 
 func (s *sender) GetNode() node.Node {
@@ -39,8 +75,11 @@ func (s *sender) GetNode() node.Node {
 }
 
 func (s *sender) GetAdvertiseTopic() string {
+	if s.options.Topic != "" {
+		return s.options.Topic
+	}
 	id := s.node.ID().String()
-	if s.strictMode {
+	if s.options.Strict {
 		return id
 	} else {
 		return id[len(id)-7:]
@@ -51,97 +90,257 @@ func (s *sender) Close() {
 	s.node.Close()
 }
 
-func authenticateReceiver(ctx context.Context, host host.Host, secretHash []byte, strict bool) (peer.ID, error) {
+// Returns the session of the receiver if it succeeded, a legacy one without key for the legacy protocol.
+func handleAuthenticate(stream network.Stream, secret []byte) (auth.Session, *bool, error) {
+	conn := stream.Conn()
+	if stream.Protocol() == auth.LegacyProtocol {
+		success, err := auth.HandleAuthenticate(stream, auth.ComputeHash(secret))
+		return auth.Session{Peer: conn.RemotePeer(), Legacy: true}, success, err
+	}
+	key, success, err := auth.HandleKeyExchange(stream, secret, conn.RemotePeer(), conn.LocalPeer())
+	return auth.Session{Peer: conn.RemotePeer(), Key: key}, success, err
+}
+
+func authenticateReceiver(ctx context.Context, host host.Host, secret []byte, options Options) (auth.Session, error) {
+	var mutex sync.Mutex
 	var authenticatedPeer peer.ID = ""
-	authenticate := make(chan peer.ID, 1)
-	host.SetStreamHandler(auth.Protocol, func(stream network.Stream) {
-		slog.Debug("Received new auth stream.")
-		remotePeer := stream.Conn().RemotePeer()
-		if authenticatedPeer == "" {
-			success, err := auth.HandleAuthenticate(stream, secretHash)
-			if err != nil {
-				slog.Warn("Error authenticating receiver.", "error", err)
+	attempting := false
+	failedAttempts := 0
+	var retryAfter time.Time
+	authenticate := make(chan auth.Session, 1)
+
+	// Returns false if the attempt is rejected, only one PIN attempt at a time is allowed after a delay.
+	startAttempt := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if authenticatedPeer != "" {
+			slog.Warn("Received extra auth stream.")
+			return false
+		}
+		if !options.Strict {
+			if attempting || time.Now().Before(retryAfter) {
+				slog.Warn("Rejected auth stream while waiting for the next attempt.")
+				return false
 			}
-			if success == nil {
-				return
+			attempting = true
+		}
+		return true
+	}
+	failAttempt := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failedAttempts++
+		remaining := max(options.MaxAttempts, 1) - failedAttempts
+		if remaining <= 0 {
+			select {
+			case authenticate <- auth.Session{}: // Causes abort if not in strict mode.
+			default:
 			}
-			if *success {
-				if err == nil {
-					select {
-					case authenticate <- remotePeer:
-						host.ConnManager().Protect(remotePeer, "receiver")
-						// Mark receiver as candidate for DHT routing.
-						host.Peerstore().Put(remotePeer, node.DhtRoutingTag, struct{}{})
-					default:
-					}
-				}
-			} else {
-				if !strict {
-					select {
-					case authenticate <- "": // Causes abort if not in strict mode.
-					default:
+		} else {
+			retryAfter = time.Now().Add(attemptDelay << (failedAttempts - 1))
+			slog.Warn("Receiver failed to authenticate.", "remainingAttempts", remaining)
+		}
+	}
+
+	handler := func(stream network.Stream) {
+		slog.Debug("Received new auth stream.", "protocol", stream.Protocol())
+		remotePeer := stream.Conn().RemotePeer()
+		if options.Receiver != "" && remotePeer != options.Receiver {
+			slog.Warn("Received auth stream from unexpected receiver.", "receiver", remotePeer)
+			stream.Close()
+			return
+		}
+		if !startAttempt() {
+			stream.Close()
+			return
+		}
+		defer func() {
+			mutex.Lock()
+			attempting = false
+			mutex.Unlock()
+		}()
+
+		session, success, err := handleAuthenticate(stream, secret)
+		if err != nil {
+			slog.Warn("Error authenticating receiver.", "error", err)
+		}
+		if success == nil {
+			return
+		}
+		if *success {
+			if err == nil {
+				select {
+				case authenticate <- session:
+					if session.Legacy {
+						slog.Warn("INSECURE: Receiver authenticated with the legacy protocol, the transfer isn't bound to it.", "receiver", remotePeer)
 					}
+					host.ConnManager().Protect(remotePeer, "receiver")
+					// Mark receiver as candidate for DHT routing.
+					host.Peerstore().Put(remotePeer, node.DhtRoutingTag, struct{}{})
+				default:
 				}
 			}
-		} else {
-			slog.Warn("Received extra auth stream.")
-			stream.Close()
+		} else if !options.Strict {
+			failAttempt()
 		}
-	})
+	}
+	host.SetStreamHandler(auth.Protocol, handler)
+	if options.LegacyAuth {
+		host.SetStreamHandler(auth.LegacyProtocol, handler)
+	}
+
+	defer func() {
+		host.RemoveStreamHandler(auth.Protocol)
+		host.RemoveStreamHandler(auth.LegacyProtocol)
+	}()
 
 	select {
 	case <-ctx.Done():
-		return "", ctx.Err()
-	case authenticatedPeer = <-authenticate:
-		host.RemoveStreamHandler(auth.Protocol)
-		if authenticatedPeer == "" {
-			return "", fmt.Errorf("failed to authenticate receiver")
+		return auth.Session{}, ctx.Err()
+	case session := <-authenticate:
+		mutex.Lock()
+		authenticatedPeer = session.Peer
+		mutex.Unlock()
+		if session.Peer == "" {
+			return session, fmt.Errorf("failed to authenticate receiver")
 		} else {
-			return authenticatedPeer, nil
+			return session, nil
 		}
 	}
 }
 
-func (s *sender) WaitForReceiver(ctx context.Context, secretHash []byte) (peer.ID, error) {
-	return authenticateReceiver(ctx, s.node.GetHost(), secretHash, s.strictMode)
+func (s *sender) WaitForReceiver(ctx context.Context, secret []byte) (auth.Session, error) {
+	return authenticateReceiver(ctx, s.node.GetHost(), secret, s.options)
+}
+
+// Streams of the versions of a protocol opened by concurrent receivers, dispatched by the remote peer.
+type sessionStreams struct {
+	host      host.Host
+	protocols []protocol.ID
+	mutex     sync.Mutex
+	receivers map[peer.ID]authorizedStreams
+}
+
+type authorizedStreams struct {
+	session auth.Session
+	streams chan io.ReadWriteCloser
+}
+
+func newSessionStreams(host host.Host, protocols ...protocol.ID) *sessionStreams {
+	return &sessionStreams{host: host, protocols: protocols, receivers: make(map[peer.ID]authorizedStreams)}
 }
 
-func getAuthorizedStreams(host host.Host, receiver peer.ID) (chan io.ReadWriteCloser, func()) {
+func (t *sessionStreams) handleStream(stream network.Stream) {
+	protocol := stream.Protocol()
+	slog.Debug("Received new session stream.", "protocol", protocol)
+	t.mutex.Lock()
+	receiver, ok := t.receivers[stream.Conn().RemotePeer()]
+	t.mutex.Unlock()
+	if !ok {
+		slog.Warn("Unauthorized session stream.", "protocol", protocol)
+		stream.Close()
+		return
+	}
+	if receiver.session.Legacy {
+		// Only added to the insecure streams, whose protocol has no tags.
+		receiver.streams <- stream
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(streamTagTimeout))
+	valid, err := receiver.session.VerifyStreamTag(stream, protocol)
+	stream.SetReadDeadline(time.Time{})
+	if !valid {
+		slog.Warn("Stream not bound to the current session.", "protocol", protocol, "error", err)
+		stream.Close()
+	} else {
+		receiver.streams <- stream
+	}
+}
+
+// Accepts the streams of the receiver until canceled.
+func (t *sessionStreams) add(receiver auth.Session) (chan io.ReadWriteCloser, func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.receivers) == 0 {
+		for _, protocol := range t.protocols {
+			t.host.SetStreamHandler(protocol, t.handleStream)
+		}
+	}
 	streams := make(chan io.ReadWriteCloser, 1)
+	t.receivers[receiver.Peer] = authorizedStreams{session: receiver, streams: streams}
 	cancel := func() {
-		host.RemoveStreamHandler(transfer.Protocol)
-	}
-	host.SetStreamHandler(transfer.Protocol, func(stream network.Stream) {
-		slog.Debug("Received new transfer stream.")
-		remotePeer := stream.Conn().RemotePeer()
-		if receiver != remotePeer {
-			slog.Warn("Unauthorized transfer stream.")
-			stream.Close()
-		} else {
-			streams <- stream
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if current, ok := t.receivers[receiver.Peer]; ok && current.streams == streams {
+			delete(t.receivers, receiver.Peer)
 		}
-	})
+		if len(t.receivers) == 0 {
+			for _, protocol := range t.protocols {
+				t.host.RemoveStreamHandler(protocol)
+			}
+		}
+	}
 	return streams, cancel
 }
 
-func (s *sender) Send(ctx context.Context, receiver peer.ID, basePath string) (err error) {
+func (s *sender) Send(ctx context.Context, receiver auth.Session, basePaths []string) (err error) {
 	n := s.node
-	host := n.GetHost()
 
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	n.RegisterErrorHandler(receiver, func(errStr string) {
-		slog.Error("Receiver error", "error", errStr)
+	unregister := n.RegisterErrorHandler(receiver, func(errStr string) {
+		slog.Error("Receiver error", "receiver", receiver.Peer, "error", errStr)
 		cancel()
 	})
-	streams, cancelStreams := getAuthorizedStreams(host, receiver)
-	interrupt.RegisterInterruptHandler(ctx, func() {
+	defer unregister()
+	transfers := s.streams
+	if receiver.Legacy {
+		slog.Warn("INSECURE: Sending over the transfer protocol of older versions, anyone on the connection of the receiver can take its place.")
+		transfers = s.insecure
+	}
+	streams, cancelStreams := transfers.add(receiver)
+	defer cancelStreams()
+	// Legacy receivers neither select entries nor open parallel streams.
+	var selections, parallel chan io.ReadWriteCloser
+	if !receiver.Legacy {
+		var cancelSelections, cancelParallel func()
+		selections, cancelSelections = s.selections.add(receiver)
+		defer cancelSelections()
+		parallel, cancelParallel = s.parallel.add(receiver)
+		defer cancelParallel()
+	}
+	lanes := dispatchParallelStreams(ctx, parallel)
+	cancelTransfer := func() {
 		cancelStreams()
-		n.SendError(ctx, receiver, "Transfer canceled.")
+		n.SendError(context.WithoutCancel(ctx), receiver, "Transfer canceled.")
 		cancel()
-	})
+	}
+	if s.options.Receivers == 1 {
+		interrupt.RegisterInterruptHandler(ctx, cancelTransfer)
+	} else {
+		// Serving several receivers, the caller cancels the transfers on a later interrupt
+		// than the one that stops accepting new receivers.
+		stop := context.AfterFunc(parent, cancelTransfer)
+		defer stop()
+	}
+
+	// The version of the first stream decides the format, the receiver opens it right away.
+	var first io.ReadWriteCloser
+	select {
+	case first = <-streams:
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for transfer stream: %w", ctx.Err())
+	}
+	legacy := isLegacyStream(first)
+	slog.Debug("Receiver connected.", "legacy", legacy)
 
 	writer := channel.NewChannelWriter(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		if first != nil {
+			stream := first
+			first = nil
+			return stream, nil
+		}
 		select {
 		case stream := <-streams:
 			return stream, nil
@@ -155,20 +354,111 @@ func (s *sender) Send(ctx context.Context, receiver peer.ID, basePath string) (e
 		}
 	}()
 
-	err = transfer.WriteZip(writer, basePath)
+	var symlinks []transfer.SymlinkReport
+	err = transfer.WriteZip(writer, basePaths, transfer.WriteOptions{
+		Quiet:       s.options.Concurrent,
+		Filter:      s.options.Filter,
+		IgnoreFiles: s.options.IgnoreFiles,
+		Compression: s.options.Compression,
+		Legacy:      legacy,
+		Insecure:    receiver.Legacy,
+		Streams:     s.options.Streams,
+		Symlinks:    s.options.Symlinks,
+		Stdin:       s.options.Stdin,
+		StdinName:   s.options.StdinName,
+		Symlinked: func(report transfer.SymlinkReport) {
+			symlinks = append(symlinks, report)
+		},
+		OpenStream: func(index int) io.WriteCloser {
+			return channel.NewChannelWriter(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+				select {
+				case stream := <-lanes[index]:
+					return stream, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			})
+		},
+		Select: func(manifest transfer.Manifest) (transfer.Selection, error) {
+			return waitForSelection(ctx, selections)
+		},
+	})
 	if err == nil {
 		err = writer.Flush(true)
 	}
 	if err != nil {
 		n.SendError(ctx, receiver, "")
 		cancel()
-		return fmt.Errorf("error sending path %s: %w", basePath, err)
+		sources := slices.Clone(basePaths)
+		if s.options.Stdin != nil {
+			sources = append(sources, "stdin")
+		}
+		return fmt.Errorf("error sending %s: %w", strings.Join(sources, ", "), err)
 	}
 
+	if summary := summarizeSymlinks(symlinks); summary != "" {
+		fmt.Println(summary)
+	}
 	slog.Info("Transfer complete.")
 	return nil
 }
 
+// Dispatches the parallel streams of the receiver by the index written after their tag,
+// a stream reopened after an error continues the same parallel stream.
+func dispatchParallelStreams(ctx context.Context, streams chan io.ReadWriteCloser) []chan io.ReadWriteCloser {
+	lanes := make([]chan io.ReadWriteCloser, transfer.MaxStreams)
+	for i := range lanes {
+		lanes[i] = make(chan io.ReadWriteCloser)
+	}
+	go func() {
+		for {
+			select {
+			case stream := <-streams:
+				go func() {
+					index := make([]byte, 1)
+					if s, ok := stream.(network.Stream); ok {
+						s.SetReadDeadline(time.Now().Add(streamTagTimeout))
+						defer s.SetReadDeadline(time.Time{})
+					}
+					if _, err := io.ReadFull(stream, index); err != nil || int(index[0]) >= len(lanes) {
+						slog.Warn("Invalid parallel stream.", "error", err)
+						stream.Close()
+						return
+					}
+					select {
+					case lanes[index[0]] <- stream:
+					case <-ctx.Done():
+						stream.Close()
+					}
+				}()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return lanes
+}
+
+func isLegacyStream(stream io.ReadWriteCloser) bool {
+	s, ok := stream.(network.Stream)
+	return ok && s.Protocol() == transfer.LegacyProtocol
+}
+
+// Waits for the receiver to request entries of the manifest.
+func waitForSelection(ctx context.Context, selections chan io.ReadWriteCloser) (transfer.Selection, error) {
+	select {
+	case stream := <-selections:
+		defer stream.Close()
+		selection, err := transfer.ReadSelection(stream)
+		if err == nil {
+			_, err = stream.Write([]byte{1})
+		}
+		return selection, err
+	case <-ctx.Done():
+		return transfer.Selection{}, ctx.Err()
+	}
+}
+
 func advertiseToWAN(sender Sender, ctx context.Context) error {
 	node := sender.GetNode()
 	topic := sender.GetAdvertiseTopic()
@@ -191,80 +481,113 @@ func advertiseToWAN(sender Sender, ctx context.Context) error {
 	return ctx.Err()
 }
 
-func newSender(ctx context.Context, strictMode bool, privateMode bool, options ...libp2p.Option) Sender {
-	node := node.NewNode(ctx, privateMode, options...)
-	return &sender{node: node, strictMode: strictMode}
+func newSender(ctx context.Context, options Options, libp2pOptions ...libp2p.Option) Sender {
+	if options.Identity != nil {
+		libp2pOptions = append(libp2pOptions, libp2p.Identity(options.Identity))
+	}
+	return newNodeSender(node.NewNode(ctx, options.Private, libp2pOptions...), options)
 }
 
-func NewAdvertisedSender(ctx context.Context, strictMode bool, privateMode bool) (Sender, error) {
-	var sender Sender
-	if privateMode {
-		sender = newSender(ctx, strictMode, privateMode)
-	} else {
-		// Create new sender every 6 seconds. until 1 successfully advertised itself to WAN DHT.
-		groupCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
-
-		ps, err := pstoremem.NewPeerstore()
-		errors.Unexpected(err, "create peerstore")
-
-		resultChan := make(chan Sender, 1)
-		var wg sync.WaitGroup
+func newNodeSender(node node.Node, options Options) *sender {
+	host := node.GetHost()
+	return &sender{
+		node:       node,
+		options:    options,
+		streams:    newSessionStreams(host, transfer.Protocol, transfer.LegacyProtocol),
+		insecure:   newSessionStreams(host, transfer.InsecureProtocol),
+		selections: newSessionStreams(host, transfer.SelectProtocol),
+		parallel:   newSessionStreams(host, transfer.ParallelProtocol),
+	}
+}
 
-		// Try advertising up to 1 minute.
-		launchNode := func() error {
-			if groupCtx.Err() != nil {
-				return groupCtx.Err()
-			}
+// Creates new senders until one successfully advertised itself to WAN DHT.
+func newRacedSender(ctx context.Context, options Options) (Sender, error) {
+	groupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			candidate := newSender(ctx, strictMode, privateMode, libp2p.Peerstore(ps))
-			success := false
-			defer func() {
-				if !success {
-					candidate.Close()
-				}
-			}()
+	ps, err := pstoremem.NewPeerstore()
+	errors.Unexpected(err, "create peerstore")
 
-			timeoutCtx, cancel := context.WithTimeout(groupCtx, time.Minute)
-			defer cancel()
-			err := advertiseToWAN(candidate, timeoutCtx)
-			if err != nil {
-				return err
-			}
+	resultChan := make(chan Sender, 1)
+	var wg sync.WaitGroup
 
-			select {
-			case resultChan <- candidate:
-				success = true
-			case <-groupCtx.Done():
-			}
-			return nil
+	// Try advertising up to 1 minute.
+	launchNode := func() error {
+		if groupCtx.Err() != nil {
+			return groupCtx.Err()
 		}
 
-		go func() {
-			for i := 0; groupCtx.Err() == nil; i++ {
-				// Create 3 nodes at once at the beginning.
-				if i >= 3 {
-					time.Sleep(6 * time.Second)
-				}
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					err := launchNode()
-					if err != nil && groupCtx.Err() != context.Canceled {
-						slog.Debug("Error creating advertised node.", "error", err)
-					}
-				}()
+		candidate := newSender(ctx, options, libp2p.Peerstore(ps))
+		success := false
+		defer func() {
+			if !success {
+				candidate.Close()
 			}
 		}()
 
+		timeoutCtx, cancel := context.WithTimeout(groupCtx, time.Minute)
+		defer cancel()
+		err := advertiseToWAN(candidate, timeoutCtx)
+		if err != nil {
+			return err
+		}
+
 		select {
-		case sender = <-resultChan:
-		case <-ctx.Done():
-			return nil, ctx.Err()
+		case resultChan <- candidate:
+			success = true
+		case <-groupCtx.Done():
 		}
+		return nil
+	}
 
-		cancel()
-		wg.Wait()
+	go func() {
+		for i := 0; groupCtx.Err() == nil; i++ {
+			// Create 3 nodes at once at the beginning.
+			if i >= 3 {
+				time.Sleep(6 * time.Second)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := launchNode()
+				if err != nil && groupCtx.Err() != context.Canceled {
+					slog.Debug("Error creating advertised node.", "error", err)
+				}
+			}()
+		}
+	}()
+
+	var sender Sender
+	select {
+	case sender = <-resultChan:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	cancel()
+	wg.Wait()
+	return sender, nil
+}
+
+func NewAdvertisedSender(ctx context.Context, options Options) (Sender, error) {
+	var sender Sender
+	if options.Private {
+		sender = newSender(ctx, options)
+	} else {
+		var err error
+		if options.Identity != nil {
+			// Nodes sharing the persistent identity can't race each other, keep advertising the same node.
+			sender = newSender(ctx, options)
+			err = advertiseToWAN(sender, ctx)
+			if err != nil {
+				sender.Close()
+			}
+		} else {
+			sender, err = newRacedSender(ctx, options)
+		}
+		if err != nil {
+			return nil, err
+		}
 
 		go func() {
 			for ctx.Err() == nil {
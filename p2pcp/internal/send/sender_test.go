@@ -1,14 +1,24 @@
 package send
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"io"
+	"os"
 	"p2pcp/internal/auth"
+	"p2pcp/internal/node"
 	"p2pcp/internal/transfer"
+	"p2pcp/internal/transfer/channel"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
 	"testing"
 	"time"
 
-	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -26,10 +36,10 @@ func TestCancelAuthentication(t *testing.T) {
 	ctx, cancel := context.WithCancel(t.Context())
 	cancel()
 
-	peerID, err := authenticateReceiver(ctx, h1, nil, false)
+	session, err := authenticateReceiver(ctx, h1, nil, Options{})
 	require.Error(t, err)
 	require.Equal(t, context.Canceled, err)
-	require.Empty(t, peerID)
+	require.Empty(t, session)
 }
 
 func TestConnectionError(t *testing.T) {
@@ -45,14 +55,13 @@ func TestConnectionError(t *testing.T) {
 	err = net.LinkAll()
 	require.NoError(t, err)
 
-	secret := "test"
-	secretHash := auth.ComputeHash([]byte(secret))
+	secret := []byte("test")
 
-	var peerID peer.ID
+	var session auth.Session
 	var authenticateErr error
 	done := make(chan struct{})
 	go func() {
-		peerID, authenticateErr = authenticateReceiver(t.Context(), h1, secretHash, false)
+		session, authenticateErr = authenticateReceiver(t.Context(), h1, secret, Options{})
 		done <- struct{}{}
 	}()
 
@@ -69,7 +78,7 @@ func TestConnectionError(t *testing.T) {
 	case <-done:
 		t.Fatal("authentication should not have completed")
 	default:
-		assert.Empty(t, peerID)
+		assert.Empty(t, session)
 		assert.Nil(t, authenticateErr)
 	}
 }
@@ -89,7 +98,8 @@ func TestUnauthorizedStream(t *testing.T) {
 	err = net.LinkAll()
 	require.NoError(t, err)
 
-	streams, _ := getAuthorizedStreams(h1, h2.ID())
+	session := auth.Session{Peer: h2.ID(), Key: []byte("current")}
+	streams, _ := newSessionStreams(h1, transfer.Protocol).add(session)
 
 	go func() {
 		for stream := range streams {
@@ -103,6 +113,8 @@ func TestUnauthorizedStream(t *testing.T) {
 	stream1, err := h2.NewStream(t.Context(), h1.ID(), transfer.Protocol)
 	assert.NoError(t, err)
 	if err == nil {
+		err = session.WriteStreamTag(stream1, transfer.Protocol)
+		assert.NoError(t, err)
 		n, err := io.ReadFull(stream1, make([]byte, 1))
 		assert.NoError(t, err)
 		assert.Equal(t, 1, n)
@@ -117,4 +129,362 @@ func TestUnauthorizedStream(t *testing.T) {
 		assert.Equal(t, 0, n)
 		stream2.Close()
 	}
+
+	// Stream from the receiver, but tagged with the key of another session.
+	staleSession := auth.Session{Peer: h2.ID(), Key: []byte("stale")}
+	stream3, err := h2.NewStream(t.Context(), h1.ID(), transfer.Protocol)
+	assert.NoError(t, err)
+	if err == nil {
+		err = staleSession.WriteStreamTag(stream3, transfer.Protocol)
+		assert.NoError(t, err)
+		n, err := io.ReadFull(stream3, make([]byte, 1))
+		assert.Error(t, err)
+		assert.Equal(t, 0, n)
+		stream3.Close()
+	}
+}
+
+func TestConcurrentReceiverStreams(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	h3, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	sessionStreams := newSessionStreams(h1, transfer.Protocol)
+	session2 := auth.Session{Peer: h2.ID(), Key: []byte("receiver 2")}
+	session3 := auth.Session{Peer: h3.ID(), Key: []byte("receiver 3")}
+	streams2, cancel2 := sessionStreams.add(session2)
+	streams3, cancel3 := sessionStreams.add(session3)
+	defer cancel3()
+
+	serve := func(streams chan io.ReadWriteCloser, id byte) {
+		for stream := range streams {
+			func() {
+				defer stream.Close()
+				stream.Write([]byte{id})
+			}()
+		}
+	}
+	go serve(streams2, 2)
+	go serve(streams3, 3)
+
+	read := func(h host.Host, session auth.Session) (byte, error) {
+		stream, err := h.NewStream(t.Context(), h1.ID(), transfer.Protocol)
+		if err != nil {
+			return 0, err
+		}
+		defer stream.Close()
+		if err := session.WriteStreamTag(stream, transfer.Protocol); err != nil {
+			return 0, err
+		}
+		buffer := make([]byte, 1)
+		_, err = io.ReadFull(stream, buffer)
+		return buffer[0], err
+	}
+
+	id, err := read(h2, session2)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), id)
+	id, err = read(h3, session3)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(3), id)
+
+	// Canceling one receiver keeps the streams of the other one.
+	cancel2()
+	_, err = read(h2, session2)
+	assert.Error(t, err)
+	id, err = read(h3, session3)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(3), id)
+}
+
+func TestUnexpectedReceiver(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	h3, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	secret := []byte("paired key")
+
+	var session auth.Session
+	var authenticateErr error
+	done := make(chan struct{})
+	go func() {
+		session, authenticateErr = authenticateReceiver(t.Context(), h1, secret, Options{Strict: true, Receiver: h2.ID()})
+		done <- struct{}{}
+	}()
+
+	// Knowing the secret isn't enough for another peer.
+	var stream network.Stream
+	for {
+		time.Sleep(100 * time.Microsecond)
+		stream, err = h3.NewStream(t.Context(), h1.ID(), auth.Protocol)
+		if err == nil {
+			break
+		}
+	}
+	_, success, err := auth.KeyExchange(stream, secret, h3.ID(), h1.ID())
+	assert.Error(t, err)
+	assert.False(t, success)
+
+	stream, err = h2.NewStream(t.Context(), h1.ID(), auth.Protocol)
+	require.NoError(t, err)
+	key, success, err := auth.KeyExchange(stream, secret, h2.ID(), h1.ID())
+	require.NoError(t, err)
+	assert.True(t, success)
+
+	<-done
+	require.NoError(t, authenticateErr)
+	assert.Equal(t, h2.ID(), session.Peer)
+	assert.Equal(t, key, session.Key)
+}
+
+func TestFailedAttempts(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	secret := []byte("123456")
+
+	var session auth.Session
+	var authenticateErr error
+	done := make(chan struct{})
+	go func() {
+		session, authenticateErr = authenticateReceiver(t.Context(), h1, secret, Options{MaxAttempts: 2})
+		close(done)
+	}()
+
+	keyExchange := func(secret []byte) (bool, error) {
+		for {
+			time.Sleep(100 * time.Millisecond)
+			stream, err := h2.NewStream(t.Context(), h1.ID(), auth.Protocol)
+			if err == nil {
+				_, success, err := auth.KeyExchange(stream, secret, h2.ID(), h1.ID())
+				return success, err
+			}
+		}
+	}
+
+	// A typo doesn't abort.
+	success, err := keyExchange([]byte("123465"))
+	require.NoError(t, err)
+	assert.False(t, success)
+
+	// Attempts are rejected during the delay.
+	_, err = keyExchange(secret)
+	assert.Error(t, err)
+
+	time.Sleep(attemptDelay)
+	success, err = keyExchange(secret)
+	require.NoError(t, err)
+	assert.True(t, success)
+
+	<-done
+	require.NoError(t, authenticateErr)
+	assert.Equal(t, h2.ID(), session.Peer)
+}
+
+func TestFailedAttemptsExceeded(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	var authenticateErr error
+	done := make(chan struct{})
+	go func() {
+		_, authenticateErr = authenticateReceiver(t.Context(), h1, []byte("123456"), Options{MaxAttempts: 2})
+		close(done)
+	}()
+
+	for attempt := range 2 {
+		if attempt > 0 {
+			time.Sleep(attemptDelay << (attempt - 1))
+		}
+		for {
+			time.Sleep(100 * time.Millisecond)
+			stream, err := h2.NewStream(t.Context(), h1.ID(), auth.Protocol)
+			if err == nil {
+				_, success, err := auth.KeyExchange(stream, []byte("654321"), h2.ID(), h1.ID())
+				require.NoError(t, err)
+				assert.False(t, success)
+				break
+			}
+		}
+	}
+
+	<-done
+	assert.ErrorContains(t, authenticateErr, "failed to authenticate receiver")
+}
+
+func TestLegacyTransferStreams(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	session := auth.Session{Peer: h2.ID(), Key: []byte("current")}
+	streams, cancel := newSessionStreams(h1, transfer.Protocol, transfer.LegacyProtocol).add(session)
+	defer cancel()
+
+	// Older receivers only know the legacy version, newer ones prefer the current one.
+	for _, protocols := range [][]protocol.ID{
+		{transfer.LegacyProtocol},
+		{transfer.Protocol, transfer.LegacyProtocol},
+	} {
+		stream, err := h2.NewStream(t.Context(), h1.ID(), protocols...)
+		require.NoError(t, err)
+		require.NoError(t, session.WriteStreamTag(stream, stream.Protocol()))
+		received := <-streams
+		assert.Equal(t, len(protocols) == 1, isLegacyStream(received))
+		received.Close()
+		stream.Close()
+	}
+}
+
+// Serves the sender over a host of the mock network.
+type mockNode struct {
+	node.Node
+	host host.Host
+}
+
+func (m *mockNode) GetHost() host.Host { return m.host }
+
+func (m *mockNode) RegisterErrorHandler(session auth.Session, handler func(string)) func() {
+	return func() {}
+}
+
+func (m *mockNode) SendError(ctx context.Context, session auth.Session, errStr string) {}
+
+// Sends to a receiver speaking the wire format of the versions authenticating with the hash of the secret.
+func TestSendLegacyReceiver(t *testing.T) {
+	t.Parallel()
+
+	net := mocknet.New()
+	defer net.Close()
+
+	h1, err := net.GenPeer()
+	require.NoError(t, err)
+	h2, err := net.GenPeer()
+	require.NoError(t, err)
+	err = net.LinkAll()
+	require.NoError(t, err)
+
+	sendPath := filepath.Join(os.TempDir(), project.Name, "test", "legacy_receiver")
+	workspace.ResetDir(filepath.Join(sendPath, "sub"))
+	require.NoError(t, os.WriteFile(filepath.Join(sendPath, "sub", "file"), []byte("file"), 0o644))
+
+	secret := []byte("123456")
+	s := newNodeSender(&mockNode{host: h1}, Options{LegacyAuth: true, MaxAttempts: 1})
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		session, err := s.WaitForReceiver(ctx, secret)
+		if err == nil {
+			err = s.Send(ctx, session, []string{sendPath})
+		}
+		sent <- err
+	}()
+
+	// Streams are opened before their handlers are set, like the older versions retry.
+	newStream := func(ctx context.Context, protocol protocol.ID) (network.Stream, error) {
+		for {
+			stream, err := h2.NewStream(ctx, h1.ID(), protocol)
+			if err == nil || ctx.Err() != nil {
+				return stream, err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	stream, err := newStream(ctx, "/p2pcp/auth/1.0.0")
+	require.NoError(t, err)
+	success, err := auth.Authenticate(stream, auth.ComputeHash(secret))
+	require.NoError(t, err)
+	require.True(t, success)
+
+	reader := channel.NewChannelReader(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return newStream(ctx, "/p2pcp/transfer/1.0.0")
+	})
+	zipReader, err := gzip.NewReader(reader)
+	require.NoError(t, err)
+	entries := make(map[string]string)
+	tarReader := tar.NewReader(zipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entries[header.Name] = "/"
+		case tar.TypeReg:
+			content, err := io.ReadAll(tarReader)
+			require.NoError(t, err)
+			entries[header.Name] = string(content)
+		default:
+			t.Fatalf("unsupported file type for entry %s", header.Name)
+		}
+	}
+	_, err = io.Copy(io.Discard, reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	require.NoError(t, <-sent)
+	assert.Equal(t, map[string]string{
+		"legacy_receiver":          "/",
+		"legacy_receiver/sub":      "/",
+		"legacy_receiver/sub/file": "file",
+	}, entries)
+}
+
+func TestSummarizeSymlinks(t *testing.T) {
+	assert.Empty(t, summarizeSymlinks(nil))
+	assert.Equal(t,
+		"Followed 1 symbolic links:\n  dir/lib -> ../lib\nSkipped 1 symbolic links:\n  dir/etc -> /etc (target outside of the path)",
+		summarizeSymlinks([]transfer.SymlinkReport{
+			{Name: "dir/etc", Target: "/etc", Reason: "target outside of the path"},
+			{Name: "dir/lib", Target: "../lib", Followed: true},
+		}))
 }
@@ -0,0 +1,27 @@
+package send
+
+import (
+	"fmt"
+	"p2pcp/internal/transfer"
+	"strings"
+)
+
+// Lists the symbolic links that were followed or skipped instead of sent as links, empty if none.
+func summarizeSymlinks(reports []transfer.SymlinkReport) string {
+	var followed, skipped []string
+	for _, r := range reports {
+		if r.Followed {
+			followed = append(followed, fmt.Sprintf("%s -> %s", r.Name, r.Target))
+		} else {
+			skipped = append(skipped, fmt.Sprintf("%s -> %s (%s)", r.Name, r.Target, r.Reason))
+		}
+	}
+	var summary []string
+	if len(followed) > 0 {
+		summary = append(summary, fmt.Sprintf("Followed %d symbolic links:\n  %s", len(followed), strings.Join(followed, "\n  ")))
+	}
+	if len(skipped) > 0 {
+		summary = append(summary, fmt.Sprintf("Skipped %d symbolic links:\n  %s", len(skipped), strings.Join(skipped, "\n  ")))
+	}
+	return strings.Join(summary, "\n")
+}
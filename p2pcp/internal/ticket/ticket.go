@@ -0,0 +1,114 @@
+package ticket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Everything a receiver needs in a single string: the sender's peer ID and
+// addresses to dial directly, the topic to fall back to discovery, and the secret.
+
+const prefix = "p2pcp1"
+
+const version = 1
+
+type Ticket struct {
+	Peer   peer.ID
+	Addrs  []ma.Multiaddr
+	Topic  string
+	Secret string
+}
+
+func IsTicket(str string) bool {
+	return strings.HasPrefix(str, prefix)
+}
+
+func appendPrefixed(buffer []byte, data []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+func (t Ticket) String() string {
+	buffer := []byte{version}
+	buffer = appendPrefixed(buffer, []byte(t.Peer))
+	buffer = appendPrefixed(buffer, []byte(t.Topic))
+	buffer = appendPrefixed(buffer, []byte(t.Secret))
+	buffer = binary.AppendUvarint(buffer, uint64(len(t.Addrs)))
+	for _, addr := range t.Addrs {
+		buffer = appendPrefixed(buffer, addr.Bytes())
+	}
+	return prefix + b58.Encode(buffer)
+}
+
+func readPrefixed(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
+
+func Parse(str string) (Ticket, error) {
+	var t Ticket
+	if !IsTicket(str) {
+		return t, fmt.Errorf("invalid ticket: missing prefix")
+	}
+	data, err := b58.Decode(strings.TrimPrefix(str, prefix))
+	if err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	reader := bytes.NewReader(data)
+	if v, err := reader.ReadByte(); err != nil || v != version {
+		return t, fmt.Errorf("unsupported ticket version")
+	}
+
+	peerID, err := readPrefixed(reader)
+	if err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	if t.Peer, err = peer.IDFromBytes(peerID); err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	topic, err := readPrefixed(reader)
+	if err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	t.Topic = string(topic)
+	secret, err := readPrefixed(reader)
+	if err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	t.Secret = string(secret)
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return t, fmt.Errorf("invalid ticket: %w", err)
+	}
+	for range count {
+		addr, err := readPrefixed(reader)
+		if err != nil {
+			return t, fmt.Errorf("invalid ticket: %w", err)
+		}
+		multiaddr, err := ma.NewMultiaddrBytes(addr)
+		if err != nil {
+			return t, fmt.Errorf("invalid ticket: %w", err)
+		}
+		t.Addrs = append(t.Addrs, multiaddr)
+	}
+	if reader.Len() > 0 {
+		return t, fmt.Errorf("invalid ticket: trailing data")
+	}
+	return t, nil
+}
@@ -0,0 +1,65 @@
+package ticket
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPeerID = "12D3KooWQ4Y3NxGrCvJ7H2ob6TNBVWYn7GDtgTVkDxkDvuVnxBtY"
+
+func TestTicket(t *testing.T) {
+	peerID, err := peer.Decode(testPeerID)
+	require.NoError(t, err)
+	ticket := Ticket{
+		Peer: peerID,
+		Addrs: []ma.Multiaddr{
+			ma.StringCast("/ip4/192.168.1.2/udp/4001/quic-v1"),
+			ma.StringCast("/ip6/::1/tcp/4001"),
+		},
+		Topic:  "VnxBtYa",
+		Secret: "123456",
+	}
+
+	str := ticket.String()
+	assert.True(t, IsTicket(str))
+	parsed, err := Parse(str)
+	require.NoError(t, err)
+	assert.Equal(t, ticket.Peer, parsed.Peer)
+	assert.Equal(t, ticket.Topic, parsed.Topic)
+	assert.Equal(t, ticket.Secret, parsed.Secret)
+	require.Len(t, parsed.Addrs, 2)
+	for i, addr := range ticket.Addrs {
+		assert.True(t, addr.Equal(parsed.Addrs[i]))
+	}
+
+	// Without addresses
+	ticket.Addrs = nil
+	parsed, err = Parse(ticket.String())
+	require.NoError(t, err)
+	assert.Empty(t, parsed.Addrs)
+}
+
+func TestParseInvalid(t *testing.T) {
+	peerID, err := peer.Decode(testPeerID)
+	require.NoError(t, err)
+	str := Ticket{Peer: peerID, Topic: "VnxBtYa", Secret: "123456"}.String()
+
+	assert.False(t, IsTicket(testPeerID))
+	_, err = Parse(testPeerID)
+	assert.ErrorContains(t, err, "missing prefix")
+	data, err := b58.Decode(str[len(prefix):])
+	require.NoError(t, err)
+	_, err = Parse(prefix + b58.Encode(data[:len(data)-3]))
+	assert.ErrorContains(t, err, "invalid ticket")
+	_, err = Parse(prefix + b58.Encode(append(data, 0)))
+	assert.ErrorContains(t, err, "trailing data")
+	_, err = Parse(prefix + "0OIl")
+	assert.ErrorContains(t, err, "invalid ticket")
+	_, err = Parse(prefix + b58.Encode([]byte{2}))
+	assert.ErrorContains(t, err, "unsupported ticket version")
+}
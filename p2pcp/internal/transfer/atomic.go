@@ -0,0 +1,184 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Temporary path a file is written to before it replaces the path, also kept to resume from.
+func partPath(path string) string {
+	return filepath.Join(filepath.Dir(path), ".p2pcp-part-"+filepath.Base(path))
+}
+
+// Flushes the file to disk before closing it, so a renamed file is never empty after a crash.
+func syncClose(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Creates the directory the whole tree is received into, next to the entries it replaces.
+func startStaging(basePath string) (string, error) {
+	dir, err := os.MkdirTemp(basePath, ".p2pcp-atomic-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating staging directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Moves the staged tree into the base path and removes the staging directory. Each top-level entry
+// replaces the existing one with a single rename, and the previous entries are kept until all of them
+// are in place, so a failing commit leaves the base path as it was.
+func commitStaging(staging string, basePath string) error {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return fmt.Errorf("error reading staged directory %s: %w", staging, err)
+	}
+	for _, e := range entries {
+		if err := checkCommit(filepath.Join(staging, e.Name()), filepath.Join(basePath, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	old, err := os.MkdirTemp(basePath, ".p2pcp-old-*")
+	if err != nil {
+		return fmt.Errorf("error creating directory for replaced entries: %w", err)
+	}
+	c := &commit{}
+	c.undo = append(c.undo, func() error { return os.Remove(old) })
+	for _, e := range entries {
+		if err := c.swap(filepath.Join(staging, e.Name()), filepath.Join(basePath, e.Name()), filepath.Join(old, e.Name())); err != nil {
+			c.rollback()
+			return err
+		}
+	}
+	if err := os.RemoveAll(old); err != nil {
+		slog.Warn("Error removing replaced entries.", "path", old, "error", err)
+	}
+	return os.RemoveAll(staging)
+}
+
+func abortStaging(staging string) {
+	if err := os.RemoveAll(staging); err != nil {
+		slog.Warn("Error removing staging directory.", "path", staging, "error", err)
+	}
+}
+
+// Fails if a staged entry that isn't a directory would replace a directory, before anything is renamed.
+func checkCommit(staged string, target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error committing %s: %w", target, err)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	stagedInfo, err := os.Lstat(staged)
+	if err != nil {
+		return fmt.Errorf("error reading staged entry %s: %w", staged, err)
+	}
+	if !stagedInfo.IsDir() {
+		return fmt.Errorf("error committing %s: is a directory", target)
+	}
+	entries, err := os.ReadDir(staged)
+	if err != nil {
+		return fmt.Errorf("error reading staged directory %s: %w", staged, err)
+	}
+	for _, e := range entries {
+		if err := checkCommit(filepath.Join(staged, e.Name()), filepath.Join(target, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes made to the base path by a commit, undone in reverse order if it fails.
+type commit struct {
+	undo []func() error
+}
+
+func (c *commit) rename(from string, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return fmt.Errorf("error committing %s: %w", to, err)
+	}
+	c.undo = append(c.undo, func() error { return os.Rename(to, from) })
+	return nil
+}
+
+func (c *commit) rollback() {
+	for i := len(c.undo) - 1; i >= 0; i-- {
+		if err := c.undo[i](); err != nil {
+			slog.Warn("Error rolling back commit.", "error", err)
+		}
+	}
+}
+
+// Replaces the target with the staged entry, moving the existing one to the old path.
+// Directories are merged first, the staged one replaces the existing one whole.
+func (c *commit) swap(staged string, target string, old string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c.rename(staged, target)
+	} else if err != nil {
+		return fmt.Errorf("error committing %s: %w", target, err)
+	}
+	if info.IsDir() {
+		if err := c.merge(staged, target); err != nil {
+			return err
+		}
+	}
+	if err := c.rename(target, old); err != nil {
+		return err
+	}
+	return c.rename(staged, target)
+}
+
+// Moves the entries only the existing directory has into the staged one, keeping the staged ones.
+func (c *commit) merge(staged string, existing string) error {
+	stagedInfo, err := os.Lstat(staged)
+	if err != nil {
+		return fmt.Errorf("error reading staged directory %s: %w", staged, err)
+	}
+	existingInfo, err := os.Lstat(existing)
+	if err != nil {
+		return fmt.Errorf("error committing %s: %w", existing, err)
+	}
+	// Moving the entries changes the times of both directories.
+	c.undo = append(c.undo, func() error {
+		return os.Chtimes(existing, accessTime(existingInfo), existingInfo.ModTime())
+	})
+
+	entries, err := os.ReadDir(existing)
+	if err != nil {
+		return fmt.Errorf("error committing %s: %w", existing, err)
+	}
+	for _, e := range entries {
+		from := filepath.Join(existing, e.Name())
+		to := filepath.Join(staged, e.Name())
+		info, err := os.Lstat(to)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := c.rename(from, to); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading staged entry %s: %w", to, err)
+		}
+		if e.IsDir() && info.IsDir() {
+			if err := c.merge(to, from); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Chtimes(staged, accessTime(stagedInfo), stagedInfo.ModTime()); err != nil {
+		return fmt.Errorf("error committing %s: %w", staged, err)
+	}
+	return nil
+}
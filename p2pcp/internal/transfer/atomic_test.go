@@ -0,0 +1,136 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"runtime"
+	"test/pkg/asserts"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A directory to send, and a target with an older copy of a file and a file only the receiver has.
+var atomicTree = map[string]testEntry{
+	"send/dir/big":       {content: randomContent(13, 4<<20)},
+	"send/dir/sub/added": {content: []byte("added")},
+	"target/dir/big":     {content: randomContent(14, 1000)},
+	"target/dir/own":     {content: []byte("own")},
+}
+
+// Writes the archive of the path cut off in the middle of its content.
+func truncatedArchive(t *testing.T, sendPath string) *bytes.Reader {
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true, Compression: Compression{Codec: CodecNone}}))
+	return bytes.NewReader(buffer.Bytes()[:buffer.Len()/2])
+}
+
+func TestInterruptedFileKeepsExisting(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "interrupted_file")
+	sendPath, targetPath := createTree(t, testPath, atomicTree)
+	existing := atomicTree["target/dir/big"].content
+
+	err := ReadZip(truncatedArchive(t, sendPath), targetPath, ReadOptions{})
+	assert.Error(t, err)
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "big"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(existing, content))
+	assert.NoFileExists(t, partPath(filepath.Join(targetPath, "dir", "big")))
+}
+
+func TestAtomicTransfer(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "atomic")
+	sendPath, targetPath := createTree(t, testPath, atomicTree)
+	existing := atomicTree["target/dir/big"].content
+
+	// Nothing changes in the target if the transfer fails.
+	err := ReadZip(truncatedArchive(t, sendPath), targetPath, ReadOptions{Atomic: true})
+	assert.Error(t, err)
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "big"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(existing, content))
+	assert.NoDirExists(t, filepath.Join(targetPath, "dir", "sub"))
+	entries, err := os.ReadDir(targetPath)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// The staged tree is merged into the existing directory.
+	_, err = transferZip(sendPath, targetPath, ReadOptions{Atomic: true})
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(targetPath, "dir", "own")))
+	asserts.AssertDirsEqual(sendPath, filepath.Join(targetPath, "dir"))
+	entries, err = os.ReadDir(targetPath)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestAtomicCommitConflict(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "atomic_commit_conflict")
+	sendPath, targetPath := createTree(t, testPath, atomicTree)
+	existing := atomicTree["target/dir/big"].content
+	workspace.ResetDir(filepath.Join(targetPath, "dir", "sub", "added"))
+	info, err := os.Stat(filepath.Join(targetPath, "dir"))
+	require.NoError(t, err)
+
+	// The file in the way of the directory fails the commit before dir/big is replaced.
+	_, err = transferZip(sendPath, targetPath, ReadOptions{Atomic: true})
+	assert.ErrorContains(t, err, "is a directory")
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "big"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(existing, content))
+	assert.FileExists(t, filepath.Join(targetPath, "dir", "own"))
+	assert.DirExists(t, filepath.Join(targetPath, "dir", "sub", "added"))
+	committed, err := os.Stat(filepath.Join(targetPath, "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), committed.ModTime())
+	entries, err := os.ReadDir(targetPath)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1) // The staging directory is removed.
+}
+
+func TestAtomicCommitRollback(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions not enforced")
+	}
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "atomic_commit_rollback")
+	sendPath, targetPath := createTree(t, testPath, atomicTree)
+	existing := atomicTree["target/dir/big"].content
+	subPath := filepath.Join(targetPath, "dir", "sub")
+	workspace.ResetDir(subPath)
+	require.NoError(t, os.WriteFile(filepath.Join(subPath, "mine"), []byte("mine"), 0o644))
+	require.NoError(t, os.Chmod(subPath, 0o555))
+	t.Cleanup(func() { os.Chmod(subPath, 0o755) })
+
+	// Moving dir/sub/mine fails after dir/own was moved, which is moved back.
+	_, err := transferZip(sendPath, targetPath, ReadOptions{Atomic: true})
+	assert.ErrorContains(t, err, "permission denied")
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "big"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(existing, content))
+	assert.FileExists(t, filepath.Join(targetPath, "dir", "own"))
+	assert.FileExists(t, filepath.Join(subPath, "mine"))
+	assert.NoFileExists(t, filepath.Join(subPath, "added"))
+	entries, err := os.ReadDir(targetPath)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestAtomicSync(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "atomic_sync")
+	sendPath, targetPath := createTree(t, testPath, atomicTree)
+	content, err := os.ReadFile(filepath.Join(sendPath, "big"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(targetPath, "dir", "big"), append([]byte("prefix"), content...), 0o644))
+
+	// Deltas apply to the copies in the target, not in the staging directory.
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{Atomic: true, Sync: true})
+	require.NoError(t, err)
+	assert.Contains(t, selection.Signatures, "dir/big")
+	received, err := os.ReadFile(filepath.Join(targetPath, "dir", "big"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, received))
+}
@@ -0,0 +1,390 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"p2pcp/internal/errors"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// spell-checker: ignore klauspost pierrec zstd
+
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+	CodecLz4  Codec = "lz4"
+)
+
+// Codecs of this version, advertised by the receiver in its selection.
+var SupportedCodecs = []Codec{CodecZstd, CodecLz4, CodecGzip, CodecNone}
+
+// Identifies the codec of a frame.
+var codecIDs = []Codec{CodecNone, CodecGzip, CodecZstd, CodecLz4}
+
+// Highest level of each codec, the lowest is 1.
+var maxLevels = map[Codec]int{CodecNone: 0, CodecGzip: gzip.BestCompression, CodecZstd: 22, CodecLz4: 9}
+
+// Upper bound of the uncompressed data of a frame.
+const maxFrameSize = 1 << 20
+
+// Size of the sample of a file to estimate its entropy from.
+const entropySampleSize = 4 << 10
+
+// Files with more bits of entropy per byte in their sample are sent uncompressed.
+const maxEntropy = 7.5
+
+// Extensions of formats that are compressed already.
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true, ".deb": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true,
+	".lz4": true, ".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".odt": true,
+	".ogg": true, ".png": true, ".pptx": true, ".rar": true, ".rpm": true, ".tgz": true, ".webm": true,
+	".webp": true, ".woff2": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// Compression preferred by the sender.
+type Compression struct {
+	Codec Codec // Zstd if empty.
+	Level int   // Default of the codec if 0.
+}
+
+// Parses a codec with an optional level, e.g. "zstd" or "zstd:19".
+func ParseCompression(value string) (Compression, error) {
+	name, levelValue, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(value)), ":")
+	compression := Compression{Codec: Codec(name)}
+	maxLevel, ok := maxLevels[compression.Codec]
+	if !ok {
+		return compression, fmt.Errorf("unsupported codec %q, expected one of %v", name, SupportedCodecs)
+	}
+	if hasLevel {
+		level, err := strconv.Atoi(levelValue)
+		if err != nil || level < 1 || level > maxLevel {
+			if maxLevel == 0 {
+				return compression, fmt.Errorf("%s has no levels", name)
+			}
+			return compression, fmt.Errorf("invalid level %q for %s, expected 1 to %d", levelValue, name, maxLevel)
+		}
+		compression.Level = level
+	}
+	return compression, nil
+}
+
+func (c Compression) String() string {
+	if c.Level == 0 {
+		return string(c.Codec)
+	}
+	return fmt.Sprintf("%s:%d", c.Codec, c.Level)
+}
+
+// Falls back to gzip if the receiver doesn't support the codec.
+func (c Compression) negotiate(supported []Codec) Compression {
+	if c.Codec == "" {
+		c.Codec = CodecZstd
+	}
+	if !slices.Contains(supported, c.Codec) {
+		return Compression{Codec: CodecGzip}
+	}
+	return c
+}
+
+// Shannon entropy of the data in bits per byte.
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var result float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			result -= p * math.Log2(p)
+		}
+	}
+	return result
+}
+
+// Whether the file is worth compressing, judged by its extension or a sample of its content.
+func isCompressible(path string) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return true // Reported when sending the file.
+	}
+	defer file.Close()
+	sample := make([]byte, entropySampleSize)
+	n, _ := io.ReadFull(file, sample)
+	return n < entropySampleSize || entropy(sample[:n]) <= maxEntropy
+}
+
+// Compresses the stream in frames of up to maxFrameSize, each with its own codec:
+// a codec byte, the uncompressed and compressed size as uvarint, and the compressed data.
+type frameWriter struct {
+	w           io.Writer
+	compression Compression
+	codec       Codec // Codec of the buffered data.
+	buffer      []byte
+	compressed  bytes.Buffer
+	gzip        *gzip.Writer
+	zstd        *zstd.Encoder
+	scratch     []byte
+}
+
+func newFrameWriter(w io.Writer, compression Compression) *frameWriter {
+	return &frameWriter{w: w, compression: compression, codec: compression.Codec}
+}
+
+// Sets the compression of the data written from now on.
+func (f *frameWriter) setCompression(compression Compression) error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	f.compression = compression
+	f.gzip, f.zstd = nil, nil
+	return f.use(compression.Codec)
+}
+
+// Switches the codec of the data written next, e.g. for the content of a file.
+func (f *frameWriter) use(codec Codec) error {
+	if codec == f.codec {
+		return nil
+	}
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	f.codec = codec
+	return nil
+}
+
+// Compresses the file written next with the codec of the stream, unless it looks incompressible.
+func (f *frameWriter) startFile(path string) error {
+	if f == nil {
+		return nil
+	}
+	codec := f.compression.Codec
+	if codec != CodecNone && !isCompressible(path) {
+		codec = CodecNone
+	}
+	return f.use(codec)
+}
+
+// Switches back to the codec of the stream for the following headers.
+func (f *frameWriter) endFile() error {
+	if f == nil {
+		return nil
+	}
+	return f.use(f.compression.Codec)
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFrameSize-len(f.buffer))
+		f.buffer = append(f.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(f.buffer) == maxFrameSize {
+			if err := f.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Writes the buffered data as a frame.
+func (f *frameWriter) Flush() error {
+	if len(f.buffer) == 0 {
+		return nil
+	}
+	codec, payload := f.compress()
+	header := []byte{byte(slices.Index(codecIDs, codec))}
+	header = binary.AppendUvarint(header, uint64(len(f.buffer)))
+	header = binary.AppendUvarint(header, uint64(len(payload)))
+	f.buffer = f.buffer[:0]
+	if _, err := f.w.Write(header); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+func (f *frameWriter) Close() error {
+	return f.Flush()
+}
+
+// Compresses the buffer with the current codec, or not at all if that doesn't make it smaller.
+func (f *frameWriter) compress() (Codec, []byte) {
+	var payload []byte
+	switch f.codec {
+	case CodecGzip:
+		if f.gzip == nil {
+			level := f.compression.Level
+			if f.compression.Codec != CodecGzip || level == 0 {
+				level = gzip.DefaultCompression
+			}
+			var err error
+			f.gzip, err = gzip.NewWriterLevel(nil, level)
+			errors.Unexpected(err, "frameWriter.compress: gzip.NewWriterLevel")
+		}
+		f.compressed.Reset()
+		f.gzip.Reset(&f.compressed)
+		f.gzip.Write(f.buffer)
+		f.gzip.Close()
+		payload = f.compressed.Bytes()
+	case CodecZstd:
+		if f.zstd == nil {
+			level := zstd.SpeedDefault
+			if f.compression.Codec == CodecZstd && f.compression.Level > 0 {
+				level = zstd.EncoderLevelFromZstd(f.compression.Level)
+			}
+			var err error
+			f.zstd, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+			errors.Unexpected(err, "frameWriter.compress: zstd.NewWriter")
+		}
+		payload = f.zstd.EncodeAll(f.buffer, f.scratch[:0])
+		f.scratch = payload
+	case CodecLz4:
+		bound := lz4.CompressBlockBound(len(f.buffer))
+		f.scratch = slices.Grow(f.scratch[:0], bound)[:bound]
+		var n int
+		var err error
+		if f.compression.Codec == CodecLz4 && f.compression.Level > 0 {
+			compressor := lz4.CompressorHC{Level: lz4.CompressionLevel(1 << (8 + f.compression.Level))}
+			n, err = compressor.CompressBlock(f.buffer, f.scratch)
+		} else {
+			var compressor lz4.Compressor
+			n, err = compressor.CompressBlock(f.buffer, f.scratch)
+		}
+		errors.Unexpected(err, "frameWriter.compress: lz4.CompressBlock")
+		payload = f.scratch[:n]
+	}
+	if f.codec == CodecNone || len(payload) == 0 || len(payload) >= len(f.buffer) {
+		return CodecNone, f.buffer
+	}
+	return f.codec, payload
+}
+
+// Reads the frames of frameWriter.
+type frameReader struct {
+	r       io.Reader
+	frame   []byte // Uncompressed data left of the current frame.
+	buffer  []byte
+	payload []byte
+	gzip    *gzip.Reader
+	zstd    *zstd.Decoder
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.frame) == 0 {
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.frame)
+	f.frame = f.frame[n:]
+	return n, nil
+}
+
+func (f *frameReader) Close() error {
+	if f.zstd != nil {
+		f.zstd.Close()
+	}
+	return nil
+}
+
+// Reads and decompresses the next frame, io.EOF if the stream ended before it.
+func (f *frameReader) next() error {
+	reader := &byteReader{f.r}
+	id, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if int(id) >= len(codecIDs) {
+		return fmt.Errorf("unsupported codec %d in frame", id)
+	}
+	codec := codecIDs[id]
+	size, err := binary.ReadUvarint(reader)
+	if err == nil && (size == 0 || size > maxFrameSize) {
+		err = fmt.Errorf("invalid frame size %d", size)
+	}
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	payloadSize, err := binary.ReadUvarint(reader)
+	if err == nil && (payloadSize == 0 || payloadSize > size) { // Frames are never larger compressed.
+		err = fmt.Errorf("invalid frame size %d", payloadSize)
+	}
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	f.payload = slices.Grow(f.payload[:0], int(payloadSize))[:payloadSize]
+	if _, err := io.ReadFull(f.r, f.payload); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	f.buffer = slices.Grow(f.buffer[:0], int(size))[:size]
+	switch codec {
+	case CodecNone:
+		if payloadSize != size {
+			err = fmt.Errorf("invalid frame size %d", payloadSize)
+		}
+		copy(f.buffer, f.payload)
+	case CodecGzip:
+		if f.gzip == nil {
+			f.gzip, err = gzip.NewReader(bytes.NewReader(f.payload))
+		} else {
+			err = f.gzip.Reset(bytes.NewReader(f.payload))
+		}
+		if err == nil {
+			_, err = io.ReadFull(f.gzip, f.buffer)
+		}
+	case CodecZstd:
+		if f.zstd == nil {
+			f.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecodeAllCapLimit(true))
+			errors.Unexpected(err, "frameReader.next: zstd.NewReader")
+		}
+		var decoded []byte
+		decoded, err = f.zstd.DecodeAll(f.payload, f.buffer[:0])
+		if err == nil && len(decoded) != int(size) {
+			err = fmt.Errorf("frame of %d bytes instead of %d", len(decoded), size)
+		}
+	case CodecLz4:
+		var n int
+		n, err = lz4.UncompressBlock(f.payload, f.buffer)
+		if err == nil && n != int(size) {
+			err = fmt.Errorf("frame of %d bytes instead of %d", n, size)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error decompressing %s frame: %w", codec, err)
+	}
+	f.frame = f.buffer
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Compression
+		err      string
+	}{
+		{"zstd", Compression{Codec: CodecZstd}, ""},
+		{"ZSTD:19", Compression{Codec: CodecZstd, Level: 19}, ""},
+		{"gzip:9", Compression{Codec: CodecGzip, Level: 9}, ""},
+		{"lz4:1", Compression{Codec: CodecLz4, Level: 1}, ""},
+		{"none", Compression{Codec: CodecNone}, ""},
+		{"gzip:10", Compression{}, "invalid level"},
+		{"zstd:x", Compression{}, "invalid level"},
+		{"none:1", Compression{}, "none has no levels"},
+		{"brotli", Compression{}, "unsupported codec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			compression, err := ParseCompression(tt.value)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, compression)
+		})
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	assert.Equal(t, Compression{Codec: CodecZstd}, Compression{}.negotiate(SupportedCodecs))
+	assert.Equal(t, Compression{Codec: CodecLz4, Level: 3}, Compression{Codec: CodecLz4, Level: 3}.negotiate(SupportedCodecs))
+	// Receivers of older versions only know gzip.
+	assert.Equal(t, Compression{Codec: CodecGzip}, Compression{Codec: CodecLz4, Level: 3}.negotiate(nil))
+}
+
+func TestFrameReadWrite(t *testing.T) {
+	text := []byte(strings.Repeat("compressible text ", 100_000))
+	random := randomContent(5, 1_500_000)
+	compressions := []Compression{
+		{Codec: CodecNone}, {Codec: CodecGzip}, {Codec: CodecGzip, Level: 1},
+		{Codec: CodecZstd}, {Codec: CodecZstd, Level: 19}, {Codec: CodecLz4}, {Codec: CodecLz4, Level: 9},
+	}
+	for _, compression := range compressions {
+		t.Run(compression.String(), func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := newFrameWriter(&buffer, compression)
+			_, err := writer.Write(text)
+			require.NoError(t, err)
+			require.NoError(t, writer.use(CodecNone))
+			_, err = writer.Write(random)
+			require.NoError(t, err)
+			require.NoError(t, writer.use(compression.Codec))
+			_, err = writer.Write(text[:1000])
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			if compression.Codec == CodecNone {
+				assert.Greater(t, buffer.Len(), len(text)+len(random))
+			} else {
+				assert.Less(t, buffer.Len(), len(text)/10+len(random)+1000)
+			}
+
+			reader := newFrameReader(&buffer)
+			defer reader.Close()
+			received, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			expected := append(append(append([]byte{}, text...), random...), text[:1000]...)
+			assert.True(t, bytes.Equal(expected, received))
+		})
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	tests := map[string][]byte{
+		"unexpected EOF":       {0, 5, 5, 'x'},
+		"invalid frame size 0": {0, 0, 0},
+		"invalid frame size 6": {0, 5, 6, 'x', 'x', 'x', 'x', 'x', 'x'},
+		"invalid frame size 4": {0, 5, 4, 'x', 'x', 'x', 'x'},
+		"error decompressing":  {3, 5, 2, 0xff, 0xff},
+		"unsupported codec 4":  {4, 1, 1, 'x'},
+	}
+	for message, frames := range tests {
+		t.Run(message, func(t *testing.T) {
+			_, err := io.ReadAll(newFrameReader(bytes.NewReader(frames)))
+			assert.ErrorContains(t, err, message)
+		})
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	basePath := filepath.Join(os.TempDir(), project.Name, "test", "compressible")
+	workspace.ResetDir(basePath)
+	files := map[string][]byte{
+		"text.txt":   []byte(strings.Repeat("text ", 10_000)),
+		"small.bin":  randomContent(6, 100),
+		"random.bin": randomContent(7, 10_000),
+		"photo.JPG":  []byte(strings.Repeat("text ", 10_000)),
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(basePath, name), content, 0o644))
+	}
+
+	assert.True(t, isCompressible(filepath.Join(basePath, "text.txt")))
+	assert.True(t, isCompressible(filepath.Join(basePath, "small.bin")))
+	assert.False(t, isCompressible(filepath.Join(basePath, "random.bin")))
+	assert.False(t, isCompressible(filepath.Join(basePath, "photo.JPG")))
+}
@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// How the receiver handles entries in the way of received ones.
+// Received directories are merged into existing ones, their content is checked entry by entry.
+type ConflictPolicy string
+
+const (
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictRename    ConflictPolicy = "rename" // Receive the entry under a free name.
+	ConflictNewer     ConflictPolicy = "newer"  // Overwrite older entries, skip the others.
+	ConflictFail      ConflictPolicy = "fail"
+	ConflictAsk       ConflictPolicy = "ask"
+)
+
+var ConflictPolicies = []ConflictPolicy{ConflictOverwrite, ConflictSkip, ConflictRename, ConflictNewer, ConflictFail, ConflictAsk}
+
+var ErrConflict = fmt.Errorf("already exists")
+
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	policy := ConflictPolicy(strings.ToLower(value))
+	if !slices.Contains(ConflictPolicies, policy) {
+		return "", fmt.Errorf("unsupported policy %s", value)
+	}
+	return policy, nil
+}
+
+// An entry of the sender in the way of an existing one, and how it's resolved.
+type Conflict struct {
+	Entry      ManifestEntry
+	Existing   fs.FileInfo
+	Resolution ConflictPolicy // Overwrite, skip or rename.
+	Renamed    string         // Name the entry is received under if renamed.
+}
+
+// Resolves the conflicts of the selected entries by the policy, returning the selection without the skipped entries
+// and the renamed entries. Entries of an interrupted transfer to resume aren't conflicts.
+func resolveConflicts(basePath string, manifest Manifest, selection Selection, j *journal, options ReadOptions) (Selection, map[string]string, error) {
+	policy := options.OnConflict
+	if policy == "" || policy == ConflictOverwrite {
+		return selection, nil, nil
+	}
+	names := make(map[string]bool, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		names[e.Name] = true
+	}
+
+	resolved := selection
+	resolved.All, resolved.Names = false, []string{}
+	renamed := make(map[string]string)
+	skipped := make(map[string]bool)
+	for _, e := range manifest.Select(selection).Entries {
+		parent := path.Dir(e.Name)
+		if skipped[parent] {
+			skipped[e.Name] = true
+			continue
+		}
+		if name, ok := renamed[parent]; ok {
+			// Nothing exists below a free name.
+			renamed[e.Name] = path.Join(name, path.Base(e.Name))
+			resolved.Names = append(resolved.Names, e.Name)
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(basePath, filepath.FromSlash(e.Name)))
+		isResumed := j != nil && (j.done[e.Name] || j.partial == e.Name)
+		if err != nil || isResumed || (e.Type == EntryDir && info.IsDir()) {
+			resolved.Names = append(resolved.Names, e.Name)
+			continue
+		}
+
+		conflict := Conflict{Entry: e, Existing: info, Resolution: policy}
+		if policy == ConflictAsk {
+			conflict.Resolution, err = options.Ask(conflict)
+			if err != nil {
+				return selection, nil, err
+			}
+		}
+		if conflict.Resolution == ConflictNewer {
+			conflict.Resolution = ConflictSkip
+			if e.ModTime > info.ModTime().Unix() {
+				conflict.Resolution = ConflictOverwrite
+			}
+		}
+		switch conflict.Resolution {
+		case ConflictFail:
+			return selection, nil, fmt.Errorf("%s %w", e.Name, ErrConflict)
+		case ConflictSkip:
+			skipped[e.Name] = true
+		case ConflictRename:
+			conflict.Renamed = freeName(basePath, e.Name, names)
+			renamed[e.Name] = conflict.Renamed
+			resolved.Names = append(resolved.Names, e.Name)
+		default:
+			resolved.Names = append(resolved.Names, e.Name)
+		}
+		if options.Conflicted != nil {
+			options.Conflicted(conflict)
+		}
+	}
+
+	if len(resolved.Offsets) > 0 {
+		resolved.Offsets = make(map[string]int64)
+		for name, offset := range selection.Offsets {
+			if !skipped[name] {
+				resolved.Offsets[name] = offset
+			}
+		}
+	}
+	return resolved, renamed, nil
+}
+
+// Finds a name like "file (1).txt" that neither exists nor is received.
+func freeName(basePath string, name string, names map[string]bool) string {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = "" // Dot files
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, i, ext)
+		if _, err := os.Lstat(filepath.Join(basePath, filepath.FromSlash(candidate))); os.IsNotExist(err) && !names[candidate] {
+			return candidate
+		}
+	}
+}
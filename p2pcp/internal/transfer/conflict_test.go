@@ -0,0 +1,132 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, policy := range ConflictPolicies {
+		parsed, err := ParseConflictPolicy(string(policy))
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	parsed, err := ParseConflictPolicy("Skip")
+	require.NoError(t, err)
+	assert.Equal(t, ConflictSkip, parsed)
+	_, err = ParseConflictPolicy("merge")
+	assert.ErrorContains(t, err, "unsupported policy merge")
+}
+
+func TestFreeName(t *testing.T) {
+	basePath := filepath.Join(os.TempDir(), project.Name, "test", "free_name")
+	workspace.ResetDir(filepath.Join(basePath, "dir"))
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, "dir", "file (1).txt"), nil, 0o644))
+
+	assert.Equal(t, "dir/file (2).txt", freeName(basePath, "dir/file.txt", nil))
+	assert.Equal(t, "dir/file (3).txt", freeName(basePath, "dir/file.txt", map[string]bool{"dir/file (2).txt": true}))
+	assert.Equal(t, "dir/.hidden (1)", freeName(basePath, "dir/.hidden", nil))
+	assert.Equal(t, "dir (1)", freeName(basePath, "dir", nil))
+}
+
+// A target with an older file, a newer file and an older file where the sender has a directory.
+func conflictTree() map[string]testEntry {
+	now := time.Now()
+	return map[string]testEntry{
+		"send/dir/old":      {content: []byte("sent"), modTime: now},
+		"send/dir/new":      {content: []byte("sent"), modTime: now.Add(-time.Hour)},
+		"send/dir/sub/file": {content: []byte("sent")},
+		"send/dir/added":    {content: []byte("sent")},
+		"target/dir/old":    {content: []byte("existing"), modTime: now.Add(-time.Hour)},
+		"target/dir/new":    {content: []byte("existing"), modTime: now},
+		"target/dir/sub":    {content: []byte("existing"), modTime: now.Add(-time.Hour)},
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "conflicts")
+	tests := []struct {
+		policy   ConflictPolicy
+		expected map[string]string // Content of the files after the transfer.
+		missing  []string
+	}{
+		{ConflictOverwrite, map[string]string{"old": "sent", "new": "sent", "sub/file": "sent", "added": "sent"}, nil},
+		{ConflictSkip, map[string]string{"old": "existing", "new": "existing", "sub": "existing", "added": "sent"}, []string{"old (1)", "sub (1)"}},
+		{ConflictNewer, map[string]string{"old": "sent", "new": "existing", "sub/file": "sent", "added": "sent"}, nil},
+		{ConflictRename, map[string]string{
+			"old": "existing", "old (1)": "sent", "new": "existing", "new (1)": "sent",
+			"sub": "existing", "sub (1)/file": "sent", "added": "sent",
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			sendPath, targetPath := createTree(t, testPath, conflictTree())
+
+			var conflicts []Conflict
+			_, err := transferZip(sendPath, targetPath, ReadOptions{
+				OnConflict: tt.policy,
+				Conflicted: func(conflict Conflict) { conflicts = append(conflicts, conflict) },
+			})
+			require.NoError(t, err)
+			for name, content := range tt.expected {
+				received, err := os.ReadFile(filepath.Join(targetPath, "dir", name))
+				require.NoError(t, err, name)
+				assert.Equal(t, content, string(received), name)
+			}
+			for _, name := range tt.missing {
+				assert.NoFileExists(t, filepath.Join(targetPath, "dir", name))
+			}
+			if tt.policy == ConflictOverwrite {
+				assert.Empty(t, conflicts)
+			} else {
+				// Existing directories are merged.
+				require.Len(t, conflicts, 3)
+				assert.Equal(t, "dir/new", conflicts[0].Entry.Name)
+			}
+		})
+	}
+}
+
+func TestConflictFail(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "conflicts_fail")
+	sendPath, targetPath := createTree(t, testPath, conflictTree())
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true}))
+	err := ReadZip(&buffer, targetPath, ReadOptions{OnConflict: ConflictFail})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.ErrorContains(t, err, "dir/new already exists")
+	assert.NoFileExists(t, filepath.Join(targetPath, "dir", "added"))
+}
+
+func TestConflictAsk(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "conflicts_ask")
+	sendPath, targetPath := createTree(t, testPath, conflictTree())
+
+	answers := map[string]ConflictPolicy{"dir/old": ConflictOverwrite, "dir/new": ConflictRename, "dir/sub": ConflictSkip}
+	var resolved []Conflict
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{
+		OnConflict: ConflictAsk,
+		Ask: func(conflict Conflict) (ConflictPolicy, error) {
+			assert.False(t, conflict.Existing.IsDir())
+			return answers[conflict.Entry.Name], nil
+		},
+		Conflicted: func(conflict Conflict) { resolved = append(resolved, conflict) },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir", "dir/added", "dir/new", "dir/old"}, selection.Names)
+	require.Len(t, resolved, 3)
+	assert.Equal(t, "dir/new (1)", resolved[0].Renamed)
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "old"))
+	require.NoError(t, err)
+	assert.Equal(t, "sent", string(content))
+	assert.NoDirExists(t, filepath.Join(targetPath, "dir", "sub (1)"))
+}
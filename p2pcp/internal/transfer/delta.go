@@ -0,0 +1,359 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Delta transfer of files the receiver has an older copy of, following rsync: the receiver
+// sends checksums of the blocks of its copy, and the sender sends references to the blocks
+// it finds in its file along with the data in between.
+
+// PAX record of a file header whose content is a delta against the receiver's copy, with the block size.
+const deltaRecord = "P2PCP.delta"
+
+const (
+	minBlockSize  = 2 << 10
+	maxBlockSize  = 1 << 20
+	strongSumSize = 8 // Truncated BLAKE2b, the hash of the whole file catches collisions.
+)
+
+const (
+	opData byte = iota // Length and data of the sender's file.
+	opCopy             // First block and number of blocks of the receiver's copy.
+)
+
+// What the receiver has of a file, lets the sender skip it if unchanged or send a delta.
+type Signature struct {
+	Size      int64
+	ModTime   int64
+	BlockSize int        `json:",omitempty"`
+	Blocks    []BlockSum `json:",omitempty"` // Full blocks only, the tail of the copy isn't reused.
+}
+
+type BlockSum struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Whether the receiver's copy has the size and modification time of the file.
+func (s Signature) matches(header *tar.Header) bool {
+	return s.Size == header.Size && s.ModTime == header.ModTime.Unix()
+}
+
+// Block size about the square root of the file size, like rsync.
+func signatureBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+func strongSum(block []byte) []byte {
+	sum := blake2b.Sum256(block)
+	return sum[:strongSumSize]
+}
+
+// Weak checksum of rsync that can be rolled over the file one byte at a time.
+type rollingSum struct {
+	a, b, length uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	r := rollingSum{length: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.length*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// Computes the signature of the receiver's copy of a file, with checksums of its blocks
+// only if it differs from the entry of the manifest.
+func computeSignature(path string, e ManifestEntry) (*Signature, error) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil // Nothing to reuse.
+	}
+	signature := &Signature{Size: info.Size(), ModTime: info.ModTime().Unix()}
+	if signature.Size == e.Size && signature.ModTime == e.ModTime {
+		return signature, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	signature.BlockSize = signatureBlockSize(info.Size())
+	reader := bufio.NewReader(file)
+	block := make([]byte, signature.BlockSize)
+	for {
+		if _, err := io.ReadFull(reader, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading file %s: %w", path, err)
+		}
+		signature.Blocks = append(signature.Blocks, BlockSum{Weak: newRollingSum(block).sum(), Strong: strongSum(block)})
+	}
+	return signature, nil
+}
+
+// Computes the signatures of the receiver's copies of the selected files, except the resumed ones.
+func computeSignatures(basePath string, manifest Manifest, offsets map[string]int64) (map[string]Signature, error) {
+	signatures := make(map[string]Signature)
+	for _, e := range manifest.Entries {
+		if _, ok := offsets[e.Name]; ok || e.Type != EntryFile {
+			continue
+		}
+		path, err := entryPath(basePath, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := computeSignature(path, e)
+		if err != nil {
+			return nil, err
+		}
+		if signature != nil {
+			signatures[e.Name] = *signature
+		}
+	}
+	return signatures, nil
+}
+
+// Copies blocks of the receiver's copy, or data of the sender's file if count is 0.
+type deltaOp struct {
+	block, count   int64
+	offset, length int64
+}
+
+func (op deltaOp) encodedSize() int64 {
+	var buffer [2 * binary.MaxVarintLen64]byte
+	if op.count > 0 {
+		return 1 + int64(len(binary.AppendUvarint(binary.AppendUvarint(buffer[:0], uint64(op.block)), uint64(op.count))))
+	}
+	return 1 + int64(len(binary.AppendUvarint(buffer[:0], uint64(op.length)))) + op.length
+}
+
+// A delta of a file against the receiver's copy, with the data of the file referenced by offsets.
+type delta struct {
+	ops []deltaOp
+}
+
+func (d *delta) addData(offset int64, length int64) {
+	if length > 0 {
+		d.ops = append(d.ops, deltaOp{offset: offset, length: length})
+	}
+}
+
+func (d *delta) addCopy(block int64) {
+	if n := len(d.ops); n > 0 && d.ops[n-1].count > 0 && d.ops[n-1].block+d.ops[n-1].count == block {
+		d.ops[n-1].count++
+		return
+	}
+	d.ops = append(d.ops, deltaOp{block: block, count: 1})
+}
+
+func (d *delta) size() int64 {
+	var size int64
+	for _, op := range d.ops {
+		size += op.encodedSize()
+	}
+	return size
+}
+
+// Finds the blocks of the signature in the file by rolling the weak checksum over it, and writes the
+// content to hash on the way.
+func computeDelta(r io.Reader, signature Signature, hash io.Writer) (*delta, error) {
+	blockSize := signature.BlockSize
+	if blockSize < minBlockSize || blockSize > maxBlockSize {
+		return nil, fmt.Errorf("invalid block size %d in signature", blockSize)
+	}
+	blocks := make(map[uint32][]int64)
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], int64(i))
+	}
+
+	d := &delta{}
+	reader := bufio.NewReader(io.TeeReader(r, hash))
+	window := make([]byte, blockSize) // Ring buffer of the block at offset.
+	block := make([]byte, blockSize)
+	var offset, dataOffset int64
+	for {
+		// Fills the window after a match.
+		n, err := io.ReadFull(reader, window)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			d.addData(dataOffset, offset+int64(n)-dataOffset)
+			return d, nil
+		} else if err != nil {
+			return nil, err
+		}
+		head := 0
+		sum := newRollingSum(window)
+
+		for {
+			if candidates, ok := blocks[sum.sum()]; ok {
+				copy(block, window[head:])
+				copy(block[blockSize-head:], window[:head])
+				strong := strongSum(block)
+				match := int64(-1)
+				for _, i := range candidates {
+					if bytes.Equal(strong, signature.Blocks[i].Strong) {
+						match = i
+						break
+					}
+				}
+				if match >= 0 {
+					d.addData(dataOffset, offset-dataOffset)
+					d.addCopy(match)
+					offset += int64(blockSize)
+					dataOffset = offset
+					break
+				}
+			}
+
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				d.addData(dataOffset, offset+int64(blockSize)-dataOffset)
+				return d, nil
+			} else if err != nil {
+				return nil, err
+			}
+			sum.roll(window[head], c)
+			window[head] = c
+			head = (head + 1) % blockSize
+			offset++
+		}
+	}
+}
+
+// Writes the ops of the delta, reading the data from the file.
+func (d *delta) write(w io.Writer, file io.ReaderAt) error {
+	for _, op := range d.ops {
+		var buffer []byte
+		if op.count > 0 {
+			buffer = binary.AppendUvarint(append(buffer, opCopy), uint64(op.block))
+			buffer = binary.AppendUvarint(buffer, uint64(op.count))
+		} else {
+			buffer = binary.AppendUvarint(append(buffer, opData), uint64(op.length))
+		}
+		if _, err := w.Write(buffer); err != nil {
+			return err
+		}
+		if op.count == 0 {
+			// Fails if the file got shorter since the delta was computed.
+			if _, err := io.CopyN(w, io.NewSectionReader(file, op.offset, op.length), op.length); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deltaHeader(header *tar.Header, size int64, blockSize int) *tar.Header {
+	delta := *header
+	delta.Size = size
+	delta.PAXRecords = maps.Clone(header.PAXRecords)
+	if delta.PAXRecords == nil {
+		delta.PAXRecords = make(map[string]string)
+	}
+	delta.PAXRecords[deltaRecord] = strconv.Itoa(blockSize)
+	return &delta
+}
+
+// Returns the block size of a delta header, or 0 for regular content.
+func deltaBlockSize(header *tar.Header) (int, error) {
+	value, ok := header.PAXRecords[deltaRecord]
+	if !ok {
+		return 0, nil
+	}
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize < minBlockSize || blockSize > maxBlockSize {
+		return 0, fmt.Errorf("invalid delta for %s in archive", header.Name)
+	}
+	return blockSize, nil
+}
+
+// Reconstructs the file from the delta and the copy at its path in the temporary file.
+func readDelta(header *tar.Header, reader io.Reader, path string, temp string, blockSize int, w io.Writer) error {
+	basis, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", path, err)
+	}
+	defer basis.Close()
+
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error creating file for %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err := applyDelta(io.MultiWriter(file, w), reader, basis, blockSize); err != nil {
+		return fmt.Errorf("error applying delta to %s: %w", path, err)
+	}
+	if err := syncClose(file); err != nil {
+		return fmt.Errorf("error writing file %s: %w", path, err)
+	}
+	return nil
+}
+
+func applyDelta(w io.Writer, r io.Reader, basis io.ReaderAt, blockSize int) error {
+	reader := &byteReader{r}
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch op {
+		case opData:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, int64(length)); err != nil {
+				return err
+			}
+		case opCopy:
+			block, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			count, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			if block > math.MaxInt64/uint64(blockSize) || count > math.MaxInt64/uint64(blockSize)-block {
+				return fmt.Errorf("block out of range")
+			}
+			length := int64(count) * int64(blockSize)
+			section := io.NewSectionReader(basis, int64(block)*int64(blockSize), length)
+			if n, err := io.Copy(w, section); err != nil {
+				return err
+			} else if n != length {
+				return fmt.Errorf("block out of range")
+			}
+		default:
+			return fmt.Errorf("invalid operation %d", op)
+		}
+	}
+}
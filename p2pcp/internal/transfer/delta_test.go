@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomContent(seed uint64, size int) []byte {
+	content := make([]byte, size)
+	rand.NewChaCha8([32]byte{byte(seed)}).Read(content)
+	return content
+}
+
+func TestRollingSum(t *testing.T) {
+	content := randomContent(1, 100)
+	sum := newRollingSum(content[:16])
+	for i := 16; i < len(content); i++ {
+		sum.roll(content[i-16], content[i])
+		assert.Equal(t, newRollingSum(content[i-15:i+1]).sum(), sum.sum())
+	}
+}
+
+// Computes the signature of the old content, then the delta of the new content against it.
+func roundTripDelta(t *testing.T, oldContent []byte, newContent []byte) (int64, []byte) {
+	path := filepath.Join(os.TempDir(), project.Name, "test", "delta", "file")
+	workspace.ResetDir(filepath.Dir(path))
+	require.NoError(t, os.WriteFile(path, oldContent, 0o644))
+	signature, err := computeSignature(path, ManifestEntry{Size: -1})
+	require.NoError(t, err)
+
+	hash := newHash()
+	d, err := computeDelta(bytes.NewReader(newContent), *signature, hash)
+	require.NoError(t, err)
+	expected := newHash()
+	expected.Write(newContent)
+	assert.Equal(t, expected.Sum(nil), hash.Sum(nil))
+	var encoded bytes.Buffer
+	require.NoError(t, d.write(&encoded, bytes.NewReader(newContent)))
+	assert.Equal(t, d.size(), int64(encoded.Len()))
+
+	basis, err := os.Open(path)
+	require.NoError(t, err)
+	defer basis.Close()
+	var result bytes.Buffer
+	require.NoError(t, applyDelta(&result, &encoded, basis, signature.BlockSize))
+	return d.size(), result.Bytes()
+}
+
+func TestDelta(t *testing.T) {
+	content := randomContent(2, 100_000)
+	inserted := append(append(append([]byte{}, content[:1000]...), []byte("inserted")...), content[1000:]...)
+	modified := append([]byte{}, content...)
+	copy(modified[50_000:], "modified")
+
+	tests := []struct {
+		name       string
+		oldContent []byte
+		newContent []byte
+		maxSize    int64
+	}{
+		{"unchanged", content, content, minBlockSize + 100}, // The tail isn't reused.
+		{"inserted", content, inserted, 10_000},
+		{"modified", content, modified, 10_000},
+		{"appended", content, append(append([]byte{}, content...), "appended"...), 10_000},
+		{"truncated", content, content[:60_000], 10_000},
+		{"empty basis", nil, content, 100_100},
+		{"empty file", content, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, result := roundTripDelta(t, tt.oldContent, tt.newContent)
+			assert.Equal(t, len(tt.newContent), len(result))
+			assert.True(t, bytes.Equal(tt.newContent, result))
+			assert.LessOrEqual(t, size, tt.maxSize)
+		})
+	}
+}
+
+func TestApplyInvalidDelta(t *testing.T) {
+	basis := bytes.NewReader(randomContent(3, minBlockSize))
+	tests := map[string][]byte{
+		"block out of range": {opCopy, 1, 1},
+		"invalid operation":  {7},
+		"EOF":                {opData, 10, 'x'},
+	}
+	for message, delta := range tests {
+		err := applyDelta(io.Discard, bytes.NewReader(delta), basis, minBlockSize)
+		assert.ErrorContains(t, err, message)
+	}
+	assert.NoError(t, applyDelta(io.Discard, bytes.NewReader([]byte{opCopy, 0, 1}), basis, minBlockSize))
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func TestSyncReadWrite(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "sync")
+	sendPath := filepath.Join(testPath, "send", "dir")
+	targetPath := filepath.Join(testPath, "target")
+	workspace.ResetDir(sendPath)
+	workspace.ResetDir(filepath.Join(targetPath, "dir"))
+
+	content := randomContent(4, 300_000)
+	modified := append([]byte("prefix"), content...)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []struct {
+		name         string
+		content      []byte
+		otherContent []byte
+		hasCopy      bool
+	}{
+		{"changed", modified, content, true},
+		{"unchanged", content, content, true},
+		{"new", content, nil, false},
+	}
+	for _, f := range files {
+		path := filepath.Join(sendPath, f.name)
+		require.NoError(t, os.WriteFile(path, f.content, 0o644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		if f.hasCopy {
+			path := filepath.Join(targetPath, "dir", f.name)
+			require.NoError(t, os.WriteFile(path, f.otherContent, 0o644))
+			require.NoError(t, os.Chtimes(path, modTime, modTime.Add(-time.Hour)))
+		}
+	}
+	// Unchanged by size and modification time, so never read.
+	require.NoError(t, os.Chtimes(filepath.Join(targetPath, "dir", "unchanged"), modTime, modTime))
+
+	selections := make(chan Selection, 1)
+	reader, writer := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		defer writer.Close()
+		writeErr <- WriteZip(writer, []string{sendPath}, WriteOptions{Quiet: true, Select: func(manifest Manifest) (Selection, error) {
+			return <-selections, nil
+		}})
+	}()
+
+	var requested Selection
+	counter := &countingReader{Reader: reader}
+	err := ReadZip(counter, targetPath, ReadOptions{
+		Sync: true,
+		Request: func(selection Selection) error {
+			requested = selection
+			selections <- selection
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-writeErr)
+
+	require.Len(t, requested.Signatures, 2)
+	assert.NotEmpty(t, requested.Signatures["dir/changed"].Blocks)
+	assert.Empty(t, requested.Signatures["dir/unchanged"].Blocks)
+	// The new file in full and a small delta of the changed one.
+	assert.Less(t, counter.count, int64(len(content)+50_000))
+
+	for _, f := range files {
+		path := filepath.Join(targetPath, "dir", f.name)
+		received, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(f.content, received), f.name)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, modTime.Unix(), info.ModTime().Unix(), f.name)
+	}
+}
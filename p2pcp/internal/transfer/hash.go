@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"p2pcp/internal/errors"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// PAX record of the global header following each regular file, with the BLAKE2b-256 hash of its content.
+const hashRecord = "P2PCP.blake2b"
+
+func newHash() hash.Hash {
+	h, err := blake2b.New256(nil)
+	errors.Unexpected(err, "newHash: blake2b.New256")
+	return h
+}
+
+func writeHash(writer *tar.Writer, sum []byte) error {
+	return writeTarHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{hashRecord: hex.EncodeToString(sum)},
+	}, writer)
+}
+
+// A received file awaiting the hash that follows it in the archive.
+type pendingHash struct {
+	name string
+	path string
+	temp string // Written content, renamed to the path once verified.
+	sum  []byte
+}
+
+// Verifies the hash of the global header, removing the content if it's corrupted.
+func (p *pendingHash) verify(header *tar.Header) error {
+	expected, err := hex.DecodeString(header.PAXRecords[hashRecord])
+	if err != nil || len(expected) == 0 {
+		p.discard()
+		return fmt.Errorf("invalid hash for %s in archive", p.name)
+	}
+	if !bytes.Equal(expected, p.sum) {
+		p.discard()
+		return fmt.Errorf("%s is corrupted, its content doesn't match the hash of the sender", p.name)
+	}
+	return nil
+}
+
+// Replaces the path with the verified content.
+func (p *pendingHash) commit() error {
+	if err := os.Rename(p.temp, p.path); err != nil {
+		return fmt.Errorf("error writing file %s: %w", p.path, err)
+	}
+	return nil
+}
+
+func (p *pendingHash) discard() {
+	os.Remove(p.temp)
+}
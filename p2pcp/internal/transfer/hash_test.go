@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds an archive with a single file followed by the given hash records.
+func buildHashedTar(t *testing.T, content string, hashes ...map[string]string) *bytes.Buffer {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0o644, Size: int64(len(content))})
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(content))
+	require.NoError(t, err)
+	for _, records := range hashes {
+		err = writer.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: records})
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return &buffer
+}
+
+func TestReadTarHash(t *testing.T) {
+	outputPath := filepath.Join(os.TempDir(), project.Name, "test", "tar_hash")
+	filePath := filepath.Join(outputPath, "file")
+
+	hash := newHash()
+	hash.Write([]byte("content"))
+	valid := map[string]string{hashRecord: hex.EncodeToString(hash.Sum(nil))}
+
+	workspace.ResetDir(outputPath)
+	err := readTar(buildHashedTar(t, "content", valid), outputPath, nil, nil, nil, ReadOptions{})
+	require.NoError(t, err)
+	assert.FileExists(t, filePath)
+
+	// Content changed in transit.
+	workspace.ResetDir(outputPath)
+	err = readTar(buildHashedTar(t, "CONTENT", valid), outputPath, nil, nil, nil, ReadOptions{})
+	assert.EqualError(t, err, "file is corrupted, its content doesn't match the hash of the sender")
+	assert.NoFileExists(t, filePath)
+
+	workspace.ResetDir(outputPath)
+	err = readTar(buildHashedTar(t, "content"), outputPath, nil, nil, nil, ReadOptions{})
+	assert.EqualError(t, err, "missing hash for file in archive")
+
+	workspace.ResetDir(outputPath)
+	err = readTar(buildHashedTar(t, "content", map[string]string{hashRecord: "xyz"}), outputPath, nil, nil, nil, ReadOptions{})
+	assert.EqualError(t, err, "invalid hash for file in archive")
+
+	workspace.ResetDir(outputPath)
+	err = readTar(buildHashedTar(t, "content", valid, valid), outputPath, nil, nil, nil, ReadOptions{})
+	assert.EqualError(t, err, "unexpected hash in archive")
+}
@@ -0,0 +1,170 @@
+package transfer
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"p2pcp/internal/errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Name of the journal of a resumable transfer in the target directory.
+const JournalName = ".p2pcp-partial"
+
+// PAX record of a file header, the content continues the partial file of the receiver at this offset.
+const offsetRecord = "P2PCP.offset"
+
+func resumeHeader(header *tar.Header, offset int64) *tar.Header {
+	resumed := *header
+	resumed.Size -= offset
+	resumed.PAXRecords = maps.Clone(header.PAXRecords)
+	if resumed.PAXRecords == nil {
+		resumed.PAXRecords = make(map[string]string)
+	}
+	resumed.PAXRecords[offsetRecord] = strconv.FormatInt(offset, 10)
+	return &resumed
+}
+
+func resumeOffset(header *tar.Header) (int64, error) {
+	value, ok := header.PAXRecords[offsetRecord]
+	if !ok {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset for %s in archive", header.Name)
+	}
+	return offset, nil
+}
+
+type journalRecord struct {
+	Manifest string `json:",omitempty"` // ID of the manifest, always the first record.
+	Start    string `json:",omitempty"`
+	Done     string `json:",omitempty"`
+}
+
+// Append-only journal of a resumable transfer, records started and completed files.
+type journal struct {
+	file    *os.File
+	done    map[string]bool
+	partial string // File started last but not completed.
+}
+
+// Opens the journal in the base path, continuing it if it belongs to the same manifest.
+func openJournal(basePath string, manifest Manifest) (*journal, error) {
+	path := filepath.Join(basePath, JournalName)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading journal %s: %w", path, err)
+	}
+
+	id := manifest.id()
+	j := &journal{done: make(map[string]bool)}
+	for i, line := range strings.Split(string(data), "\n") {
+		var record journalRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			break // Torn by a crash.
+		}
+		if i == 0 {
+			if record.Manifest != id {
+				break // Source content changed.
+			}
+			continue
+		}
+		if record.Start != "" {
+			j.partial = record.Start
+		}
+		if record.Done != "" {
+			j.done[record.Done] = true
+			if j.partial == record.Done {
+				j.partial = ""
+			}
+		}
+	}
+
+	// Rewrites the journal with only the current state.
+	j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating journal %s: %w", path, err)
+	}
+	err = j.write(journalRecord{Manifest: id})
+	for name := range j.done {
+		if err == nil {
+			err = j.write(journalRecord{Done: name})
+		}
+	}
+	if err == nil && j.partial != "" {
+		err = j.write(journalRecord{Start: j.partial})
+	}
+	if err != nil {
+		j.file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) write(record journalRecord) error {
+	data, err := json.Marshal(record)
+	errors.Unexpected(err, "journal.write: json.Marshal")
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	return nil
+}
+
+func (j *journal) started(name string) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalRecord{Start: name})
+}
+
+func (j *journal) completed(name string) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalRecord{Done: name})
+}
+
+// Skips the completed files that are still present and continues the partial one from the size of its temporary file.
+func (j *journal) resume(basePath string, manifest Manifest, selection Selection) Selection {
+	resumed := Selection{Names: []string{}, Offsets: make(map[string]int64)}
+	for _, e := range manifest.Select(selection).Entries {
+		if e.Type == EntryFile && (j.done[e.Name] || j.partial == e.Name) {
+			path := filepath.Join(basePath, filepath.FromSlash(e.Name))
+			if j.partial == e.Name {
+				path = partPath(path)
+			}
+			info, err := os.Lstat(path)
+			if err == nil && info.Mode().IsRegular() {
+				if j.done[e.Name] && info.Size() == e.Size {
+					continue
+				} else if j.partial == e.Name && info.Size() > 0 {
+					resumed.Offsets[e.Name] = min(info.Size(), e.Size)
+				}
+			}
+		}
+		resumed.Names = append(resumed.Names, e.Name)
+	}
+	if len(resumed.Offsets) == 0 {
+		resumed.Offsets = nil
+	}
+	return resumed
+}
+
+func (j *journal) close() {
+	j.file.Close()
+}
+
+// Removes the journal of the completed transfer.
+func (j *journal) remove() error {
+	j.file.Close()
+	if err := os.Remove(j.file.Name()); err != nil {
+		return fmt.Errorf("error removing journal: %w", err)
+	}
+	return nil
+}
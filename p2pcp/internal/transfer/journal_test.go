@@ -0,0 +1,107 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"test/pkg/asserts"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Prepares an interrupted transfer with file1 completed and two bytes of file2, corrupted if requested.
+func interruptTransfer(t *testing.T, sendPath string, targetPath string, corrupted bool) {
+	entries, err := collectEntries(sendPath, WriteOptions{})
+	require.NoError(t, err)
+	j, err := openJournal(targetPath, newManifest(entries))
+	require.NoError(t, err)
+	defer j.close()
+
+	info, err := os.Stat(sendPath)
+	require.NoError(t, err)
+	dir := filepath.Join(targetPath, "transfer_dir_multiple_file")
+	require.NoError(t, os.Mkdir(dir, info.Mode().Perm()))
+	require.NoError(t, os.Chmod(dir, info.Mode().Perm())) // Not masked by the umask like Mkdir.
+	copyFile := func(name string, size int) {
+		info, err := os.Stat(filepath.Join(sendPath, name))
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(sendPath, name))
+		require.NoError(t, err)
+		content = content[:size]
+		if corrupted && name == "file2" {
+			content = []byte("XX")
+		}
+		path := filepath.Join(dir, name)
+		if size < int(info.Size()) {
+			path = partPath(path)
+		}
+		require.NoError(t, os.WriteFile(path, content, info.Mode().Perm()))
+		require.NoError(t, os.Chmod(path, info.Mode().Perm()))
+	}
+	copyFile("file1", 5)
+	require.NoError(t, j.started("transfer_dir_multiple_file/file1"))
+	require.NoError(t, j.completed("transfer_dir_multiple_file/file1"))
+	copyFile("file2", 2)
+	require.NoError(t, j.started("transfer_dir_multiple_file/file2"))
+}
+
+func TestResumeTransfer(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "resume_transfer")
+	workspace.ResetDir(targetPath)
+
+	interruptTransfer(t, sendPath, targetPath, false)
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{Resume: true})
+	require.NoError(t, err)
+	assert.NotContains(t, selection.Names, "transfer_dir_multiple_file/file1")
+	assert.Contains(t, selection.Names, "transfer_dir_multiple_file/file2")
+	assert.Equal(t, map[string]int64{"transfer_dir_multiple_file/file2": 2}, selection.Offsets)
+	asserts.AssertDirsEqual(filepath.Join(targetPath, "transfer_dir_multiple_file"), sendPath)
+	assert.NoFileExists(t, filepath.Join(targetPath, JournalName))
+}
+
+func TestResumeTransferCorruptedPartial(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "resume_transfer_corrupted")
+	workspace.ResetDir(targetPath)
+
+	interruptTransfer(t, sendPath, targetPath, true)
+	_, err := transferZip(sendPath, targetPath, ReadOptions{Resume: true})
+	assert.ErrorContains(t, err, "transfer_dir_multiple_file/file2 is corrupted")
+	assert.FileExists(t, filepath.Join(targetPath, JournalName))
+
+	// Starts over with the removed file.
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{Resume: true})
+	require.NoError(t, err)
+	assert.Nil(t, selection.Offsets)
+	asserts.AssertDirsEqual(filepath.Join(targetPath, "transfer_dir_multiple_file"), sendPath)
+}
+
+func TestJournalOfOtherManifest(t *testing.T) {
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "journal_other_manifest")
+	workspace.ResetDir(targetPath)
+
+	manifest := Manifest{Entries: []ManifestEntry{{Name: "file", Type: EntryFile, Size: 5}}}
+	j, err := openJournal(targetPath, manifest)
+	require.NoError(t, err)
+	require.NoError(t, j.started("file"))
+	require.NoError(t, j.completed("file"))
+	j.close()
+
+	j, err = openJournal(targetPath, manifest)
+	require.NoError(t, err)
+	assert.True(t, j.done["file"])
+	j.close()
+
+	// Source content changed.
+	manifest.Entries[0].Size = 6
+	j, err = openJournal(targetPath, manifest)
+	require.NoError(t, err)
+	assert.Empty(t, j.done)
+	assert.Empty(t, j.partial)
+	require.NoError(t, j.remove())
+	assert.NoFileExists(t, filepath.Join(targetPath, JournalName))
+}
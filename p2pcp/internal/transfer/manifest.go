@@ -0,0 +1,248 @@
+package transfer
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"p2pcp/internal/errors"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Upper bound of an encoded manifest or selection, guards the receiver against huge allocations.
+const maxManifestSize = 64 << 20
+
+type EntryType string
+
+const (
+	EntryFile    EntryType = "file"
+	EntryDir     EntryType = "dir"
+	EntrySymlink EntryType = "symlink"
+	EntryFifo    EntryType = "fifo"
+	EntryDevice  EntryType = "device"
+)
+
+type ManifestEntry struct {
+	Name    string
+	Type    EntryType
+	Size    int64 `json:",omitempty"`
+	ModTime int64 `json:",omitempty"` // Unix time, tells changed files apart on resume and newer entries on conflicts.
+	Piped   bool  `json:",omitempty"` // Content of unknown size, e.g. from stdin of the sender, not counted in Size.
+}
+
+// Summary of a transfer, sent ahead of the data so the receiver can approve it.
+type Manifest struct {
+	Entries []ManifestEntry
+	Streams int `json:",omitempty"` // Parallel streams offered by the sender, none if 0.
+}
+
+func newManifest(entries []entry) Manifest {
+	manifest := Manifest{Entries: make([]ManifestEntry, 0, len(entries))}
+	for _, e := range entries {
+		m := ManifestEntry{Name: e.header.Name, ModTime: e.header.ModTime.Unix()}
+		switch e.header.Typeflag {
+		case tar.TypeReg:
+			m.Type = EntryFile
+			m.Size = e.header.Size
+			m.Piped = e.pipe != nil
+		case tar.TypeDir:
+			m.Type = EntryDir
+		case tar.TypeSymlink:
+			m.Type = EntrySymlink
+		case tar.TypeFifo:
+			m.Type = EntryFifo
+		case tar.TypeChar, tar.TypeBlock:
+			m.Type = EntryDevice
+		}
+		manifest.Entries = append(manifest.Entries, m)
+	}
+	return manifest
+}
+
+func (m Manifest) TotalSize() int64 {
+	var size int64
+	for _, e := range m.Entries {
+		size += e.Size
+	}
+	return size
+}
+
+// Whether the total size is a lower bound, as piped content is only measured once received.
+func (m Manifest) HasPiped() bool {
+	return slices.ContainsFunc(m.Entries, func(e ManifestEntry) bool { return e.Piped })
+}
+
+func (m Manifest) Count(t EntryType) int {
+	count := 0
+	for _, e := range m.Entries {
+		if e.Type == t {
+			count++
+		}
+	}
+	return count
+}
+
+// Identifies the source content, used to match the journal of an interrupted transfer.
+func (m Manifest) id() string {
+	data, err := json.Marshal(Manifest{Entries: m.Entries}) // Independent of the offered streams.
+	errors.Unexpected(err, "Manifest.id: json.Marshal")
+	sum := blake2b.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Names of the top-level entries in order, usually a single file or directory.
+func (m Manifest) TopLevelNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, e := range m.Entries {
+		name, _, _ := strings.Cut(e.Name, "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Entries requested by the receiver, sent back to the sender after the manifest.
+type Selection struct {
+	All     bool             `json:",omitempty"`
+	Names   []string         `json:",omitempty"`
+	Offsets map[string]int64 `json:",omitempty"` // Offsets to resume partial files from.
+	// Copies of the receiver to skip if unchanged or send deltas against.
+	Signatures map[string]Signature `json:",omitempty"`
+	// Codecs supported by the receiver, the sender falls back to gzip if empty.
+	Codecs []Codec `json:",omitempty"`
+	// Parallel streams the receiver opens for the content of files, none if 0.
+	Streams int `json:",omitempty"`
+	// Metadata the sender adds to the entries.
+	Preserve Preserve `json:",omitzero"`
+	// Whether the receiver links hard-linked files and keeps the holes of sparse files,
+	// older versions receive full copies.
+	HardLinks bool `json:",omitempty"`
+	Sparse    bool `json:",omitempty"`
+}
+
+func (s Selection) nameSet() map[string]bool {
+	names := make(map[string]bool, len(s.Names))
+	for _, name := range s.Names {
+		names[name] = true
+	}
+	return names
+}
+
+// Selects the entries accepted by match along with their parent directories.
+func (m Manifest) Filter(match func(entry ManifestEntry) bool) Selection {
+	selected := make(map[string]bool)
+	for _, e := range m.Entries {
+		if !match(e) {
+			continue
+		}
+		for name := e.Name; name != "." && !selected[name]; name = path.Dir(name) {
+			selected[name] = true
+		}
+	}
+	if len(selected) == len(m.Entries) {
+		return Selection{All: true}
+	}
+	selection := Selection{Names: []string{}}
+	for _, e := range m.Entries {
+		if selected[e.Name] {
+			selection.Names = append(selection.Names, e.Name)
+		}
+	}
+	return selection
+}
+
+// The part of the manifest covered by the selection.
+func (m Manifest) Select(selection Selection) Manifest {
+	if selection.All {
+		return m
+	}
+	names := selection.nameSet()
+	selected := Manifest{Entries: []ManifestEntry{}}
+	for _, e := range m.Entries {
+		if names[e.Name] {
+			selected.Entries = append(selected.Entries, e)
+		}
+	}
+	return selected
+}
+
+// Writes the value as length-prefixed JSON.
+func writeJSON(w io.Writer, value any) error {
+	data, err := json.Marshal(value)
+	errors.Unexpected(err, "writeJSON: json.Marshal")
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readJSON(r io.Reader, value any) error {
+	size, err := binary.ReadUvarint(&byteReader{r})
+	if err != nil {
+		return err
+	}
+	if size > maxManifestSize {
+		return fmt.Errorf("too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+func writeManifest(w io.Writer, manifest Manifest) error {
+	if err := writeJSON(w, manifest); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
+
+func readManifest(r io.Reader) (Manifest, error) {
+	var manifest Manifest
+	if err := readJSON(r, &manifest); err != nil {
+		return manifest, fmt.Errorf("error reading manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func WriteSelection(w io.Writer, selection Selection) error {
+	if err := writeJSON(w, selection); err != nil {
+		return fmt.Errorf("error writing selection: %w", err)
+	}
+	return nil
+}
+
+func ReadSelection(r io.Reader) (Selection, error) {
+	var selection Selection
+	if err := readJSON(r, &selection); err != nil {
+		return selection, fmt.Errorf("error reading selection: %w", err)
+	}
+	return selection, nil
+}
+
+// Reads single bytes without buffering ahead, unlike bufio.Reader.
+type byteReader struct {
+	io.Reader
+}
+
+var _ io.ByteReader = &byteReader{}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	buffer := make([]byte, 1)
+	_, err := io.ReadFull(b.Reader, buffer)
+	return buffer[0], err
+}
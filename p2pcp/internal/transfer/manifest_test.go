@@ -0,0 +1,258 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"p2pcp/internal/filter"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	manifest := Manifest{Entries: []ManifestEntry{
+		{Name: "dir", Type: EntryDir},
+		{Name: "dir/a", Type: EntryFile, Size: 10},
+		{Name: "dir/sub", Type: EntryDir},
+		{Name: "dir/sub/b", Type: EntryFile, Size: 5},
+		{Name: "dir/link", Type: EntrySymlink},
+		{Name: "file", Type: EntryFile},
+	}}
+	assert.Equal(t, int64(15), manifest.TotalSize())
+	assert.Equal(t, 3, manifest.Count(EntryFile))
+	assert.Equal(t, 2, manifest.Count(EntryDir))
+	assert.Equal(t, 1, manifest.Count(EntrySymlink))
+	assert.Equal(t, []string{"dir", "file"}, manifest.TopLevelNames())
+
+	var buffer bytes.Buffer
+	require.NoError(t, writeManifest(&buffer, manifest))
+	buffer.WriteString("rest")
+	decoded, err := readManifest(&buffer)
+	require.NoError(t, err)
+	assert.Equal(t, manifest, decoded)
+	assert.Equal(t, "rest", buffer.String())
+}
+
+func TestInvalidManifest(t *testing.T) {
+	_, err := readManifest(bytes.NewReader(nil))
+	assert.Error(t, err)
+
+	_, err = readManifest(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}))
+	assert.ErrorContains(t, err, "too large")
+
+	_, err = readManifest(bytes.NewReader([]byte{2, '{'}))
+	assert.ErrorContains(t, err, "error reading manifest")
+
+	_, err = readManifest(bytes.NewReader([]byte{1, '{'}))
+	assert.ErrorContains(t, err, "invalid JSON")
+}
+
+func TestCollectEntriesManifest(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	entries, err := collectEntries(sendPath, WriteOptions{})
+	require.NoError(t, err)
+
+	manifest := newManifest(entries)
+	assert.Equal(t, []string{"transfer_dir_multiple_file"}, manifest.TopLevelNames())
+	assert.Equal(t, 1, manifest.Count(EntryDir))
+	assert.Equal(t, 3, manifest.Count(EntryFile))
+	var size int64
+	for _, name := range []string{".dot_file", "file1", "file2"} {
+		info, err := os.Stat(filepath.Join(sendPath, name))
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	assert.Equal(t, size, manifest.TotalSize())
+}
+
+func TestReadZipApproval(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "zip_approval")
+	workspace.ResetDir(targetPath)
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true}))
+
+	var approved Manifest
+	err := ReadZip(bytes.NewReader(buffer.Bytes()), targetPath, ReadOptions{
+		Approve: func(manifest Manifest) (Selection, error) {
+			approved = manifest
+			return Selection{}, ErrRejected
+		},
+	})
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, 3, approved.Count(EntryFile))
+	entries, err := os.ReadDir(targetPath)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing is written before approval")
+
+	err = ReadZip(bytes.NewReader(buffer.Bytes()), targetPath, ReadOptions{
+		Approve: func(manifest Manifest) (Selection, error) { return Selection{All: true}, nil },
+	})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(targetPath, "transfer_dir_multiple_file", "file1"))
+}
+
+func TestReadTarExceedingManifest(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "tar_exceeding_manifest")
+	workspace.ResetDir(targetPath)
+
+	var buffer bytes.Buffer
+	require.NoError(t, writeTar(&buffer, sendPath, WriteOptions{Quiet: true}))
+
+	// The manifest understates the size of the archive.
+	entries, err := collectEntries(sendPath, WriteOptions{})
+	require.NoError(t, err)
+	manifest := newManifest(entries)
+	manifest.Entries[len(manifest.Entries)-1].Size--
+	err = readTar(&buffer, targetPath, &manifest, nil, nil, ReadOptions{})
+	assert.ErrorContains(t, err, "archive exceeds the size announced in the manifest")
+}
+
+func TestManifestFilter(t *testing.T) {
+	manifest := Manifest{Entries: []ManifestEntry{
+		{Name: "dir", Type: EntryDir},
+		{Name: "dir/a.log", Type: EntryFile, Size: 10},
+		{Name: "dir/sub", Type: EntryDir},
+		{Name: "dir/sub/b.log", Type: EntryFile, Size: 5},
+		{Name: "dir/sub/c.txt", Type: EntryFile, Size: 1},
+		{Name: "dir/empty", Type: EntryDir},
+	}}
+
+	selection := manifest.Filter(func(e ManifestEntry) bool { return e.Name == "dir/sub/b.log" })
+	assert.Equal(t, Selection{Names: []string{"dir", "dir/sub", "dir/sub/b.log"}}, selection)
+	selected := manifest.Select(selection)
+	assert.Equal(t, int64(5), selected.TotalSize())
+	assert.Equal(t, 2, selected.Count(EntryDir))
+
+	selection = manifest.Filter(func(e ManifestEntry) bool { return true })
+	assert.Equal(t, Selection{All: true}, selection)
+	assert.Equal(t, manifest, manifest.Select(selection))
+
+	selection = manifest.Filter(func(e ManifestEntry) bool { return false })
+	assert.Empty(t, manifest.Select(selection).Entries)
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteSelection(&buffer, Selection{Names: []string{"dir"}}))
+	decoded, err := ReadSelection(&buffer)
+	require.NoError(t, err)
+	assert.Equal(t, Selection{Names: []string{"dir"}}, decoded)
+}
+
+func TestSelectiveReadWrite(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "zip_selective")
+	workspace.ResetDir(targetPath)
+
+	selections := make(chan Selection, 1)
+	reader, writer := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		defer writer.Close()
+		writeErr <- WriteZip(writer, []string{sendPath}, WriteOptions{Quiet: true, Select: func(manifest Manifest) (Selection, error) {
+			return <-selections, nil
+		}})
+	}()
+
+	err := ReadZip(reader, targetPath, ReadOptions{
+		Approve: func(manifest Manifest) (Selection, error) {
+			return manifest.Filter(func(e ManifestEntry) bool { return filepath.Base(e.Name) == "file2" }), nil
+		},
+		Request: func(selection Selection) error {
+			selections <- selection
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-writeErr)
+
+	entries, err := os.ReadDir(filepath.Join(targetPath, "transfer_dir_multiple_file"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "file2", entries[0].Name())
+}
+
+func TestReadTarUnexpectedEntry(t *testing.T) {
+	sendPath := filepath.Join(workspace.GetTestDataPath(), "transfer_dir_multiple_file")
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "tar_unexpected_entry")
+	workspace.ResetDir(targetPath)
+
+	var buffer bytes.Buffer
+	require.NoError(t, writeTar(&buffer, sendPath, WriteOptions{Quiet: true}))
+
+	// Only the directory was selected, the files are unexpected.
+	manifest := Manifest{Entries: []ManifestEntry{{Name: "transfer_dir_multiple_file", Type: EntryDir}}}
+	err := readTar(&buffer, targetPath, &manifest, nil, nil, ReadOptions{})
+	assert.ErrorContains(t, err, "entry not in the manifest: transfer_dir_multiple_file/")
+}
+
+func TestCollectEntriesFiltered(t *testing.T) {
+	basePath := filepath.Join(os.TempDir(), project.Name, "test", "collect_filtered", "repo")
+	workspace.ResetDir(basePath)
+	files := map[string]string{
+		".gitignore":                  "build/\n*.tmp\n",
+		".p2pcpignore":                "secret.txt\n",
+		".git/HEAD":                   "ref",
+		"build/out.bin":               "bin",
+		"node_modules/lib/index.js":   "js",
+		"src/main.go":                 "go",
+		"src/cache.tmp":               "tmp",
+		"src/.p2pcpignore":            "!keep.txt\nlocal.txt\n",
+		"src/local.txt":               "local",
+		"docs/readme.md":              "md",
+		"docs/secret.txt":             "secret",
+		"docs/images/diagram.png":     "png",
+		"docs/images/diagram.png.tmp": "tmp",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(basePath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o755))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0o644))
+	}
+
+	names := func(options WriteOptions) []string {
+		entries, err := collectEntries(basePath, options)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.header.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{
+		"repo", "repo/.git", "repo/.git/HEAD", "repo/.gitignore", "repo/.p2pcpignore",
+		"repo/build", "repo/build/out.bin",
+		"repo/docs", "repo/docs/images", "repo/docs/images/diagram.png", "repo/docs/images/diagram.png.tmp",
+		"repo/docs/readme.md",
+		"repo/node_modules", "repo/node_modules/lib", "repo/node_modules/lib/index.js",
+		"repo/src", "repo/src/.p2pcpignore", "repo/src/cache.tmp", "repo/src/main.go",
+	}, names(WriteOptions{}))
+
+	assert.Equal(t, []string{
+		"repo", "repo/.gitignore", "repo/.p2pcpignore",
+		"repo/docs", "repo/docs/images", "repo/docs/images/diagram.png",
+		"repo/docs/readme.md",
+		"repo/src", "repo/src/.p2pcpignore", "repo/src/main.go",
+	}, names(WriteOptions{
+		IgnoreFiles: []string{".gitignore"},
+		Filter:      filter.Filter{Exclude: []string{"node_modules"}},
+	}))
+
+	assert.Equal(t, []string{
+		"repo", "repo/docs", "repo/docs/images", "repo/docs/images/diagram.png", "repo/docs/readme.md",
+	}, names(WriteOptions{
+		IgnoreFiles: []string{".gitignore"},
+		Filter:      filter.Filter{Include: []string{"docs"}},
+	}))
+
+	assert.Equal(t, []string{"repo", "repo/src", "repo/src/main.go"}, names(WriteOptions{
+		Filter: filter.Filter{Include: []string{"*.go"}},
+	}))
+}
@@ -0,0 +1,170 @@
+package transfer
+
+import (
+	"archive/tar"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Prefix of the PAX records with the extended attributes of an entry.
+const xattrRecordPrefix = "SCHILY.xattr."
+
+var errUnsupported = fmt.Errorf("unsupported on this platform")
+
+// Extended attributes of POSIX ACLs on Linux.
+var aclXattrs = map[string]bool{"system.posix_acl_access": true, "system.posix_acl_default": true}
+
+// Namespaces of extended attributes never preserved, e.g. file capabilities.
+var ignoredXattrPrefixes = []string{"security.", "system.", "trusted."}
+
+// Metadata preserved on request of the receiver, modification and access times always are.
+type Preserve struct {
+	Owner        bool `json:",omitempty"` // User and group IDs, only applied when running as root.
+	Xattrs       bool `json:",omitempty"` // Extended attributes, except those of system namespaces.
+	ACLs         bool `json:",omitempty"` // POSIX ACLs.
+	SymlinkTimes bool `json:",omitempty"` // Times of symbolic links, not only of their targets.
+	Specials     bool `json:",omitempty"` // FIFOs and device nodes, the latter only created when running as root.
+}
+
+// Whether the extended attribute is preserved.
+func (p Preserve) includesXattr(name string) bool {
+	if aclXattrs[name] {
+		return p.ACLs
+	}
+	for _, prefix := range ignoredXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return p.Xattrs
+}
+
+// Adds the metadata requested by the receiver to the headers of the entries.
+func preserveMetadata(entries []entry, preserve Preserve) error {
+	if !preserve.Owner && !preserve.Xattrs && !preserve.ACLs {
+		return nil
+	}
+	for _, e := range entries {
+		if e.pipe != nil {
+			continue // Not a file of the sender.
+		}
+		if preserve.Owner {
+			info, err := os.Lstat(e.path)
+			if err != nil {
+				return fmt.Errorf("error reading owner of %s: %w", e.path, err)
+			}
+			if uid, gid, ok := fileOwner(info); ok {
+				e.header.Uid, e.header.Gid = uid, gid
+			}
+		}
+		if preserve.Xattrs || preserve.ACLs {
+			xattrs, err := readXattrs(e.path)
+			if err != nil {
+				return fmt.Errorf("error reading extended attributes of %s: %w", e.path, err)
+			}
+			for name, value := range xattrs {
+				if !preserve.includesXattr(name) {
+					continue
+				}
+				if e.header.PAXRecords == nil {
+					e.header.PAXRecords = make(map[string]string)
+				}
+				e.header.PAXRecords[xattrRecordPrefix+name] = value
+			}
+		}
+	}
+	return nil
+}
+
+// Restores the metadata of received entries, directories once their content is complete.
+type metadataRestorer struct {
+	preserve Preserve
+	dirs     []dirMetadata
+	warned   map[string]bool // Warnings logged once per transfer.
+}
+
+type dirMetadata struct {
+	header *tar.Header
+	path   string
+}
+
+func newMetadataRestorer(preserve Preserve) *metadataRestorer {
+	return &metadataRestorer{preserve: preserve, warned: make(map[string]bool)}
+}
+
+func (m *metadataRestorer) warnOnce(message string) {
+	if !m.warned[message] {
+		m.warned[message] = true
+		slog.Warn(message)
+	}
+}
+
+// Restores the metadata of the entry, after the content of a file is written.
+func (m *metadataRestorer) restore(header *tar.Header, path string) error {
+	if header.Typeflag == tar.TypeDir {
+		// Writing the content would change the times again.
+		m.dirs = append(m.dirs, dirMetadata{header: header, path: path})
+		return nil
+	}
+	return m.apply(header, path)
+}
+
+// Restores the metadata of the directories, the deepest first.
+func (m *metadataRestorer) restoreDirs() error {
+	for i := len(m.dirs) - 1; i >= 0; i-- {
+		if err := m.apply(m.dirs[i].header, m.dirs[i].path); err != nil {
+			return err
+		}
+	}
+	m.dirs = nil
+	return nil
+}
+
+func (m *metadataRestorer) apply(header *tar.Header, path string) error {
+	isSymlink := header.Typeflag == tar.TypeSymlink
+	if m.preserve.Owner {
+		if os.Geteuid() != 0 {
+			m.warnOnce("Ownership is only preserved when running as root.")
+		} else if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("error setting owner of %s: %w", path, err)
+		}
+	}
+	if (m.preserve.Xattrs || m.preserve.ACLs) && !isSymlink {
+		for key, value := range header.PAXRecords {
+			name, ok := strings.CutPrefix(key, xattrRecordPrefix)
+			if !ok || !m.preserve.includesXattr(name) {
+				continue
+			}
+			if err := writeXattr(path, name, value); err == errUnsupported {
+				m.warnOnce("Extended attributes aren't supported by the platform or file system.")
+				break
+			} else if err != nil {
+				return fmt.Errorf("error setting extended attribute %s of %s: %w", name, path, err)
+			}
+		}
+	}
+	if isSymlink {
+		if !m.preserve.SymlinkTimes {
+			return nil
+		}
+		if err := lchtimes(path, header.AccessTime, header.ModTime); err == errUnsupported {
+			m.warnOnce("Times of symbolic links aren't supported on this platform.")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error setting times of %s: %w", path, err)
+		}
+		return nil
+	}
+	return restoreTimes(header, path)
+}
+
+// Sets the times of the sender, so tools comparing them see unchanged files.
+// A zero access time of older senders is left unchanged.
+func restoreTimes(header *tar.Header, path string) error {
+	if err := os.Chtimes(path, header.AccessTime, header.ModTime); err != nil {
+		return fmt.Errorf("error setting modification time of %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+
+package transfer
+
+import (
+	"os"
+	"time"
+)
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattr(path string, name string, value string) error {
+	return errUnsupported
+}
+
+func lchtimes(path string, atime time.Time, mtime time.Time) error {
+	return errUnsupported
+}
+
+func accessTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
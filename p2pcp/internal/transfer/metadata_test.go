@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncludesXattr(t *testing.T) {
+	all := Preserve{Xattrs: true, ACLs: true}
+	assert.True(t, all.includesXattr("user.comment"))
+	assert.True(t, all.includesXattr("com.apple.metadata"))
+	assert.True(t, all.includesXattr("system.posix_acl_access"))
+	assert.False(t, all.includesXattr("security.capability"))
+	assert.False(t, all.includesXattr("trusted.overlay"))
+	assert.False(t, all.includesXattr("system.nfs4_acl"))
+
+	assert.False(t, Preserve{Xattrs: true}.includesXattr("system.posix_acl_default"))
+	assert.False(t, Preserve{ACLs: true}.includesXattr("user.comment"))
+}
+
+func TestPreserveTimes(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "preserve_times")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "dir")
+	workspace.ResetDir(filepath.Join(sendPath, "subdir"))
+	require.NoError(t, os.WriteFile(filepath.Join(sendPath, "subdir", "file"), []byte("file"), 0o644))
+	require.NoError(t, os.Symlink("subdir/file", filepath.Join(sendPath, "link")))
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	atime := time.Date(2021, 6, 7, 8, 9, 10, 987654321, time.UTC)
+	require.NoError(t, lchtimes(filepath.Join(sendPath, "link"), atime, mtime))
+
+	for _, symlinkTimes := range []bool{false, true} {
+		// Sending reads the files, which may update their access times.
+		for _, name := range []string{"subdir/file", "subdir", "."} {
+			require.NoError(t, os.Chtimes(filepath.Join(sendPath, name), atime, mtime))
+		}
+		targetPath := filepath.Join(testPath, "target")
+		workspace.ResetDir(targetPath)
+		_, err := transferZip(sendPath, targetPath, ReadOptions{Preserve: Preserve{SymlinkTimes: symlinkTimes}})
+		require.NoError(t, err)
+
+		for _, name := range []string{"subdir/file", "subdir", "."} {
+			info, err := os.Stat(filepath.Join(targetPath, "dir", name))
+			require.NoError(t, err)
+			assert.True(t, mtime.Equal(info.ModTime()), "%s: %v", name, info.ModTime())
+			assert.True(t, atime.Equal(accessTime(info)), "%s: %v", name, accessTime(info))
+		}
+		info, err := os.Lstat(filepath.Join(targetPath, "dir", "link"))
+		require.NoError(t, err)
+		assert.Equal(t, symlinkTimes, mtime.Equal(info.ModTime()))
+	}
+}
+
+func TestPreserveXattrs(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "preserve_xattrs")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "dir")
+	workspace.ResetDir(sendPath)
+	file := filepath.Join(sendPath, "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0o644))
+	if err := writeXattr(file, "user.p2pcp", "value\x00binary"); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+
+	for _, preserve := range []bool{false, true} {
+		targetPath := filepath.Join(testPath, "target")
+		workspace.ResetDir(targetPath)
+		_, err := transferZip(sendPath, targetPath, ReadOptions{Preserve: Preserve{Xattrs: preserve}})
+		require.NoError(t, err)
+
+		xattrs, err := readXattrs(filepath.Join(targetPath, "dir", "file"))
+		require.NoError(t, err)
+		if preserve {
+			assert.Equal(t, "value\x00binary", xattrs["user.p2pcp"])
+		} else {
+			assert.NotContains(t, xattrs, "user.p2pcp")
+		}
+	}
+}
+
+func TestPreserveOwner(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "preserve_owner")
+	workspace.ResetDir(testPath)
+	path := filepath.Join(testPath, "file")
+	require.NoError(t, os.WriteFile(path, []byte("file"), 0o644))
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		t.Skip("ownership not supported")
+	}
+
+	entries := []entry{{header: &tar.Header{Name: "file", Uid: -1, Gid: -1}, path: path}}
+	require.NoError(t, preserveMetadata(entries, Preserve{}))
+	assert.Equal(t, -1, entries[0].header.Uid)
+	require.NoError(t, preserveMetadata(entries, Preserve{Owner: true}))
+	assert.Equal(t, uid, entries[0].header.Uid)
+	assert.Equal(t, gid, entries[0].header.Gid)
+
+	// Only warns unless running as root.
+	header := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Uid: os.Geteuid(), Gid: os.Getegid()}
+	assert.NoError(t, newMetadataRestorer(Preserve{Owner: true}).restore(header, path))
+}
@@ -0,0 +1,70 @@
+//go:build linux || darwin
+
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// Reads the extended attributes of the path without following symbolic links.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:size])
+	}
+	return xattrs, nil
+}
+
+func writeXattr(path string, name string, value string) error {
+	err := unix.Lsetxattr(path, name, []byte(value), 0)
+	if err == unix.ENOTSUP {
+		return errUnsupported
+	}
+	return err
+}
+
+// Sets the times of a symbolic link itself, the access time falls back to the modification time if zero.
+func lchtimes(path string, atime time.Time, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
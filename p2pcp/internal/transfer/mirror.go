@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	Path "p2pcp/internal/path"
+	"path/filepath"
+)
+
+// Lists the entries under the received directories that the sender doesn't have.
+// The content of an extraneous directory isn't listed separately.
+func extraneousEntries(basePath string, manifest Manifest) ([]string, error) {
+	basePath = Path.GetAbsolutePath(basePath)
+	names := make(map[string]bool, len(manifest.Entries))
+	dirs := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		names[e.Name] = true
+		if e.Type == EntryDir {
+			dirs[e.Name] = true
+		}
+	}
+
+	var extraneous []string
+	for _, name := range manifest.TopLevelNames() {
+		if !dirs[name] {
+			continue // Single files have nothing to mirror.
+		}
+		root, err := entryPath(basePath, name)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Lstat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error walking path %s: %w", path, err)
+			}
+			relative, err := filepath.Rel(basePath, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(relative)
+			if names[name] {
+				return nil
+			}
+			extraneous = append(extraneous, name)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return extraneous, nil
+}
+
+// Deletes the entries of the base path that the sender doesn't have, or only reports them in a dry run.
+func mirror(basePath string, manifest Manifest, options ReadOptions) error {
+	extraneous, err := extraneousEntries(basePath, manifest)
+	if err != nil {
+		return err
+	}
+	for _, name := range extraneous {
+		path, err := entryPath(basePath, name)
+		if err != nil {
+			return err
+		}
+		if !options.DryRun {
+			// Symbolic links are removed, never followed.
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("error deleting %s: %w", path, err)
+			}
+		}
+		if options.Deleted != nil {
+			options.Deleted(name)
+		}
+	}
+	return nil
+}
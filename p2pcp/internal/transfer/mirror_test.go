@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A directory to send and an older copy of it with extraneous entries.
+func mirrorTree(testPath string) map[string]testEntry {
+	return map[string]testEntry{
+		"outside":                           {content: []byte("outside")},
+		"send/dir/file":                     {content: []byte("file")},
+		"send/dir/subdir/file":              {content: []byte("file")},
+		"target/dir/file":                   {content: []byte("old")},
+		"target/dir/stale":                  {content: []byte("stale")},
+		"target/dir/subdir/stale":           {content: []byte("stale")},
+		"target/dir/stale_dir/nested/stale": {content: []byte("stale")},
+		"target/dir/stale_link":             {link: filepath.Join(testPath, "outside")},
+		// Entries next to the received directory are left alone.
+		"target/other": {content: []byte("other")},
+	}
+}
+
+func TestMirror(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "mirror")
+	sendPath, targetPath := createTree(t, testPath, mirrorTree(testPath))
+
+	var deleted []string
+	_, err := transferZip(sendPath, targetPath, ReadOptions{
+		Mirror:  true,
+		Deleted: func(name string) { deleted = append(deleted, name) },
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dir/stale", "dir/stale_dir", "dir/stale_link", "dir/subdir/stale"}, deleted)
+
+	entries, err := os.ReadDir(filepath.Join(targetPath, "dir"))
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"file", "subdir"}, names)
+	assert.NoFileExists(t, filepath.Join(targetPath, "dir", "subdir", "stale"))
+	assert.FileExists(t, filepath.Join(targetPath, "dir", "subdir", "file"))
+	assert.FileExists(t, filepath.Join(testPath, "outside"))
+	assert.FileExists(t, filepath.Join(targetPath, "other"))
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "mirror_dry_run")
+	sendPath, targetPath := createTree(t, testPath, mirrorTree(testPath))
+
+	var deleted []string
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{
+		Mirror:  true,
+		DryRun:  true,
+		Deleted: func(name string) { deleted = append(deleted, name) },
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dir/stale", "dir/stale_dir", "dir/stale_link", "dir/subdir/stale"}, deleted)
+	assert.Empty(t, selection.Names)
+
+	// Nothing deleted or received.
+	assert.FileExists(t, filepath.Join(targetPath, "dir", "stale"))
+	assert.FileExists(t, filepath.Join(targetPath, "dir", "stale_dir", "nested", "stale"))
+	assert.NoFileExists(t, filepath.Join(targetPath, "dir", "subdir", "file"))
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(content))
+}
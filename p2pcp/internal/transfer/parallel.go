@@ -0,0 +1,449 @@
+package transfer
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Upper bound of the parallel streams of a transfer, in addition to the main one.
+const MaxStreams = 16
+
+// Files are split into chunks of this size over the parallel streams.
+const chunkSize = 4 << 20
+
+// Upper bound of the name of a chunk's file, guards the receiver against huge allocations.
+const maxChunkNameSize = 64 << 10
+
+// PAX record of a file header, its content of this size is sent in chunks over the parallel streams.
+const parallelRecord = "P2PCP.parallel"
+
+func parallelHeader(header *tar.Header) *tar.Header {
+	parallel := *header
+	parallel.Size = 0
+	parallel.PAXRecords = maps.Clone(header.PAXRecords)
+	if parallel.PAXRecords == nil {
+		parallel.PAXRecords = make(map[string]string)
+	}
+	parallel.PAXRecords[parallelRecord] = strconv.FormatInt(header.Size, 10)
+	return &parallel
+}
+
+// Size of the file sent in chunks, 0 if its content follows the header.
+func parallelSize(header *tar.Header) (int64, error) {
+	value, ok := header.PAXRecords[parallelRecord]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 || header.Size != 0 {
+		return 0, fmt.Errorf("invalid parallel size for %s in archive", header.Name)
+	}
+	return size, nil
+}
+
+// Whether the entry is sent in chunks, files resumed, sent as delta or sparse keep to the main stream.
+func isParallel(e entry) bool {
+	return e.header.Typeflag == tar.TypeReg && e.header.Size > 0 && e.offset == 0 && e.signature == nil && !e.sparse
+}
+
+// Bytes of each file sent or received over the parallel streams.
+type chunkProgress struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	sizes map[string]int64
+	err   error
+	ended bool // All streams are closed.
+}
+
+func newChunkProgress() *chunkProgress {
+	p := &chunkProgress{sizes: make(map[string]int64)}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+func (p *chunkProgress) add(name string, n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sizes[name] += n
+	p.cond.Broadcast()
+}
+
+// Ends the transfer, the first error is kept.
+func (p *chunkProgress) end(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err == nil {
+		p.ended = true
+	} else if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+func (p *chunkProgress) failed() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+// Waits until size bytes of the file are done, reporting the progress along the way.
+func (p *chunkProgress) wait(name string, size int64, report func(n int64)) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		done := p.sizes[name]
+		report(min(done, size))
+		if done >= size {
+			return nil
+		} else if p.err != nil {
+			return p.err
+		} else if p.ended {
+			return fmt.Errorf("parallel streams ended before the content of %s", name)
+		}
+		p.cond.Wait()
+	}
+}
+
+// Reports the bytes of a file written through it to the progress.
+type progressWriter struct {
+	w        io.Writer
+	name     string
+	progress *chunkProgress
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	p.progress.add(p.name, int64(n))
+	return n, err
+}
+
+// A part of a file sent over one of the parallel streams.
+type chunk struct {
+	entry  entry
+	offset int64
+	size   int64
+}
+
+// Sends the content of files in chunks over the parallel streams, the next free stream takes the next chunk.
+type parallelWriter struct {
+	chunks   chan chunk
+	progress *chunkProgress
+	done     chan struct{} // Closed to stop queuing chunks.
+	stop     sync.Once
+	wg       sync.WaitGroup
+}
+
+// Queues the chunks of the entries in order and starts sending them.
+func startParallelWriter(streams []io.WriteCloser, entries []entry, compression Compression) *parallelWriter {
+	p := &parallelWriter{
+		chunks:   make(chan chunk, len(streams)),
+		progress: newChunkProgress(),
+		done:     make(chan struct{}),
+	}
+	go p.queue(entries)
+	for _, stream := range streams {
+		p.wg.Add(1)
+		go p.run(stream, compression)
+	}
+	return p
+}
+
+func (p *parallelWriter) queue(entries []entry) {
+	defer close(p.chunks)
+	for _, e := range entries {
+		if !isParallel(e) {
+			continue
+		}
+		for offset := int64(0); offset < e.header.Size; offset += chunkSize {
+			select {
+			case p.chunks <- chunk{entry: e, offset: offset, size: min(chunkSize, e.header.Size-offset)}:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// Sends the chunks taken from the queue, each stream compresses its own frames.
+func (p *parallelWriter) run(stream io.WriteCloser, compression Compression) {
+	defer p.wg.Done()
+	frames := newFrameWriter(stream, compression)
+	for c := range p.chunks {
+		if p.progress.failed() != nil {
+			continue // Drains the queue.
+		}
+		if err := p.writeChunk(frames, c); err != nil {
+			p.progress.end(err)
+		}
+	}
+	err := frames.Close()
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		p.progress.end(fmt.Errorf("error closing parallel stream: %w", err))
+	}
+}
+
+// Writes the name of the file, the offset and size of the chunk as uvarint, and its content.
+func (p *parallelWriter) writeChunk(frames *frameWriter, c chunk) error {
+	file, err := os.Open(c.entry.path)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", c.entry.path, err)
+	}
+	defer file.Close()
+
+	name := c.entry.header.Name
+	header := binary.AppendUvarint(nil, uint64(len(name)))
+	header = append(header, name...)
+	header = binary.AppendUvarint(header, uint64(c.offset))
+	header = binary.AppendUvarint(header, uint64(c.size))
+	if _, err := frames.Write(header); err != nil {
+		return fmt.Errorf("error writing chunk of %s: %w", name, err)
+	}
+	if err := frames.startFile(c.entry.path); err != nil {
+		return fmt.Errorf("error writing chunk of %s: %w", name, err)
+	}
+	writer := &progressWriter{w: frames, name: name, progress: p.progress}
+	if _, err := io.CopyN(writer, io.NewSectionReader(file, c.offset, c.size), c.size); err != nil {
+		return fmt.Errorf("error writing chunk of %s: %w", name, err)
+	}
+	return frames.endFile()
+}
+
+// Writes the header of a file sent in chunks and its hash once all chunks are sent.
+func (p *parallelWriter) writeFile(e entry, writer *tar.Writer, options WriteOptions) error {
+	if err := writeTarHeader(parallelHeader(e.header), writer); err != nil {
+		return err
+	}
+
+	// The chunks are read out of order, so the file is read once more for its hash.
+	hash := newHash()
+	file, err := os.Open(e.path)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", e.path, err)
+	}
+	defer file.Close()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("error reading file %s: %w", e.path, err)
+	}
+	if n != e.header.Size {
+		return fmt.Errorf("file %s changed during the transfer", e.path)
+	}
+
+	bar := newProgressBar(e.header.Size, e.header.Name, options.Quiet)
+	defer bar.Close()
+	if err := p.progress.wait(e.header.Name, e.header.Size, func(n int64) { bar.Set64(n) }); err != nil {
+		return err
+	}
+	return writeHash(writer, hash.Sum(nil))
+}
+
+// Stops sending chunks after an error of the main stream, the parallel streams are closed nonetheless.
+func (p *parallelWriter) abort(err error) {
+	p.progress.end(err)
+	p.stop.Do(func() { close(p.done) })
+}
+
+// Waits for the streams to send the remaining chunks.
+func (p *parallelWriter) close() error {
+	p.wg.Wait()
+	return p.progress.failed()
+}
+
+// Receives chunks over the parallel streams into staged files, moved into place once complete.
+type parallelReader struct {
+	dir      string // Staging directory in the base path.
+	sizes    map[string]int64
+	mutex    sync.Mutex
+	files    map[string]*os.File
+	staged   int         // Number of staged files, names the next one.
+	umask    os.FileMode // Cleared from the modes of the staged files.
+	progress *chunkProgress
+	wg       sync.WaitGroup
+}
+
+// Starts receiving the chunks of the files of the manifest.
+func startParallelReader(basePath string, manifest Manifest, streams []io.ReadCloser) (*parallelReader, error) {
+	dir, err := os.MkdirTemp(basePath, ".p2pcp-parallel-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	umask, err := readUmask(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	p := &parallelReader{
+		dir:      dir,
+		umask:    umask,
+		sizes:    make(map[string]int64),
+		files:    make(map[string]*os.File),
+		progress: newChunkProgress(),
+	}
+	for _, e := range manifest.Entries {
+		if e.Type == EntryFile {
+			p.sizes[e.Name] = e.Size
+		}
+	}
+	for _, stream := range streams {
+		p.wg.Add(1)
+		go p.run(stream)
+	}
+	go func() {
+		p.wg.Wait()
+		p.progress.end(nil)
+	}()
+	return p, nil
+}
+
+func (p *parallelReader) run(stream io.ReadCloser) {
+	defer p.wg.Done()
+	defer stream.Close()
+	frames := newFrameReader(stream)
+	defer frames.Close()
+	for {
+		err := p.readChunk(frames)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			p.progress.end(err)
+			return
+		}
+	}
+}
+
+// Reads a chunk written by parallelWriter.writeChunk, io.EOF if the stream ended before it.
+func (p *parallelReader) readChunk(r io.Reader) error {
+	reader := &byteReader{r}
+	nameSize, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return err
+	}
+	if nameSize > maxChunkNameSize {
+		return fmt.Errorf("invalid chunk name size %d", nameSize)
+	}
+	nameBuffer := make([]byte, nameSize)
+	if _, err := io.ReadFull(r, nameBuffer); err != nil {
+		return fmt.Errorf("error reading chunk: %w", unexpectedEOF(err))
+	}
+	name := string(nameBuffer)
+	offset, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return fmt.Errorf("error reading chunk of %s: %w", name, unexpectedEOF(err))
+	}
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return fmt.Errorf("error reading chunk of %s: %w", name, unexpectedEOF(err))
+	}
+	fileSize, ok := p.sizes[name]
+	if !ok {
+		return fmt.Errorf("chunk of a file not in the manifest: %s", name)
+	}
+	if size == 0 || offset > uint64(fileSize) || size > uint64(fileSize)-offset {
+		return fmt.Errorf("chunk exceeds the size of %s", name)
+	}
+
+	file, err := p.file(name)
+	if err != nil {
+		return err
+	}
+	writer := &progressWriter{w: io.NewOffsetWriter(file, int64(offset)), name: name, progress: p.progress}
+	if _, err := io.CopyN(writer, r, int64(size)); err != nil {
+		return fmt.Errorf("error writing chunk of %s: %w", name, unexpectedEOF(err))
+	}
+	return nil
+}
+
+// Returns the mode bits the umask clears from files created in the directory.
+// Staged files are created before their mode is known, and can't rely on it.
+func readUmask(dir string) (os.FileMode, error) {
+	path := filepath.Join(dir, "umask")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o777)
+	if err != nil {
+		return 0, fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	defer os.Remove(path)
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error reading file %s: %w", path, err)
+	}
+	return 0o777 &^ info.Mode().Perm(), nil
+}
+
+// Opens the staged file, shared by the streams writing its chunks.
+func (p *parallelReader) file(name string) (*os.File, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if file, ok := p.files[name]; ok {
+		return file, nil
+	}
+	file, err := os.OpenFile(filepath.Join(p.dir, strconv.Itoa(p.staged)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file for %s: %w", name, err)
+	}
+	p.staged++
+	p.files[name] = file
+	return file, nil
+}
+
+// Waits for all chunks of the file, returns the hash of its content and the staged file to rename into place.
+func (p *parallelReader) readFile(header *tar.Header, size int64, options ReadOptions) ([]byte, string, error) {
+	bar := newProgressBar(size, header.Name, options.Quiet)
+	defer bar.Close()
+	if err := p.progress.wait(header.Name, size, func(n int64) { bar.Set64(n) }); err != nil {
+		return nil, "", err
+	}
+
+	file, err := p.file(header.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	p.mutex.Lock()
+	delete(p.files, header.Name)
+	p.mutex.Unlock()
+	defer file.Close()
+
+	hash := newHash()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size)); err != nil {
+		return nil, "", fmt.Errorf("error reading file %s: %w", file.Name(), err)
+	}
+	if err := file.Chmod(header.FileInfo().Mode().Perm() &^ p.umask); err != nil {
+		return nil, "", fmt.Errorf("error creating file %s: %w", file.Name(), err)
+	}
+	if err := syncClose(file); err != nil {
+		return nil, "", fmt.Errorf("error creating file %s: %w", file.Name(), err)
+	}
+	return hash.Sum(nil), file.Name(), nil
+}
+
+// Waits for the streams to end and removes the staging directory.
+func (p *parallelReader) close() error {
+	p.wg.Wait()
+	err := p.progress.failed()
+	p.abort()
+	return err
+}
+
+// Removes the staging directory without waiting for the streams, their writes fail from now on.
+func (p *parallelReader) abort() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, file := range p.files {
+		file.Close()
+	}
+	clear(p.files)
+	if err := os.RemoveAll(p.dir); err != nil {
+		slog.Warn("Error removing staging directory.", "path", p.dir, "error", err)
+	}
+}
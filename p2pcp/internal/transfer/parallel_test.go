@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"strings"
+	"test/pkg/asserts"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelHeader(t *testing.T) {
+	header := parallelHeader(&tar.Header{Name: "file", Size: 10})
+	assert.Equal(t, int64(0), header.Size)
+	size, err := parallelSize(header)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+
+	size, err = parallelSize(&tar.Header{Name: "file", Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	for _, value := range []string{"0", "-1", "x"} {
+		_, err = parallelSize(&tar.Header{Name: "file", PAXRecords: map[string]string{parallelRecord: value}})
+		assert.ErrorContains(t, err, "invalid parallel size")
+	}
+}
+
+// Transfers the path through pipes with the given number of parallel streams,
+// returning the selection requested from the sender.
+func transferParallel(t *testing.T, sendPath string, targetPath string, streams int, options ReadOptions) (Selection, error) {
+	readers := make([]*io.PipeReader, streams)
+	writers := make([]*io.PipeWriter, streams)
+	for i := range streams {
+		readers[i], writers[i] = io.Pipe()
+	}
+	defer func() {
+		for i := range streams {
+			readers[i].Close()
+			writers[i].Close()
+		}
+	}()
+
+	selections := make(chan Selection, 1)
+	reader, writer := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		defer writer.Close()
+		writeErr <- WriteZip(writer, []string{sendPath}, WriteOptions{
+			Quiet:      true,
+			Streams:    streams,
+			OpenStream: func(index int) io.WriteCloser { return writers[index] },
+			Select: func(manifest Manifest) (Selection, error) {
+				return <-selections, nil
+			},
+		})
+	}()
+
+	var requested Selection
+	options.Request = func(selection Selection) error {
+		requested = selection
+		selections <- selection
+		return nil
+	}
+	options.OpenStream = func(index int) io.ReadCloser { return readers[index] }
+	err := ReadZip(reader, targetPath, options)
+	reader.Close()
+	if err == nil {
+		require.NoError(t, <-writeErr)
+	}
+	return requested, err
+}
+
+// A directory with large, small and empty files to send.
+func parallelTree() map[string]testEntry {
+	tree := map[string]testEntry{
+		"send/dir/random":        {content: randomContent(8, 2*chunkSize+1000), mode: 0o640},
+		"send/dir/text":          {content: []byte(strings.Repeat("compressible text ", chunkSize/10)), mode: 0o640},
+		"send/dir/empty":         {mode: 0o640},
+		"send/dir/link":          {link: "random"},
+		"send/dir/subdir":        {dir: true, mode: 0o700},
+		"send/dir/subdir/random": {content: randomContent(9, chunkSize), mode: 0o640},
+	}
+	for i := range 50 {
+		tree[fmt.Sprintf("send/dir/subdir/small%02d", i)] = testEntry{content: randomContent(uint64(i), i*100), mode: 0o640}
+	}
+	return tree
+}
+
+func TestParallelReadWrite(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "parallel")
+	sendPath, _ := createTree(t, testPath, parallelTree())
+
+	for _, streams := range []int{1, 2, 5} {
+		targetPath := filepath.Join(testPath, "target", fmt.Sprint(streams))
+		workspace.ResetDir(targetPath)
+		selection, err := transferParallel(t, sendPath, targetPath, streams, ReadOptions{})
+		require.NoError(t, err)
+		if streams == 1 {
+			assert.Zero(t, selection.Streams)
+		} else {
+			assert.Equal(t, streams, selection.Streams)
+		}
+		asserts.AssertDirsEqual(sendPath, filepath.Join(targetPath, "dir"))
+
+		// The staging directory is removed.
+		entries, err := os.ReadDir(targetPath)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	}
+}
+
+func TestParallelFileMode(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "parallel_mode")
+	sendPath, targetPath := createTree(t, testPath, map[string]testEntry{
+		"send/dir/random": {content: randomContent(10, chunkSize+1000), mode: 0o777},
+	})
+
+	// Staged files get the mode of the sender masked by the umask, like files of the main stream.
+	var modes []os.FileMode
+	for _, streams := range []int{1, 3} {
+		target := filepath.Join(targetPath, fmt.Sprint(streams))
+		workspace.ResetDir(target)
+		_, err := transferParallel(t, sendPath, target, streams, ReadOptions{})
+		require.NoError(t, err)
+		info, err := os.Stat(filepath.Join(target, "dir", "random"))
+		require.NoError(t, err)
+		modes = append(modes, info.Mode())
+	}
+	assert.Equal(t, modes[0], modes[1])
+}
+
+func TestParallelSync(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "parallel_sync")
+	sendPath, targetPath := createTree(t, testPath, parallelTree())
+	workspace.ResetDir(filepath.Join(targetPath, "dir"))
+	content := append([]byte("prefix"), randomContent(8, 2*chunkSize+1000)...)
+	require.NoError(t, os.WriteFile(filepath.Join(targetPath, "dir", "random"), content, 0o640))
+
+	// The delta of the existing file keeps to the main stream, the other files are sent in chunks.
+	selection, err := transferParallel(t, sendPath, targetPath, 3, ReadOptions{Sync: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, selection.Streams)
+	assert.Contains(t, selection.Signatures, "dir/random")
+	received, err := os.ReadFile(filepath.Join(targetPath, "dir", "random"))
+	require.NoError(t, err)
+	expected, err := os.ReadFile(filepath.Join(sendPath, "random"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, received))
+	received, err = os.ReadFile(filepath.Join(targetPath, "dir", "subdir", "random"))
+	require.NoError(t, err)
+	assert.Len(t, received, chunkSize)
+}
+
+func TestParallelStreamsEndedEarly(t *testing.T) {
+	basis := filepath.Join(os.TempDir(), project.Name, "test", "parallel_ended")
+	workspace.ResetDir(basis)
+	p, err := startParallelReader(basis, Manifest{Entries: []ManifestEntry{
+		{Name: "dir/random", Type: EntryFile, Size: 10},
+	}}, []io.ReadCloser{io.NopCloser(bytes.NewReader(nil))})
+	require.NoError(t, err)
+	_, _, err = p.readFile(&tar.Header{Name: "dir/random", Mode: 0o644}, 10, ReadOptions{})
+	assert.ErrorContains(t, err, "parallel streams ended before the content of dir/random")
+	require.NoError(t, p.close())
+	assert.NoDirExists(t, p.dir)
+}
+
+func TestInvalidChunks(t *testing.T) {
+	basis := filepath.Join(os.TempDir(), project.Name, "test", "parallel_invalid")
+	workspace.ResetDir(basis)
+	manifest := Manifest{Entries: []ManifestEntry{{Name: "file", Type: EntryFile, Size: 10}, {Name: "dir", Type: EntryDir}}}
+	tests := map[string][]byte{
+		"chunk of a file not in the manifest": append(append([]byte{3}, "dir"...), 0, 1),
+		"chunk exceeds the size of file":      append(append([]byte{4}, "file"...), 5, 6),
+		"unexpected EOF":                      append(append([]byte{4}, "file"...), 0, 10, 'x'),
+	}
+	for message, chunk := range tests {
+		t.Run(message, func(t *testing.T) {
+			var frames bytes.Buffer
+			writer := newFrameWriter(&frames, Compression{Codec: CodecNone})
+			_, err := writer.Write(chunk)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			p, err := startParallelReader(basis, manifest, []io.ReadCloser{io.NopCloser(&frames)})
+			require.NoError(t, err)
+			assert.ErrorContains(t, p.close(), message)
+		})
+	}
+}
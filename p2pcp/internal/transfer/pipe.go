@@ -0,0 +1,99 @@
+package transfer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// PAX record of a file whose size isn't known in advance, e.g. piped to the sender from stdin.
+// Its content follows in chunks, regular file headers of the same name ending with an empty one.
+const pipeRecord = "P2PCP.pipe"
+
+// Bytes read from a pipe before they are sent as a chunk.
+const pipeChunkSize = 1 << 20
+
+// Creates the entry of content piped to the sender, sent as a file of the name.
+func pipeEntry(name string, reader io.Reader) entry {
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       0o644,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{pipeRecord: "1"},
+	}
+	return entry{header: header, pipe: reader}
+}
+
+func isPiped(header *tar.Header) bool {
+	_, ok := header.PAXRecords[pipeRecord]
+	return ok
+}
+
+// Writes the piped content in chunks as it's read, followed by the hash of the whole content.
+func writePipe(e entry, writer *tar.Writer, options WriteOptions) error {
+	if err := writeTarHeader(e.header, writer); err != nil {
+		return err
+	}
+
+	bar := newProgressBar(-1, e.header.Name, options.Quiet)
+	defer bar.Close()
+
+	hash := newHash()
+	buffer := make([]byte, pipeChunkSize)
+	for {
+		n, err := io.ReadFull(e.pipe, buffer)
+		if n > 0 {
+			if err := writeTarHeader(&tar.Header{Typeflag: tar.TypeReg, Name: e.header.Name, Size: int64(n)}, writer); err != nil {
+				return err
+			}
+			if _, err := io.MultiWriter(writer, bar, hash).Write(buffer[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading %s: %w", e.header.Name, err)
+		}
+	}
+	if err := writeTarHeader(&tar.Header{Typeflag: tar.TypeReg, Name: e.header.Name}, writer); err != nil {
+		return err
+	}
+	return writeHash(writer, hash.Sum(nil))
+}
+
+// Writes the chunks of piped content to the temporary path and returns the hash of the content.
+func readPipe(header *tar.Header, reader *tar.Reader, temp string, options ReadOptions) ([]byte, error) {
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return nil, fmt.Errorf("error creating file %s: %w", temp, err)
+	}
+	defer file.Close()
+
+	bar := newProgressBar(-1, header.Name, options.Quiet)
+	defer bar.Close()
+
+	hash := newHash()
+	for {
+		chunk, err := reader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading next tar header: %w", err)
+		}
+		if chunk.Typeflag != tar.TypeReg || chunk.Name != header.Name {
+			return nil, fmt.Errorf("invalid chunk of %s in archive", header.Name)
+		}
+		if chunk.Size == 0 {
+			break
+		}
+		if _, err := io.Copy(io.MultiWriter(file, bar, hash), reader); err != nil {
+			return nil, fmt.Errorf("error writing file content for %s: %w", temp, err)
+		}
+	}
+	if err := syncClose(file); err != nil {
+		return nil, fmt.Errorf("error writing file content for %s: %w", temp, err)
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,66 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "pipe")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "file")
+	workspace.ResetDir(filepath.Dir(sendPath))
+	require.NoError(t, os.WriteFile(sendPath, []byte("file"), 0o644))
+	targetPath := filepath.Join(testPath, "target")
+	workspace.ResetDir(targetPath)
+
+	// Spans several chunks, the last one partial.
+	content := randomContent(15, 2*pipeChunkSize+100)
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{
+		Quiet:     true,
+		Stdin:     bytes.NewReader(content),
+		StdinName: "piped.bin",
+	}))
+	require.NoError(t, ReadZip(&buffer, targetPath, ReadOptions{
+		Approve: func(manifest Manifest) (Selection, error) {
+			require.Len(t, manifest.Entries, 2)
+			assert.Equal(t, ManifestEntry{Name: "piped.bin", Type: EntryFile, ModTime: manifest.Entries[1].ModTime, Piped: true}, manifest.Entries[1])
+			return Selection{All: true}, nil
+		},
+	}))
+	received, err := os.ReadFile(filepath.Join(targetPath, "piped.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, received))
+	received, err = os.ReadFile(filepath.Join(targetPath, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(received))
+}
+
+func TestEmptyPipe(t *testing.T) {
+	targetPath := filepath.Join(os.TempDir(), project.Name, "test", "empty_pipe")
+	workspace.ResetDir(targetPath)
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, nil, WriteOptions{Quiet: true, Stdin: bytes.NewReader(nil), StdinName: "stdin"}))
+	require.NoError(t, ReadZip(&buffer, targetPath, ReadOptions{}))
+	info, err := os.Stat(filepath.Join(targetPath, "stdin"))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestInvalidPipe(t *testing.T) {
+	for _, name := range []string{"", "..", "dir/file"} {
+		err := WriteZip(&bytes.Buffer{}, nil, WriteOptions{Quiet: true, Stdin: bytes.NewReader(nil), StdinName: name})
+		assert.ErrorContains(t, err, "invalid name for stdin")
+	}
+	err := WriteZip(&bytes.Buffer{}, nil, WriteOptions{Quiet: true, Stdin: bytes.NewReader(nil), StdinName: "stdin", Legacy: true})
+	assert.ErrorContains(t, err, "not supported by the receiver")
+}
@@ -2,4 +2,20 @@ package transfer
 
 import "github.com/libp2p/go-libp2p/core/protocol"
 
-const Protocol protocol.ID = "/p2pcp/transfer/1.0.0"
+// Compresses the stream in frames, with a codec negotiated with the receiver and chosen per file.
+const Protocol protocol.ID = "/p2pcp/transfer/1.5.0"
+
+// Gzips the whole stream, spoken by versions before negotiated compression.
+const LegacyProtocol protocol.ID = "/p2pcp/transfer/1.4.0"
+
+// Gzips a plain tar without manifest or hashes, spoken by the versions authenticating
+// with the hash of the secret. Its streams aren't bound to the session, so it's only
+// spoken with the peers of legacy sessions and is insecure.
+const InsecureProtocol protocol.ID = "/p2pcp/transfer/1.0.0"
+
+// Carries the selection of the receiver back to the sender.
+const SelectProtocol protocol.ID = "/p2pcp/select/1.0.0"
+
+// Carries chunks of files in parallel to the transfer stream, the receiver writes
+// the index of the stream after its tag.
+const ParallelProtocol protocol.ID = "/p2pcp/parallel/1.0.0"
@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []string{"B", "kB", "MB", "GB", "TB", "PB"}
+
+// Formats a byte count with decimal units, e.g. 1.5 MB.
+func FormatSize(size int64) string {
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(sizeUnits)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, sizeUnits[unit])
+}
+
+// Parses a byte count with an optional decimal or binary unit, e.g. 500M, 1.5GB or 2GiB.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	number := strings.TrimRightFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(s[len(number):]))
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	multiplier := float64(1)
+	if unit != "" && unit != "B" {
+		base := float64(1000)
+		if strings.HasSuffix(unit, "IB") {
+			base = 1024
+			unit = strings.TrimSuffix(unit, "IB")
+		} else {
+			unit = strings.TrimSuffix(unit, "B")
+		}
+		exponent := strings.Index("KMGTP", unit) + 1
+		if len(unit) != 1 || exponent == 0 {
+			return 0, fmt.Errorf("invalid size unit %q", s[len(number):])
+		}
+		for range exponent {
+			multiplier *= base
+		}
+	}
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,41 @@
+package transfer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", FormatSize(0))
+	assert.Equal(t, "999 B", FormatSize(999))
+	assert.Equal(t, "1.5 kB", FormatSize(1500))
+	assert.Equal(t, "2.0 GB", FormatSize(2_000_000_000))
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"10B", 10},
+		{"500M", 500_000_000},
+		{"500 MB", 500_000_000},
+		{"1.5GB", 1_500_000_000},
+		{"2GiB", 2 << 30},
+		{"1k", 1000},
+		{"1KiB", 1024},
+	}
+	for _, tt := range tests {
+		size, err := ParseSize(tt.input)
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, size, tt.input)
+	}
+
+	for _, input := range []string{"", "MB", "-1", "1XB", "1MiBB", "1.2.3"} {
+		_, err := ParseSize(input)
+		assert.Error(t, err, input)
+	}
+}
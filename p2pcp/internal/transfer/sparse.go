@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PAX records of a sparse file, with its size and the offsets and lengths of its data segments.
+// Only the data segments are in the archive, and covered by the hash of the file.
+const (
+	sparseSizeRecord = "P2PCP.sparse.size"
+	sparseMapRecord  = "P2PCP.sparse.map"
+)
+
+// Data of a sparse file, the ranges in between are holes.
+type segment struct {
+	Offset int64
+	Length int64
+}
+
+func sparseHeader(header *tar.Header, segments []segment) *tar.Header {
+	sparse := *header
+	sparse.Size = 0
+	values := make([]string, 0, 2*len(segments))
+	for _, s := range segments {
+		sparse.Size += s.Length
+		values = append(values, strconv.FormatInt(s.Offset, 10), strconv.FormatInt(s.Length, 10))
+	}
+	sparse.PAXRecords = maps.Clone(header.PAXRecords)
+	if sparse.PAXRecords == nil {
+		sparse.PAXRecords = make(map[string]string)
+	}
+	sparse.PAXRecords[sparseSizeRecord] = strconv.FormatInt(header.Size, 10)
+	sparse.PAXRecords[sparseMapRecord] = strings.Join(values, ",")
+	return &sparse
+}
+
+// Returns the size and data segments of a sparse header, or no segments for regular content.
+func sparseMap(header *tar.Header) (int64, []segment, error) {
+	value, ok := header.PAXRecords[sparseSizeRecord]
+	if !ok {
+		return 0, nil, nil
+	}
+	invalid := fmt.Errorf("invalid sparse map for %s in archive", header.Name)
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, nil, invalid
+	}
+	segments := []segment{}
+	var values []string
+	if value := header.PAXRecords[sparseMapRecord]; value != "" {
+		values = strings.Split(value, ",")
+	}
+	if len(values)%2 != 0 {
+		return 0, nil, invalid
+	}
+	var end, dataSize int64
+	for i := 0; i < len(values); i += 2 {
+		offset, err := strconv.ParseInt(values[i], 10, 64)
+		if err != nil {
+			return 0, nil, invalid
+		}
+		length, err := strconv.ParseInt(values[i+1], 10, 64)
+		if err != nil || offset < end || length <= 0 || length > size-offset {
+			return 0, nil, invalid
+		}
+		end = offset + length
+		dataSize += length
+		segments = append(segments, segment{Offset: offset, Length: length})
+	}
+	if dataSize != header.Size {
+		return 0, nil, invalid
+	}
+	return size, segments, nil
+}
+
+// Writes only the data segments of a sparse file if it has holes, otherwise leaves the file to be sent in full.
+func writeSparse(e entry, file *os.File, writer *tar.Writer, options WriteOptions) (bool, error) {
+	segments, err := dataSegments(file, e.header.Size)
+	if err != nil {
+		return false, fmt.Errorf("error reading file %s: %w", e.path, err)
+	}
+	if segments == nil || (len(segments) == 1 && segments[0].Length == e.header.Size) {
+		return false, nil
+	}
+
+	header := sparseHeader(e.header, segments)
+	if err := writeTarHeader(header, writer); err != nil {
+		return true, err
+	}
+
+	bar := newProgressBar(header.Size, header.Name, options.Quiet)
+	defer bar.Close()
+
+	hash := newHash()
+	for _, s := range segments {
+		if _, err := io.Copy(io.MultiWriter(writer, bar, hash), io.NewSectionReader(file, s.Offset, s.Length)); err != nil {
+			return true, fmt.Errorf("error reading file %s: %w", e.path, err)
+		}
+	}
+	return true, writeHash(writer, hash.Sum(nil))
+}
+
+// Writes the data segments to their offsets, leaving the ranges in between as holes.
+// The file is only extended to its size at the end, so a partial one can be resumed.
+func readSparse(header *tar.Header, reader io.Reader, path string, size int64, segments []segment, w io.Writer) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	for _, s := range segments {
+		if _, err := file.Seek(s.Offset, io.SeekStart); err != nil {
+			return fmt.Errorf("error writing file content for %s: %w", path, err)
+		}
+		if _, err := io.CopyN(io.MultiWriter(file, w), reader, s.Length); err != nil {
+			return fmt.Errorf("error writing file content for %s: %w", path, err)
+		}
+	}
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("error writing file content for %s: %w", path, err)
+	}
+	return syncClose(file)
+}
@@ -0,0 +1,94 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseHeader(t *testing.T) {
+	segments := []segment{{Offset: 10, Length: 5}, {Offset: 100, Length: 20}}
+	header := sparseHeader(&tar.Header{Name: "file", Size: 200}, segments)
+	assert.Equal(t, int64(25), header.Size)
+	size, parsed, err := sparseMap(header)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), size)
+	assert.Equal(t, segments, parsed)
+
+	// Only holes.
+	size, parsed, err = sparseMap(sparseHeader(&tar.Header{Name: "file", Size: 200}, nil))
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), size)
+	assert.Empty(t, parsed)
+	assert.NotNil(t, parsed)
+
+	_, parsed, err = sparseMap(&tar.Header{Name: "file", Size: 10})
+	require.NoError(t, err)
+	assert.Nil(t, parsed)
+
+	for _, records := range []map[string]string{
+		{sparseSizeRecord: "x"},
+		{sparseSizeRecord: "200", sparseMapRecord: "10"},
+		{sparseSizeRecord: "200", sparseMapRecord: "10,0"},
+		{sparseSizeRecord: "200", sparseMapRecord: "190,20"},
+		{sparseSizeRecord: "200", sparseMapRecord: "10,10,15,15"},
+		{sparseSizeRecord: "200", sparseMapRecord: "10,24"},
+	} {
+		_, _, err := sparseMap(&tar.Header{Name: "file", Size: 25, PAXRecords: records})
+		assert.ErrorContains(t, err, "invalid sparse map", records)
+	}
+}
+
+// Writes a file of the size with the data at the offsets and holes in between.
+func writeSparseFile(t *testing.T, path string, size int64, data map[int64][]byte) []byte {
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, file.Truncate(size))
+	content := make([]byte, size)
+	for offset, bytes := range data {
+		_, err := file.WriteAt(bytes, offset)
+		require.NoError(t, err)
+		copy(content[offset:], bytes)
+	}
+	return content
+}
+
+func TestSparseReadWrite(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "sparse")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "dir")
+	workspace.ResetDir(sendPath)
+	files := map[string][]byte{
+		"data":  writeSparseFile(t, filepath.Join(sendPath, "data"), 64<<20, map[int64][]byte{1 << 20: randomContent(10, 100_000), 32 << 20: randomContent(11, 5000)}),
+		"holes": writeSparseFile(t, filepath.Join(sendPath, "holes"), 16<<20, nil),
+		"tail":  writeSparseFile(t, filepath.Join(sendPath, "tail"), 8<<20, map[int64][]byte{8<<20 - 100: randomContent(12, 100)}),
+	}
+	info, err := os.Stat(filepath.Join(sendPath, "data"))
+	require.NoError(t, err)
+	if !isSparse(info) {
+		t.Skip("sparse files not supported by the file system")
+	}
+
+	targetPath := filepath.Join(testPath, "target")
+	workspace.ResetDir(targetPath)
+	selection, err := transferZip(sendPath, targetPath, ReadOptions{})
+	require.NoError(t, err)
+	assert.True(t, selection.Sparse)
+	for name, expected := range files {
+		path := filepath.Join(targetPath, "dir", name)
+		received, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, received), name)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.True(t, isSparse(info), name)
+	}
+}
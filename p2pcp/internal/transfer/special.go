@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+// Device and inode number of a file with several hard links.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+func isSpecial(typeflag byte) bool {
+	return typeflag == tar.TypeFifo || typeflag == tar.TypeChar || typeflag == tar.TypeBlock
+}
+
+// Turns the entries of files already in the list into hard links to the first one.
+func linkEntries(entries []entry) []entry {
+	first := make(map[inode]string)
+	for i, e := range entries {
+		if e.inode == (inode{}) {
+			continue
+		}
+		name, ok := first[e.inode]
+		if !ok {
+			first[e.inode] = e.header.Name
+			continue
+		}
+		link := *e.header
+		link.Typeflag = tar.TypeLink
+		link.Linkname = name
+		link.Size = 0
+		entries[i] = entry{header: &link, path: e.path}
+	}
+	return entries
+}
+
+// Removes a file, symbolic link or special file in the way of a received entry.
+func removeExisting(path string) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error overwriting %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Links the entry to a file received before, copying it if the file system has no hard links.
+func readHardLink(header *tar.Header, path string, received map[string]string) error {
+	target, ok := received[header.Linkname]
+	if !ok {
+		return fmt.Errorf("invalid hard link in archive: %s -> %s", header.Name, header.Linkname)
+	}
+	if err := removeExisting(path); err != nil {
+		return err
+	}
+	err := os.Link(target, path)
+	if err == nil {
+		return nil
+	}
+	slog.Debug("Copying instead of linking.", "file", header.Name, "error", err)
+	return copyFile(target, path)
+}
+
+func copyFile(source string, path string) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", source, err)
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", source, err)
+	}
+	writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	defer writer.Close()
+	if _, err := io.Copy(writer, reader); err != nil {
+		return fmt.Errorf("error writing file content for %s: %w", path, err)
+	}
+	return writer.Close()
+}
+
+// Creates the FIFO or device node, returns false if it's skipped.
+func readSpecial(header *tar.Header, path string, metadata *metadataRestorer) (bool, error) {
+	if header.Typeflag != tar.TypeFifo && os.Geteuid() != 0 {
+		metadata.warnOnce("Device nodes are only created when running as root.")
+		return false, nil
+	}
+	if err := removeExisting(path); err != nil {
+		return false, err
+	}
+	if err := createSpecial(header, path); err == errUnsupported {
+		metadata.warnOnce("Special files aren't supported on this platform.")
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error creating %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// Whether the file mode is of a special file that can be sent.
+func isSpecialMode(mode fs.FileMode) bool {
+	return mode&(fs.ModeNamedPipe|fs.ModeDevice) != 0
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+
+package transfer
+
+import (
+	"archive/tar"
+	"os"
+)
+
+func fileKey(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+func isSparse(info os.FileInfo) bool {
+	return false
+}
+
+func deviceNumbers(info os.FileInfo) (int64, int64) {
+	return 0, 0
+}
+
+func dataSegments(file *os.File, size int64) ([]segment, error) {
+	return nil, nil
+}
+
+func createSpecial(header *tar.Header, path string) error {
+	return errUnsupported
+}
@@ -0,0 +1,156 @@
+//go:build linux || darwin
+
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestLinkEntries(t *testing.T) {
+	linked := inode{dev: 1, ino: 2}
+	entries := linkEntries([]entry{
+		{header: &tar.Header{Name: "dir/a", Typeflag: tar.TypeReg, Size: 10}, inode: linked, sparse: true},
+		{header: &tar.Header{Name: "dir/b", Typeflag: tar.TypeReg, Size: 10}},
+		{header: &tar.Header{Name: "dir/c", Typeflag: tar.TypeReg, Size: 10}, inode: linked, sparse: true},
+	})
+	assert.Equal(t, byte(tar.TypeReg), entries[0].header.Typeflag)
+	assert.Equal(t, byte(tar.TypeReg), entries[1].header.Typeflag)
+	assert.Equal(t, byte(tar.TypeLink), entries[2].header.Typeflag)
+	assert.Equal(t, "dir/a", entries[2].header.Linkname)
+	assert.Zero(t, entries[2].header.Size)
+	assert.False(t, entries[2].sparse)
+}
+
+func TestHardLinks(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "hard_links")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "dir")
+	workspace.ResetDir(filepath.Join(sendPath, "sub"))
+	require.NoError(t, os.WriteFile(filepath.Join(sendPath, "a"), []byte("linked"), 0o644))
+	require.NoError(t, os.Link(filepath.Join(sendPath, "a"), filepath.Join(sendPath, "sub", "b")))
+	require.NoError(t, os.Link(filepath.Join(sendPath, "a"), filepath.Join(sendPath, "sub", "c")))
+	info, err := os.Lstat(filepath.Join(sendPath, "a"))
+	require.NoError(t, err)
+	if _, ok := fileKey(info); !ok {
+		t.Skip("hard links not supported")
+	}
+
+	for name, approve := range map[string]func(Manifest) (Selection, error){
+		"all": nil,
+		// The first selected link becomes the file.
+		"partial": func(Manifest) (Selection, error) {
+			return Selection{Names: []string{"dir", "dir/sub", "dir/sub/b", "dir/sub/c"}}, nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			targetPath := filepath.Join(testPath, "target", name)
+			workspace.ResetDir(targetPath)
+			_, err := transferZip(sendPath, targetPath, ReadOptions{Approve: approve})
+			require.NoError(t, err)
+
+			b, err := os.Stat(filepath.Join(targetPath, "dir", "sub", "b"))
+			require.NoError(t, err)
+			c, err := os.Stat(filepath.Join(targetPath, "dir", "sub", "c"))
+			require.NoError(t, err)
+			assert.True(t, os.SameFile(b, c))
+			content, err := os.ReadFile(filepath.Join(targetPath, "dir", "sub", "c"))
+			require.NoError(t, err)
+			assert.Equal(t, "linked", string(content))
+			if approve == nil {
+				a, err := os.Stat(filepath.Join(targetPath, "dir", "a"))
+				require.NoError(t, err)
+				assert.True(t, os.SameFile(a, b))
+			}
+		})
+	}
+}
+
+func TestInvalidHardLinks(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "invalid_hard_links")
+	workspace.ResetDir(testPath)
+	require.NoError(t, os.WriteFile(filepath.Join(testPath, "outside"), []byte("outside"), 0o644))
+	outputPath := filepath.Join(testPath, "output")
+
+	for _, linkname := range []string{"../outside", "/etc/passwd", "dir/missing", "dir"} {
+		t.Run(linkname, func(t *testing.T) {
+			workspace.ResetDir(outputPath)
+			var archive bytes.Buffer
+			writer := tar.NewWriter(&archive)
+			require.NoError(t, writer.WriteHeader(&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0o755}))
+			require.NoError(t, writer.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: linkname}))
+			require.NoError(t, writer.Close())
+
+			err := readTar(&archive, outputPath, nil, nil, nil, ReadOptions{})
+			assert.ErrorContains(t, err, "invalid hard link in archive: dir/link -> "+linkname)
+			assert.NoFileExists(t, filepath.Join(outputPath, "dir", "link"))
+		})
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "special_files")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send", "dir")
+	workspace.ResetDir(sendPath)
+	require.NoError(t, os.WriteFile(filepath.Join(sendPath, "file"), []byte("file"), 0o644))
+	if err := unix.Mkfifo(filepath.Join(sendPath, "fifo"), 0o640); err != nil {
+		t.Skipf("FIFOs not supported: %v", err)
+	}
+
+	for _, specials := range []bool{false, true} {
+		targetPath := filepath.Join(testPath, "target")
+		workspace.ResetDir(targetPath)
+		var manifest Manifest
+		_, err := transferZip(sendPath, targetPath, ReadOptions{
+			Preserve: Preserve{Specials: specials},
+			Approve: func(m Manifest) (Selection, error) {
+				manifest = m
+				return Selection{All: true}, nil
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 1, manifest.Count(EntryFifo))
+
+		info, err := os.Lstat(filepath.Join(targetPath, "dir", "fifo"))
+		if !specials {
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, fs.ModeNamedPipe|0o640, info.Mode())
+	}
+}
+
+func TestDeviceNodes(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "device_nodes")
+	workspace.ResetDir(testPath)
+	header := &tar.Header{Name: "null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}
+	path := filepath.Join(testPath, "null")
+
+	created, err := readSpecial(header, path, newMetadataRestorer(Preserve{Specials: true}))
+	require.NoError(t, err)
+	if os.Geteuid() != 0 {
+		// Only warns unless running as root.
+		assert.False(t, created)
+		assert.NoFileExists(t, path)
+		return
+	}
+	assert.True(t, created)
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice, info.Mode().Type())
+	major, minor := deviceNumbers(info)
+	assert.Equal(t, int64(1), major)
+	assert.Equal(t, int64(3), minor)
+}
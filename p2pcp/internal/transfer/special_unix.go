@@ -0,0 +1,76 @@
+//go:build linux || darwin
+
+package transfer
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Identifies the file of a regular entry with other hard links to it.
+func fileKey(info os.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || uint64(stat.Nlink) < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// Whether fewer blocks are allocated than the size of the file takes.
+func isSparse(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && stat.Blocks*512 < info.Size()
+}
+
+func deviceNumbers(info os.FileInfo) (int64, int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(stat.Rdev)
+	return int64(unix.Major(dev)), int64(unix.Minor(dev))
+}
+
+// Finds the data segments of the file, nil if the file system doesn't report holes.
+func dataSegments(file *os.File, size int64) ([]segment, error) {
+	segments := []segment{}
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // Only a hole up to the end.
+		} else if errors.Is(err, unix.EINVAL) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		hole, err := file.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			segments = append(segments, segment{Offset: data, Length: hole - data})
+		}
+		offset = hole
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return segments, err
+}
+
+func createSpecial(header *tar.Header, path string) error {
+	mode := uint32(header.Mode) & 0o7777
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		return unix.Mkfifo(path, mode)
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+	return unix.Mknod(path, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+}
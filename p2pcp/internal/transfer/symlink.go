@@ -0,0 +1,134 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	Path "p2pcp/internal/path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// How the sender handles symbolic links in a directory.
+type SymlinkPolicy string
+
+const (
+	SymlinksPreserve SymlinkPolicy = "preserve" // Send links within the path as relative links, skip the others.
+	SymlinksFollow   SymlinkPolicy = "follow"   // Send the content of the targets instead of the links.
+	SymlinksSkip     SymlinkPolicy = "skip"     // Send no links.
+	SymlinksError    SymlinkPolicy = "error"    // Send links within the path, fail on the others.
+)
+
+var SymlinkPolicies = []SymlinkPolicy{SymlinksPreserve, SymlinksFollow, SymlinksSkip, SymlinksError}
+
+func ParseSymlinkPolicy(value string) (SymlinkPolicy, error) {
+	policy := SymlinkPolicy(strings.ToLower(value))
+	if !slices.Contains(SymlinkPolicies, policy) {
+		return "", fmt.Errorf("unsupported policy %s", value)
+	}
+	return policy, nil
+}
+
+// A symbolic link that wasn't sent as a link.
+type SymlinkReport struct {
+	Name     string // Name of the entry in the archive.
+	Target   string // Target of the link as read from the file system.
+	Followed bool   // Sent as the content of its target, skipped otherwise.
+	Reason   string // Why the link was skipped.
+}
+
+// Reasons for skipping a symbolic link.
+const (
+	reasonOutside     = "target outside of the path"
+	reasonSkipped     = "symbolic links are skipped"
+	reasonBroken      = "target does not exist"
+	reasonLoop        = "target contains the link"
+	reasonUnsupported = "unsupported target file type"
+)
+
+// Returns the target of a symbolic link relative to its directory, empty if the link is skipped.
+func resolveSymlink(basePath string, path string, name string, options WriteOptions) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading symbolic link %s: %w", path, err)
+	}
+	if options.Symlinks == SymlinksSkip {
+		options.report(SymlinkReport{Name: name, Target: target, Reason: reasonSkipped})
+		return "", nil
+	}
+	destination := filepath.Clean(target)
+	if !filepath.IsAbs(destination) {
+		destination = filepath.Join(filepath.Dir(path), destination)
+	}
+	if !isInBasePath(basePath, destination) {
+		if options.Symlinks == SymlinksError {
+			return "", fmt.Errorf("symbolic link %s points outside of the path: %s", path, target)
+		}
+		options.report(SymlinkReport{Name: name, Target: target, Reason: reasonOutside})
+		return "", nil
+	}
+	return Path.GetRelativePath(filepath.Dir(path), destination), nil // All links become relative.
+}
+
+// Returns the path and file info of the target of a followed link, no file info if the link is skipped.
+// Directories already entered on the way to the link are skipped, they would never end.
+func followSymlink(path string, name string, ancestors []fs.FileInfo, options WriteOptions) (string, fs.FileInfo, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading symbolic link %s: %w", path, err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		options.report(SymlinkReport{Name: name, Target: target, Reason: reasonBroken})
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, fmt.Errorf("error reading symbolic link %s: %w", path, err)
+	}
+	info, err := os.Lstat(resolved)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading symbolic link %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() && !isSpecialMode(info.Mode()) {
+		options.report(SymlinkReport{Name: name, Target: target, Reason: reasonUnsupported})
+		return "", nil, nil
+	}
+	if info.IsDir() && slices.ContainsFunc(ancestors, func(a fs.FileInfo) bool { return os.SameFile(a, info) }) {
+		options.report(SymlinkReport{Name: name, Target: target, Reason: reasonLoop})
+		return "", nil, nil
+	}
+	options.report(SymlinkReport{Name: name, Target: target, Followed: true})
+	return resolved, info, nil
+}
+
+func (options WriteOptions) report(report SymlinkReport) {
+	if options.Symlinked != nil {
+		options.Symlinked(report)
+	}
+}
+
+// Walks the tree in lexical order like filepath.Walk, the callback returns the file info of the entry
+// it added, nil to leave it out. Directories are entered through followed links too.
+func walkTree(path string, info fs.FileInfo, ancestors []fs.FileInfo, fn func(path string, info fs.FileInfo, ancestors []fs.FileInfo) (fs.FileInfo, error)) error {
+	info, err := fn(path, info, ancestors)
+	if err != nil || info == nil || !info.IsDir() {
+		return err
+	}
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("error walking path %s: %w", path, err)
+	}
+	ancestors = append(ancestors, info)
+	for _, child := range children {
+		childPath := filepath.Join(path, child.Name())
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			return fmt.Errorf("error walking path %s: %w", childPath, err)
+		}
+		if err := walkTree(childPath, childInfo, ancestors, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	for _, policy := range SymlinkPolicies {
+		parsed, err := ParseSymlinkPolicy(string(policy))
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	parsed, err := ParseSymlinkPolicy("Follow")
+	require.NoError(t, err)
+	assert.Equal(t, SymlinksFollow, parsed)
+	_, err = ParseSymlinkPolicy("copy")
+	assert.ErrorContains(t, err, "unsupported policy copy")
+}
+
+// A directory with links to a file within it, a directory outside of it, a missing file and its own parent directory.
+func symlinkTree(testPath string) map[string]testEntry {
+	return map[string]testEntry{
+		"outside/file":      {content: []byte("outside")},
+		"send/dir/file":     {content: []byte("inside")},
+		"send/dir/inner":    {link: "file"},
+		"send/dir/outer":    {link: filepath.Join(testPath, "outside")},
+		"send/dir/broken":   {link: "missing"},
+		"send/dir/sub/loop": {link: ".."},
+	}
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "symlinks")
+	sendPath, _ := createTree(t, testPath, symlinkTree(testPath))
+
+	tests := []struct {
+		policy   SymlinkPolicy
+		links    []string // Entries sent as symbolic links.
+		files    []string // Other entries besides the directories.
+		followed []string
+		skipped  []string
+	}{
+		{SymlinksPreserve, []string{"dir/broken", "dir/inner", "dir/sub/loop"}, []string{"dir/file"}, nil, []string{"dir/outer"}},
+		{SymlinksSkip, nil, []string{"dir/file"}, nil, []string{"dir/broken", "dir/inner", "dir/outer", "dir/sub/loop"}},
+		{SymlinksFollow, nil, []string{"dir/file", "dir/inner", "dir/outer/file"}, []string{"dir/inner", "dir/outer"}, []string{"dir/broken", "dir/sub/loop"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			var followed, skipped []string
+			entries, err := collectEntries(sendPath, WriteOptions{
+				Symlinks: tt.policy,
+				Symlinked: func(report SymlinkReport) {
+					if report.Followed {
+						followed = append(followed, report.Name)
+					} else {
+						skipped = append(skipped, report.Name)
+					}
+				},
+			})
+			require.NoError(t, err)
+			var links, files []string
+			for _, e := range entries {
+				if e.header.Linkname != "" {
+					links = append(links, e.header.Name)
+				} else if !e.header.FileInfo().IsDir() {
+					files = append(files, e.header.Name)
+				}
+			}
+			assert.Equal(t, tt.links, links)
+			assert.Equal(t, tt.files, files)
+			assert.Equal(t, tt.followed, followed)
+			assert.Equal(t, tt.skipped, skipped)
+		})
+	}
+
+	t.Run(string(SymlinksError), func(t *testing.T) {
+		_, err := collectEntries(sendPath, WriteOptions{Symlinks: SymlinksError})
+		assert.ErrorContains(t, err, "points outside of the path")
+	})
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "follow_symlinks")
+	sendPath, targetPath := createTree(t, testPath, symlinkTree(testPath))
+	workspace.ResetDir(targetPath)
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true, Symlinks: SymlinksFollow}))
+	require.NoError(t, ReadZip(&buffer, targetPath, ReadOptions{}))
+	for name, expected := range map[string]string{"file": "inside", "inner": "inside", "outer/file": "outside"} {
+		info, err := os.Lstat(filepath.Join(targetPath, "dir", name))
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular(), name)
+		content, err := os.ReadFile(filepath.Join(targetPath, "dir", name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(content), name)
+	}
+	assert.NoFileExists(t, filepath.Join(targetPath, "dir", "broken"))
+	assert.NoDirExists(t, filepath.Join(targetPath, "dir", "sub", "loop"))
+}
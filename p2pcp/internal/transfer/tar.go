@@ -7,9 +7,12 @@ import (
 	"io/fs"
 	"log/slog"
 	"os"
-	"p2pcp/internal/errors"
+	"p2pcp/internal/filter"
 	Path "p2pcp/internal/path"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	progress "github.com/schollz/progressbar/v3"
 )
@@ -31,8 +34,27 @@ func isInBasePath(basePath, targetPath string) bool {
 	return basePath == path
 }
 
+// Resolves the path of an entry in the base path, rejecting entries outside of it.
+func entryPath(basePath string, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path in archive: %s", name)
+	}
+	path := filepath.Clean(filepath.Join(basePath, name))
+	if !isInBasePath(basePath, path) {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+	return path, nil
+}
+
 func readDir(header *tar.Header, path string) error {
 	fileInfo := header.FileInfo()
+	// A directory left by an interrupted transfer takes the mode of the sender, new ones get it masked by MkdirAll.
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		if err := os.Chmod(path, fileInfo.Mode().Perm()); err != nil {
+			return fmt.Errorf("error setting mode of directory %s: %w", path, err)
+		}
+		return nil
+	}
 	err := os.MkdirAll(path, fileInfo.Mode())
 	if err != nil {
 		return fmt.Errorf("error creating directory %s: %w", path, err)
@@ -40,46 +62,146 @@ func readDir(header *tar.Header, path string) error {
 	return nil
 }
 
-func readFile(header *tar.Header, reader io.Reader, path string) error {
+// Writes the file to the temporary path, to be renamed into place once its hash checks out,
+// and returns the hash of its content. Deltas apply to the copy at the path.
+func readFile(header *tar.Header, reader io.Reader, path string, temp string, options ReadOptions) ([]byte, error) {
 	fileInfo := header.FileInfo()
+	offset, err := resumeOffset(header)
+	if err != nil {
+		return nil, err
+	}
+	blockSize, err := deltaBlockSize(header)
+	if err != nil {
+		return nil, err
+	}
+
+	bar := newProgressBar(header.Size, header.Name, options.Quiet)
+	defer bar.Close()
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileInfo.Mode().Perm())
+	if blockSize > 0 {
+		hash := newHash()
+		if err := readDelta(header, io.TeeReader(reader, bar), path, temp, blockSize, hash); err != nil {
+			return nil, err
+		}
+		return hash.Sum(nil), nil
+	}
+	sparseSize, segments, err := sparseMap(header)
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", path, err)
+		return nil, err
+	}
+	if segments != nil {
+		hash := newHash()
+		if err := readSparse(header, reader, temp, sparseSize, segments, io.MultiWriter(bar, hash)); err != nil {
+			return nil, err
+		}
+		return hash.Sum(nil), nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR // Continues the partial file.
+	}
+	file, err := os.OpenFile(temp, flags, fileInfo.Mode().Perm())
+	if err != nil {
+		return nil, fmt.Errorf("error creating file %s: %w", temp, err)
 	}
 	defer file.Close()
 
-	bar := progress.DefaultBytes(header.Size, filepath.Base(header.Name))
-	defer bar.Close()
+	// The hash covers the whole file, including the part received before.
+	hash := newHash()
+	if offset > 0 {
+		if _, err := io.CopyN(hash, file, offset); err != nil {
+			return nil, fmt.Errorf("error resuming file %s: %w", temp, err)
+		}
+		if err := file.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("error resuming file %s: %w", temp, err)
+		}
+	}
 
-	_, err = io.Copy(io.MultiWriter(file, bar), reader)
+	_, err = io.Copy(io.MultiWriter(file, bar, hash), reader)
 	if err != nil {
-		return fmt.Errorf("error writing file content for %s: %w", path, err)
+		return nil, fmt.Errorf("error writing file content for %s: %w", temp, err)
+	}
+	if err := syncClose(file); err != nil {
+		return nil, fmt.Errorf("error writing file content for %s: %w", temp, err)
 	}
 
-	return nil
+	return hash.Sum(nil), nil
 }
 
-func readTar(r io.Reader, basePath string) error {
+// Reads the archive into the base path, checking it against the manifest
+// and recording the progress in the journal if not nil. The content of some files
+// is received over the parallel streams if not nil.
+func readTar(r io.Reader, basePath string, manifest *Manifest, journal *journal, parallel *parallelReader, options ReadOptions) error {
 	basePath = Path.GetAbsolutePath(basePath)
 
-	symlinks := make(map[string]string)
+	var remainingSize int64
+	names := make(map[string]bool)
+	if manifest != nil {
+		remainingSize = manifest.TotalSize()
+		for _, e := range manifest.Entries {
+			names[e.Name] = true
+		}
+	}
+
+	piped := make(map[string]bool)
+	if manifest != nil {
+		for _, e := range manifest.Entries {
+			piped[e.Name] = e.Piped
+		}
+	}
+
+	symlinks := make(map[string]*tar.Header)
+	received := make(map[string]string) // Paths of verified files, the targets hard links may have.
+	metadata := newMetadataRestorer(options.Preserve)
+	var pending *pendingHash
 	reader := tar.NewReader(r)
 	for {
 		header, err := reader.Next()
 		if err == io.EOF {
 			break // End of archive
 		} else if err != nil {
+			if pending != nil && journal == nil {
+				pending.discard()
+			}
 			return fmt.Errorf("error reading next tar header: %w", err)
 		}
 
+		// Each regular file is followed by its hash.
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			if pending == nil {
+				return fmt.Errorf("unexpected hash in archive")
+			}
+			if err := pending.verify(header); err != nil {
+				return err
+			}
+			if err := pending.commit(); err != nil {
+				return err
+			}
+			if err := journal.completed(pending.name); err != nil {
+				return err
+			}
+			received[pending.name] = pending.path
+			pending = nil
+			continue
+		}
+		if pending != nil {
+			pending.discard()
+			return fmt.Errorf("missing hash for %s in archive", pending.name)
+		}
+
+		if manifest != nil && !names[header.Name] {
+			return fmt.Errorf("entry not in the manifest: %s", header.Name)
+		}
+
 		// Validate path of entry.
-		if filepath.IsAbs(header.Name) {
-			return fmt.Errorf("absolute path in archive: %s", header.Name)
+		name := header.Name
+		if renamed, ok := options.renamed[name]; ok {
+			name = renamed
 		}
-		path := filepath.Clean(filepath.Join(basePath, header.Name))
-		if !isInBasePath(basePath, path) {
-			return fmt.Errorf("invalid path in archive: %s", header.Name)
+		path, err := entryPath(basePath, name)
+		if err != nil {
+			return err
 		}
 
 		// Handle symbolic links.
@@ -92,46 +214,128 @@ func readTar(r io.Reader, basePath string) error {
 			if !isInBasePath(basePath, targetPath) {
 				return fmt.Errorf("invalid symbolic link in archive: %s -> %s", header.Name, header.Linkname)
 			}
-			symlinks[path] = linkName
+			symlinks[path] = header
 			continue
 		}
 
 		// Handle directories.
 		if header.Typeflag == tar.TypeDir {
+			if err := removeExisting(path); err != nil {
+				return err
+			}
 			err = readDir(header, path)
 			if err != nil {
 				return err
 			}
+			if err := metadata.restore(header, path); err != nil {
+				return err
+			}
 			continue
 		}
 
 		// Handle regular files.
 		if header.Typeflag == tar.TypeReg {
-			err = readFile(header, reader, path)
+			size, err := parallelSize(header)
+			if err != nil {
+				return err
+			}
+			if size > 0 && parallel == nil {
+				return fmt.Errorf("unexpected parallel content for %s in archive", header.Name)
+			}
+			if manifest != nil {
+				remainingSize -= header.Size + size
+				if remainingSize < 0 {
+					return fmt.Errorf("archive exceeds the size announced in the manifest at %s", header.Name)
+				}
+			}
+			// Written to a temporary file, which replaces the path once the hash checks out.
+			pending = &pendingHash{name: header.Name, path: path, temp: partPath(path)}
+			if size > 0 {
+				// Staged until complete, so never partial in the base path.
+				pending.sum, pending.temp, err = parallel.readFile(header, size, options)
+			} else if isPiped(header) {
+				if manifest != nil && !piped[header.Name] {
+					return fmt.Errorf("unexpected piped content for %s in archive", header.Name)
+				}
+				pending.sum, err = readPipe(header, reader, pending.temp, options)
+			} else {
+				if err := journal.started(header.Name); err != nil {
+					return err
+				}
+				basis := path
+				if options.target != "" {
+					if basis, err = entryPath(options.target, name); err != nil {
+						return err
+					}
+				}
+				pending.sum, err = readFile(header, reader, basis, pending.temp, options)
+			}
+			if err != nil {
+				if journal == nil {
+					os.Remove(pending.temp) // Kept to be resumed otherwise.
+				}
+				return err
+			}
+			// Also keeps unchanged files from being sent again by the next sync.
+			if err := metadata.restore(header, pending.temp); err != nil {
+				return err
+			}
+			if options.Insecure {
+				// No hash follows to verify it against.
+				if err := pending.commit(); err != nil {
+					return err
+				}
+				received[pending.name] = pending.path
+				pending = nil
+			}
+			continue
+		}
+
+		// Handle hard links to files received before.
+		if header.Typeflag == tar.TypeLink {
+			if err := readHardLink(header, path, received); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Handle FIFOs and device nodes if requested.
+		if isSpecial(header.Typeflag) && options.Preserve.Specials {
+			created, err := readSpecial(header, path, metadata)
 			if err != nil {
 				return err
 			}
+			if created {
+				if err := metadata.restore(header, path); err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
 		return fmt.Errorf("unsupported file type for entry %s", header.Name)
 	}
+	if pending != nil {
+		pending.discard()
+		return fmt.Errorf("missing hash for %s in archive", pending.name)
+	}
 
 	// Create symbolic links
-	for linkPath, linkName := range symlinks {
-		if info, err := os.Lstat(linkPath); err == nil {
-			if !info.IsDir() || info.Mode()&fs.ModeSymlink == fs.ModeSymlink {
-				err = os.Remove(linkPath)
-				if err != nil {
-					return fmt.Errorf("error overwriting %s: %w", linkPath, err)
-				}
-			}
+	for linkPath, header := range symlinks {
+		linkName := filepath.Clean(header.Linkname)
+		if err := removeExisting(linkPath); err != nil {
+			return err
 		}
 		err := os.Symlink(linkName, linkPath)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("error creating symbolic link %s -> %s: %v", linkPath, linkName, err))
+		} else if err := metadata.restore(header, linkPath); err != nil {
+			return err
 		}
 	}
+	if err := metadata.restoreDirs(); err != nil {
+		return err
+	}
 
 	// Drain padding
 	buffer := make([]byte, 512)
@@ -147,6 +351,13 @@ func readTar(r io.Reader, basePath string) error {
 	return nil
 }
 
+func newProgressBar(size int64, name string, quiet bool) *progress.ProgressBar {
+	if quiet {
+		return progress.DefaultBytesSilent(size, filepath.Base(name))
+	}
+	return progress.DefaultBytes(size, filepath.Base(name))
+}
+
 func writeTarHeader(header *tar.Header, writer *tar.Writer) error {
 	if err := writer.WriteHeader(header); err != nil {
 		return fmt.Errorf("error writing tar header: %w", err)
@@ -154,93 +365,271 @@ func writeTarHeader(header *tar.Header, writer *tar.Writer) error {
 	return nil
 }
 
-func writeFile(header *tar.Header, writer *tar.Writer, path string) error {
-	if err := writeTarHeader(header, writer); err != nil {
-		return err
+func writeFile(e entry, writer *tar.Writer, options WriteOptions) error {
+	if e.pipe != nil {
+		return writePipe(e, writer, options)
 	}
-
-	file, err := os.Open(path)
+	file, err := os.Open(e.path)
 	if err != nil {
-		return fmt.Errorf("error opening file %s: %w", path, err)
+		return fmt.Errorf("error opening file %s: %w", e.path, err)
 	}
 	defer file.Close()
 
-	bar := progress.DefaultBytes(header.Size, filepath.Base(header.Name))
+	if e.signature != nil && len(e.signature.Blocks) > 0 && e.offset == 0 {
+		sent, err := writeDelta(e, file, writer, options)
+		if sent || err != nil {
+			return err
+		}
+	}
+
+	if e.sparse && e.offset == 0 {
+		sent, err := writeSparse(e, file, writer, options)
+		if sent || err != nil {
+			return err
+		}
+	}
+
+	// The hash covers the whole file, including the part the receiver already has.
+	hash := newHash()
+	header := e.header
+	if e.offset > 0 {
+		if _, err := io.CopyN(hash, file, e.offset); err != nil {
+			return fmt.Errorf("error reading file %s: %w", e.path, err)
+		}
+		header = resumeHeader(e.header, e.offset)
+	}
+	if err := writeTarHeader(header, writer); err != nil {
+		return err
+	}
+
+	bar := newProgressBar(header.Size, header.Name, options.Quiet)
 	defer bar.Close()
 
-	_, err = io.Copy(io.MultiWriter(writer, bar), file)
+	_, err = io.Copy(io.MultiWriter(writer, bar, hash), file)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if options.Insecure {
+		return nil // Not followed by hashes.
+	}
+	return writeHash(writer, hash.Sum(nil))
 }
 
-func writeTar(w io.Writer, basePath string) error {
+// Writes a delta against the receiver's copy of the file if it's smaller than the file,
+// otherwise rewinds the file to be sent in full.
+func writeDelta(e entry, file *os.File, writer *tar.Writer, options WriteOptions) (bool, error) {
+	hash := newHash()
+	d, err := computeDelta(file, *e.signature, hash)
+	if err != nil {
+		return false, fmt.Errorf("error reading file %s: %w", e.path, err)
+	}
+	size := d.size()
+	if size >= e.header.Size {
+		_, err := file.Seek(0, io.SeekStart)
+		return false, err
+	}
+	slog.Debug("Sending delta.", "file", e.header.Name, "size", size, "fileSize", e.header.Size)
+
+	header := deltaHeader(e.header, size, e.signature.BlockSize)
+	if err := writeTarHeader(header, writer); err != nil {
+		return true, err
+	}
+
+	bar := newProgressBar(header.Size, header.Name, options.Quiet)
+	defer bar.Close()
+
+	if err := d.write(io.MultiWriter(writer, bar), file); err != nil {
+		return true, fmt.Errorf("error reading file %s: %w", e.path, err)
+	}
+	return true, writeHash(writer, hash.Sum(nil))
+}
+
+// An entry of the archive and the path of its source.
+type entry struct {
+	header    *tar.Header
+	path      string
+	offset    int64      // Offset to resume a partial file of the receiver from.
+	signature *Signature // The receiver's copy of the file to send a delta against.
+	inode     inode      // Identifies the file if it has other hard links.
+	sparse    bool       // The file has holes, only its data is sent.
+	pipe      io.Reader  // Content of unknown size piped to the sender, sent in chunks.
+}
+
+// Collects the entries to send ahead of writing them, so a manifest can be sent first.
+func collectEntries(basePath string, options WriteOptions) ([]entry, error) {
 	basePath = Path.GetAbsolutePath(basePath)
 	rootInfo, err := os.Lstat(basePath)
+	if options.Symlinks == SymlinksFollow {
+		rootInfo, err = os.Stat(basePath)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	writer := tar.NewWriter(w)
 	if !rootInfo.IsDir() { // Single file
 		if !rootInfo.Mode().IsRegular() {
-			return fmt.Errorf("unsupported file type: %s", basePath)
+			return nil, fmt.Errorf("unsupported file type: %s", basePath)
 		}
-		header, err := tar.FileInfoHeader(getTarFileInfo(rootInfo), "")
-		errors.Unexpected(err, fmt.Sprintf("error getting file info header for %s", basePath))
+		header := fileInfoHeader(rootInfo, "")
 		header.Name = rootInfo.Name()
-		err = writeFile(header, writer, basePath)
-		if err != nil {
-			return err
+		return []entry{{header: header, path: basePath, sparse: isSparse(rootInfo)}}, nil
+	}
+
+	// Directory
+	var ignore filter.Ignore
+	ignoreFiles := append([]string{filter.IgnoreFileName}, options.IgnoreFiles...)
+	if slices.Contains(ignoreFiles, ".gitignore") {
+		ignore.Add("", ".git/") // Implicitly ignored by git as well.
+	}
+	var entries []entry
+	err = walkTree(basePath, rootInfo, nil, func(path string, info os.FileInfo, ancestors []os.FileInfo) (os.FileInfo, error) {
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&fs.ModeSymlink != fs.ModeSymlink && !isSpecialMode(info.Mode()) {
+			return nil, nil // Skip unsupported file types, e.g. sockets.
 		}
-	} else { // Directory
-		err = filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return fmt.Errorf("error walking path %s: %w", path, err)
-			}
 
-			link := ""
-			if info.Mode()&fs.ModeSymlink == fs.ModeSymlink { // Handle symbolic links
-				destination, err := os.Readlink(path)
-				if err != nil {
-					return fmt.Errorf("error reading symbolic link %s: %w", path, err)
-				}
-				destination = filepath.Clean(destination)
-				if !filepath.IsAbs(destination) {
-					destination = filepath.Join(filepath.Dir(path), destination)
+		// Skip ignored and excluded entries, the ignore files of a directory apply to its content.
+		// Followed links are matched as what they point to.
+		relative := filepath.ToSlash(Path.GetRelativePath(basePath, path))
+		isDir := info.IsDir()
+		if options.Symlinks == SymlinksFollow && info.Mode()&fs.ModeSymlink == fs.ModeSymlink {
+			target, err := os.Stat(path)
+			isDir = err == nil && target.IsDir()
+		}
+		if relative != "." && (ignore.IsIgnored(relative, isDir) || options.Filter.Excludes(relative)) {
+			return nil, nil
+		}
+
+		// Sets relative entry path to header, all paths are prefixed with the base directory name.
+		name := filepath.ToSlash(filepath.Join(rootInfo.Name(), Path.GetRelativePath(basePath, path)))
+
+		link, entryPath := "", path
+		if info.Mode()&fs.ModeSymlink == fs.ModeSymlink { // Handle symbolic links
+			var err error
+			if options.Symlinks == SymlinksFollow {
+				entryPath, info, err = followSymlink(path, name, ancestors, options)
+			} else {
+				link, err = resolveSymlink(basePath, path, name, options)
+				if link == "" {
+					info = nil
 				}
-				if !isInBasePath(basePath, destination) {
-					return nil // Skip symbolic links targeting outside of the base path.
+			}
+			if err != nil || info == nil {
+				return nil, err
+			}
+		}
+		if info.IsDir() {
+			for _, ignoreFile := range ignoreFiles {
+				if err := ignore.AddFile(relative, filepath.Join(path, ignoreFile)); err != nil {
+					return nil, err
 				}
-				link = Path.GetRelativePath(filepath.Dir(path), destination) // All links become relative.
 			}
-			header, err := tar.FileInfoHeader(getTarFileInfo(info), link)
-			errors.Unexpected(err, fmt.Sprintf("error getting file info header for %s", path))
+		}
 
-			// Sets relative entry path to header, all paths are prefixed with the base directory name.
-			name := Path.GetRelativePath(basePath, path)
-			name = filepath.Join(rootInfo.Name(), name)
-			name = filepath.ToSlash(name)
-			header.Name = name
+		header := fileInfoHeader(info, link)
+		header.Name = name
+		key, _ := fileKey(info)
+		entries = append(entries, entry{header: header, path: entryPath, inode: key, sparse: isSparse(info)})
+		return info, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Filter.Include) > 0 {
+		entries = keepIncluded(entries, options.Filter)
+	}
+	return entries, nil
+}
 
-			if info.Mode().IsRegular() {
-				return writeFile(header, writer, path)
-			} else if info.IsDir() || info.Mode()&fs.ModeSymlink == fs.ModeSymlink {
-				return writeTarHeader(header, writer)
-			} else {
-				return nil // Skip unsupported file types.
+// Collects the entries of all paths and the piped content, their top-level names must differ.
+func collectRoots(basePaths []string, options WriteOptions) ([]entry, error) {
+	var entries []entry
+	roots := make(map[string]bool)
+	addRoot := func(name string) error {
+		if roots[name] {
+			return fmt.Errorf("duplicate name %s, paths are sent under their base names", name)
+		}
+		roots[name] = true
+		return nil
+	}
+	for _, basePath := range basePaths {
+		root, err := collectEntries(basePath, options)
+		if err != nil {
+			return nil, err
+		}
+		if err := addRoot(root[0].header.Name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, root...)
+	}
+	if options.Stdin != nil {
+		if options.Legacy || options.Insecure {
+			return nil, fmt.Errorf("sending stdin is not supported by the receiver, it needs to be updated")
+		}
+		if name := options.StdinName; name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid name for stdin: %s", name)
+		}
+		if err := addRoot(options.StdinName); err != nil {
+			return nil, err
+		}
+		entries = append(entries, pipeEntry(options.StdinName, options.Stdin))
+	}
+	return entries, nil
+}
+
+// Keeps the entries matching an include pattern along with their parent directories.
+func keepIncluded(entries []entry, f filter.Filter) []entry {
+	kept := make(map[string]bool)
+	for _, e := range entries {
+		_, relative, found := strings.Cut(e.header.Name, "/")
+		if !found || !f.Includes(relative) {
+			continue
+		}
+		for name := e.header.Name; name != "." && !kept[name]; name = path.Dir(name) {
+			kept[name] = true
+		}
+	}
+	return slices.DeleteFunc(entries, func(e entry) bool {
+		isRoot := !strings.Contains(e.header.Name, "/")
+		return !isRoot && !kept[e.header.Name]
+	})
+}
+
+// Writes the entries, the content of some files is sent over the parallel streams if not nil.
+func writeEntries(w io.Writer, entries []entry, parallel *parallelWriter, options WriteOptions) error {
+	writer := tar.NewWriter(w)
+	frames, _ := w.(*frameWriter)
+	for _, e := range entries {
+		var err error
+		if parallel != nil && isParallel(e) {
+			err = parallel.writeFile(e, writer, options)
+		} else if e.header.Typeflag == tar.TypeReg {
+			err = frames.startFile(e.path)
+			if err == nil {
+				err = writeFile(e, writer, options)
 			}
-		})
+			if err == nil {
+				err = frames.endFile()
+			}
+		} else {
+			err = writeTarHeader(e.header, writer)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	if err = writer.Close(); err != nil {
+	if err := writer.Close(); err != nil {
 		return fmt.Errorf("error closing tar: %w", err)
 	}
 
 	return nil
 }
+
+func writeTar(w io.Writer, basePath string, options WriteOptions) error {
+	entries, err := collectEntries(basePath, options)
+	if err != nil {
+		return err
+	}
+	return writeEntries(w, entries, nil, options)
+}
@@ -1,8 +1,11 @@
 package transfer
 
 import (
+	"archive/tar"
+	"fmt"
 	"io/fs"
 	"os"
+	"p2pcp/internal/errors"
 )
 
 // Wraps os.FileInfo and drops unsupported attributes for tar transfer.
@@ -10,7 +13,7 @@ type tarFileInfo struct {
 	os.FileInfo
 }
 
-var allowedMode fs.FileMode = fs.ModeDir | fs.ModeSymlink | fs.ModePerm
+var allowedMode fs.FileMode = fs.ModeDir | fs.ModeSymlink | fs.ModeNamedPipe | fs.ModeDevice | fs.ModeCharDevice | fs.ModePerm
 
 func (t *tarFileInfo) Mode() fs.FileMode {
 	return t.FileInfo.Mode() & allowedMode
@@ -23,3 +26,15 @@ func (t *tarFileInfo) Sys() any {
 func getTarFileInfo(info os.FileInfo) os.FileInfo {
 	return &tarFileInfo{FileInfo: info}
 }
+
+// Header of the entry with its times in full precision.
+func fileInfoHeader(info os.FileInfo, link string) *tar.Header {
+	header, err := tar.FileInfoHeader(getTarFileInfo(info), link)
+	errors.Unexpected(err, fmt.Sprintf("error getting file info header for %s", info.Name()))
+	header.AccessTime = accessTime(info)
+	if info.Mode()&fs.ModeDevice != 0 {
+		header.Devmajor, header.Devminor = deviceNumbers(info)
+	}
+	header.Format = tar.FormatPAX // Other formats round the modification time and drop the access time.
+	return header
+}
@@ -46,7 +46,7 @@ func TestIsInBasePath(t *testing.T) {
 }
 
 type readFunc func(r io.Reader, basePath string) error
-type writeFunc func(w io.Writer, basePath string) error
+type writeFunc func(w io.Writer, basePath string, options WriteOptions) error
 
 func testReadWrite(t *testing.T, read readFunc, write writeFunc) {
 	testDataPath := workspace.GetTestDataPath()
@@ -114,7 +114,7 @@ func testReadWrite(t *testing.T, read readFunc, write writeFunc) {
 			go func() {
 				defer wg.Done()
 				defer pipeWriter.Close()
-				writeErr = write(pipeWriter, sendPath)
+				writeErr = write(pipeWriter, sendPath, WriteOptions{})
 			}()
 
 			wg.Wait()
@@ -140,7 +140,9 @@ func testReadWrite(t *testing.T, read readFunc, write writeFunc) {
  * and compare it with the expectedPath under testDir.
  */
 func TestTarReadWrite(t *testing.T) {
-	testReadWrite(t, readTar, writeTar)
+	testReadWrite(t, func(r io.Reader, basePath string) error {
+		return readTar(r, basePath, nil, nil, nil, ReadOptions{})
+	}, writeTar)
 }
 
 func TestInvalidTars(t *testing.T) {
@@ -177,7 +179,7 @@ func TestInvalidTars(t *testing.T) {
 		require.NoError(t, err)
 		defer reader.Close()
 
-		err = readTar(reader, outputPath)
+		err = readTar(reader, outputPath, nil, nil, nil, ReadOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, err.Error(), "absolute path in archive: /package.json")
 	}()
@@ -207,7 +209,7 @@ func TestInvalidTars(t *testing.T) {
 		require.NoError(t, err)
 		defer reader.Close()
 
-		err = readTar(reader, outputPath)
+		err = readTar(reader, outputPath, nil, nil, nil, ReadOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, err.Error(), "invalid path in archive: ../../package.json")
 	}()
@@ -240,7 +242,7 @@ func TestInvalidTars(t *testing.T) {
 		require.NoError(t, err)
 		defer reader.Close()
 
-		err = readTar(reader, outputPath)
+		err = readTar(reader, outputPath, nil, nil, nil, ReadOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, err.Error(), "absolute symbolic link in archive: abs_symlink -> /package.json")
 	}()
@@ -273,7 +275,7 @@ func TestInvalidTars(t *testing.T) {
 		require.NoError(t, err)
 		defer reader.Close()
 
-		err = readTar(reader, outputPath)
+		err = readTar(reader, outputPath, nil, nil, nil, ReadOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, err.Error(), "invalid symbolic link in archive: invalid_symlink -> ../../../package.json")
 	}()
@@ -302,7 +304,7 @@ func TestInvalidTars(t *testing.T) {
 		require.NoError(t, err)
 		defer reader.Close()
 
-		err = readTar(reader, filepath.Join(tempPath, "output"))
+		err = readTar(reader, filepath.Join(tempPath, "output"), nil, nil, nil, ReadOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, err.Error(), "unsupported file type for entry package.json")
 	}()
@@ -352,7 +354,7 @@ func TestTarOverwriteLinkWithoutPermission(t *testing.T) {
 	require.NoError(t, err)
 	defer reader.Close()
 
-	err = readTar(reader, filepath.Join(tempPath, "output"))
+	err = readTar(reader, filepath.Join(tempPath, "output"), nil, nil, nil, ReadOptions{})
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "error overwriting")
 	assert.Contains(t, err.Error(), filepath.Join(outputPath, "link"))
@@ -379,7 +381,7 @@ func TestTarReadFileWithoutPermission(t *testing.T) {
 	require.NoError(t, err)
 	defer tarFile.Close()
 
-	err = writeTar(tarFile, inputPath)
+	err = writeTar(tarFile, inputPath, WriteOptions{})
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "error opening file")
 	assert.Contains(t, err.Error(), filePath)
@@ -402,7 +404,7 @@ func TestTarReadDirWithoutPermission(t *testing.T) {
 	require.NoError(t, err)
 	defer tarFile.Close()
 
-	err = writeTar(tarFile, inputPath)
+	err = writeTar(tarFile, inputPath, WriteOptions{})
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "error walking path")
 	assert.Contains(t, err.Error(), dirPath)
@@ -423,7 +425,7 @@ func TestTarReadNonExistDir(t *testing.T) {
 	require.NoError(t, err)
 	defer tarFile.Close()
 
-	err = writeTar(tarFile, dirPath)
+	err = writeTar(tarFile, dirPath, WriteOptions{})
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "no such file or directory")
 	assert.Contains(t, err.Error(), inputPath)
@@ -446,7 +448,7 @@ func TestTarWriteFileError(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		err = writeTar(writer, inputPath)
+		err = writeTar(writer, inputPath, WriteOptions{})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "error writing tar header")
 		done <- struct{}{}
@@ -475,7 +477,7 @@ func TestTarWriteDirError(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		err := writeTar(writer, inputPath)
+		err := writeTar(writer, inputPath, WriteOptions{})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "error writing tar header")
 		done <- struct{}{}
@@ -501,7 +503,7 @@ func TestTarWriteCloseError(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		err := writeTar(writer, inputPath)
+		err := writeTar(writer, inputPath, WriteOptions{})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "error closing tar")
 		done <- struct{}{}
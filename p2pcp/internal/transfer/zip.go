@@ -1,23 +1,333 @@
 package transfer
 
 import (
+	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"log/slog"
+	"p2pcp/internal/filter"
 )
 
-func ReadZip(r io.Reader, basePath string) error {
+var ErrRejected = fmt.Errorf("transfer rejected")
+
+type ReadOptions struct {
+	// Called with the manifest before anything is written, returns the entries to receive.
+	// An error aborts the transfer, all entries are received if nil.
+	Approve func(manifest Manifest) (Selection, error)
+	// Called with the final selection, e.g. to request it from the sender.
+	Request func(selection Selection) error
+	Resume  bool // Keep a journal in the base path to resume an interrupted transfer.
+	Sync    bool // Send signatures of the files in the base path to receive only the changes.
+	Legacy  bool // The whole stream is gzipped by a sender of an older version.
+	Mirror  bool // Delete the entries of the received directories that the sender doesn't have.
+	DryRun  bool // Only report the entries Mirror would delete, and receive nothing.
+	// Called with each entry deleted by Mirror, or that would be in a dry run.
+	Deleted func(name string)
+	// Opens the parallel stream of the index, accepted if set and offered by the sender.
+	OpenStream func(index int) io.ReadCloser
+	Preserve   Preserve       // Metadata restored in addition to permissions and times.
+	OnConflict ConflictPolicy // How existing entries in the way are handled, overwritten if empty.
+	Atomic     bool           // Stage the whole tree next to the entries and move it into place once complete, not with Resume.
+	// Called with each conflict for the ask policy, returns how to resolve it.
+	Ask func(conflict Conflict) (ConflictPolicy, error)
+	// Called with each resolved conflict, e.g. to summarize the skipped and renamed entries.
+	Conflicted func(conflict Conflict)
+	Quiet      bool // Hide progress bars.
+	Insecure   bool // A gzipped tar of the insecure protocol, nothing is approved, requested or verified.
+
+	renamed map[string]string // Names the entries are received under by the conflict policy.
+	target  string            // Base path the staged tree is moved to, where deltas find their basis.
+}
+
+func ReadZip(r io.Reader, basePath string, options ReadOptions) error {
+	if options.Insecure {
+		return readInsecure(r, basePath, options)
+	}
+	var reader io.ReadCloser = newFrameReader(r)
+	if options.Legacy {
+		var err error
+		reader, err = gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+	}
+	defer reader.Close()
+
+	manifest, err := readManifest(reader)
+	if err != nil {
+		return err
+	}
+	selection := Selection{All: true}
+	if options.Approve != nil {
+		selection, err = options.Approve(manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.DryRun {
+		if err := mirror(basePath, manifest, options); err != nil {
+			return err
+		}
+		selection = Selection{Names: []string{}}
+	}
+
+	var j *journal
+	if options.Resume && !options.DryRun {
+		j, err = openJournal(basePath, manifest)
+		if err != nil {
+			return err
+		}
+		selection = j.resume(basePath, manifest, selection)
+		if len(j.done) > 0 || j.partial != "" {
+			slog.Info("Resuming transfer.", "completed", len(j.done), "partial", j.partial)
+		}
+	}
+	if !options.DryRun {
+		selection, options.renamed, err = resolveConflicts(basePath, manifest, selection, j, options)
+		if err != nil {
+			if j != nil {
+				j.close()
+			}
+			return err
+		}
+	}
+	if options.Sync && !options.DryRun {
+		selection.Signatures, err = computeSignatures(basePath, manifest.Select(selection), selection.Offsets)
+		if err != nil {
+			if j != nil {
+				j.close()
+			}
+			return err
+		}
+		for name := range options.renamed {
+			delete(selection.Signatures, name) // Nothing to send a delta against under the new name.
+		}
+		slog.Debug("Computed signatures of existing files.", "count", len(selection.Signatures))
+	}
+	selection.Preserve = options.Preserve
+	selection.HardLinks, selection.Sparse = true, true
+	if !options.Legacy {
+		selection.Codecs = SupportedCodecs
+		if manifest.Streams > 1 && options.OpenStream != nil && !options.DryRun {
+			selection.Streams = min(manifest.Streams, MaxStreams)
+		}
+	}
+	if options.Request != nil {
+		if err := options.Request(selection); err != nil {
+			if j != nil {
+				j.close()
+			}
+			return err
+		}
+	}
+
+	selected := manifest.Select(selection)
+	receivePath := basePath
+	if options.Atomic && !options.DryRun {
+		receivePath, err = startStaging(basePath)
+		if err != nil {
+			if j != nil {
+				j.close()
+			}
+			return err
+		}
+		options.target = basePath
+		slog.Debug("Staging the transfer.", "path", receivePath)
+	}
+	var parallel *parallelReader
+	if selection.Streams > 0 {
+		streams := make([]io.ReadCloser, selection.Streams)
+		for i := range streams {
+			streams[i] = options.OpenStream(i)
+		}
+		parallel, err = startParallelReader(receivePath, selected, streams)
+		if err != nil {
+			if options.target != "" {
+				abortStaging(receivePath)
+			}
+			if j != nil {
+				j.close()
+			}
+			return err
+		}
+		slog.Debug("Receiving over parallel streams.", "streams", len(streams))
+	}
+	err = readTar(reader, receivePath, &selected, j, parallel, options)
+	if parallel != nil {
+		if err == nil {
+			err = parallel.close()
+		} else {
+			parallel.abort()
+		}
+	}
+	if options.target != "" {
+		// Nothing in the base path changes unless the whole transfer succeeded.
+		if err == nil {
+			err = commitStaging(receivePath, basePath)
+		}
+		if err != nil {
+			abortStaging(receivePath)
+		}
+	}
+	if j != nil {
+		if err == nil {
+			err = j.remove()
+		} else {
+			j.close()
+		}
+	}
+	// Deletes only after a complete transfer, against all entries of the sender.
+	if err == nil && options.Mirror && !options.DryRun {
+		err = mirror(basePath, manifest, options)
+	}
+	return err
+}
+
+// Reads the gzipped tar of a sender of the insecure protocol, the content of files
+// is written as it arrives with nothing to verify it against.
+func readInsecure(r io.Reader, basePath string, options ReadOptions) error {
 	reader, err := gzip.NewReader(r)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
+	return readTar(reader, basePath, nil, nil, nil, options)
+}
+
+type WriteOptions struct {
+	Quiet       bool          // Hide progress bars, e.g. when sending to several receivers at once.
+	Filter      filter.Filter // Only send the matching entries of a directory.
+	IgnoreFiles []string      // Names of ignore files honored in addition to .p2pcpignore, e.g. .gitignore.
+	Compression Compression   // Preferred compression, negotiated with the receiver.
+	Legacy      bool          // Gzip the whole stream for receivers of older versions, ignoring Compression.
+	Insecure    bool          // Write a gzipped tar of the insecure protocol, ignoring Compression, Streams and Select.
+	Streams     int           // Parallel streams offered to the receiver for the content of files.
+	Symlinks    SymlinkPolicy // How symbolic links in a directory are sent, preserved if empty.
+	Stdin       io.Reader     // Content of unknown size sent as a file named StdinName after the paths, if set.
+	StdinName   string
+	// Called with each symbolic link skipped or followed instead of sent as a link.
+	Symlinked func(report SymlinkReport)
+	// Opens the parallel stream of the index, used if Streams is above 1.
+	OpenStream func(index int) io.WriteCloser
+	// Called after the manifest is sent, returns the entries requested by the receiver.
+	// All entries are sent if nil.
+	Select func(manifest Manifest) (Selection, error)
+}
 
-	return readTar(reader, basePath)
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
 }
 
-func WriteZip(w io.Writer, basePath string) error {
+// Writes the paths into a single archive under their base names.
+func WriteZip(w io.Writer, basePaths []string, options WriteOptions) error {
+	if options.Insecure {
+		return writeInsecure(w, basePaths, options)
+	}
+	// The manifest is gzipped, the codec of the receiver is only known from its selection.
+	var writer flushWriter = newFrameWriter(w, Compression{Codec: CodecGzip})
+	if options.Legacy {
+		writer = gzip.NewWriter(w)
+	}
+
+	entries, err := collectRoots(basePaths, options)
+	if err != nil {
+		return err
+	}
+	manifest := newManifest(entries)
+	if options.Streams > 1 && options.OpenStream != nil && !options.Legacy {
+		manifest.Streams = min(options.Streams, MaxStreams)
+	}
+	if err := writeManifest(writer, manifest); err != nil {
+		return err
+	}
+
+	selection := Selection{All: true, Codecs: SupportedCodecs, HardLinks: true, Sparse: true}
+	if options.Select != nil {
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("error writing manifest: %w", err)
+		}
+		selection, err = options.Select(manifest)
+		if err != nil {
+			return err
+		}
+	}
+	entries = selectEntries(entries, selection)
+	slog.Debug("Entries selected by receiver.", "selected", len(entries), "total", len(manifest.Entries))
+	if err := preserveMetadata(entries, selection.Preserve); err != nil {
+		return err
+	}
+	var parallel *parallelWriter
+	if frames, ok := writer.(*frameWriter); ok {
+		compression := options.Compression.negotiate(selection.Codecs)
+		slog.Debug("Compression negotiated.", "compression", compression, "receiver", selection.Codecs)
+		if err := frames.setCompression(compression); err != nil {
+			return fmt.Errorf("error writing manifest: %w", err)
+		}
+
+		if count := min(selection.Streams, manifest.Streams); count > 1 {
+			streams := make([]io.WriteCloser, count)
+			for i := range streams {
+				streams[i] = options.OpenStream(i)
+			}
+			parallel = startParallelWriter(streams, entries, compression)
+			slog.Debug("Sending over parallel streams.", "streams", count)
+		}
+	}
+
+	err = writeEntries(writer, entries, parallel, options)
+	if parallel != nil {
+		if err == nil {
+			err = parallel.close()
+		} else {
+			parallel.abort(err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Writes the gzipped tar of the insecure protocol, which only has directories,
+// regular files and symbolic links.
+func writeInsecure(w io.Writer, basePaths []string, options WriteOptions) error {
+	entries, err := collectRoots(basePaths, options)
+	if err != nil {
+		return err
+	}
 	writer := gzip.NewWriter(w)
-	defer writer.Close()
+	if err := writeEntries(writer, selectEntries(entries, Selection{All: true}), nil, options); err != nil {
+		return err
+	}
+	return writer.Close()
+}
 
-	return writeTar(writer, basePath)
+func selectEntries(entries []entry, selection Selection) []entry {
+	names := selection.nameSet()
+	var selected []entry
+	for _, e := range entries {
+		if isSpecial(e.header.Typeflag) && !selection.Preserve.Specials {
+			continue // Only created by receivers requesting them.
+		}
+		if selection.All || names[e.header.Name] {
+			e.sparse = e.sparse && selection.Sparse
+			if offset, ok := selection.Offsets[e.header.Name]; ok && offset > 0 && offset <= e.header.Size {
+				e.offset = offset
+			}
+			if signature, ok := selection.Signatures[e.header.Name]; ok && e.header.Typeflag == tar.TypeReg && e.pipe == nil {
+				if signature.matches(e.header) {
+					continue // Unchanged on the receiver.
+				}
+				e.signature = &signature
+			}
+			selected = append(selected, e)
+		}
+	}
+	if selection.HardLinks {
+		selected = linkEntries(selected)
+	}
+	return selected
 }
@@ -1,11 +1,22 @@
 package transfer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"project/pkg/project"
+	"project/pkg/workspace"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 /**
@@ -13,17 +24,220 @@ import (
  * and compare it with the expectedPath under testDir.
  */
 func TestZipReadWrite(t *testing.T) {
-	testReadWrite(t, ReadZip, WriteZip)
+	testReadWrite(t, func(r io.Reader, basePath string) error {
+		return ReadZip(r, basePath, ReadOptions{})
+	}, func(w io.Writer, basePath string, options WriteOptions) error {
+		return WriteZip(w, []string{basePath}, options)
+	})
+}
+
+// Transfers the path through a pipe, returning the selection requested from the sender.
+func transferZip(sendPath string, targetPath string, options ReadOptions) (Selection, error) {
+	selections := make(chan Selection, 1)
+	reader, writer := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		defer writer.Close()
+		writeErr <- WriteZip(writer, []string{sendPath}, WriteOptions{Quiet: true, Select: func(manifest Manifest) (Selection, error) {
+			return <-selections, nil
+		}})
+	}()
+
+	var requested Selection
+	options.Request = func(selection Selection) error {
+		requested = selection
+		selections <- selection
+		return nil
+	}
+	err := ReadZip(reader, targetPath, options)
+	reader.Close()
+	<-writeErr
+	return requested, err
+}
+
+// An entry of a test tree, a file unless it's a directory or a symbolic link.
+type testEntry struct {
+	content []byte
+	link    string      // Target of the symbolic link.
+	dir     bool        // Also created for the entries in it.
+	mode    os.FileMode // Set regardless of the umask, 0o644 or 0o775 masked by it if zero.
+	modTime time.Time   // Left to the time of creation if zero.
+}
+
+// Creates the tree in the reset test path, with the names relative to it, and returns
+// the directory to send at send/dir and the target of the transfer at target.
+func createTree(t *testing.T, testPath string, tree map[string]testEntry) (string, string) {
+	workspace.ResetDir(testPath)
+	names := slices.Sorted(maps.Keys(tree))
+	for _, name := range names {
+		e := tree[name]
+		path := filepath.Join(testPath, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o775))
+		switch {
+		case e.dir:
+			require.NoError(t, os.MkdirAll(path, 0o775))
+			if e.mode != 0 {
+				require.NoError(t, os.Chmod(path, e.mode))
+			}
+		case e.link != "":
+			require.NoError(t, os.Symlink(e.link, path))
+		default:
+			require.NoError(t, os.WriteFile(path, e.content, 0o644))
+			if e.mode != 0 {
+				require.NoError(t, os.Chmod(path, e.mode))
+			}
+		}
+	}
+	// Creating the entries changes the times of their directories, the deepest are set first.
+	for _, name := range slices.Backward(names) {
+		if e := tree[name]; !e.modTime.IsZero() {
+			require.NoError(t, os.Chtimes(filepath.Join(testPath, filepath.FromSlash(name)), e.modTime, e.modTime))
+		}
+	}
+	return filepath.Join(testPath, "send", "dir"), filepath.Join(testPath, "target")
+}
+
+func TestLegacyZipReadWrite(t *testing.T) {
+	testReadWrite(t, func(r io.Reader, basePath string) error {
+		return ReadZip(r, basePath, ReadOptions{Legacy: true})
+	}, func(w io.Writer, basePath string, options WriteOptions) error {
+		options.Legacy = true
+		return WriteZip(w, []string{basePath}, options)
+	})
+}
+
+func TestInsecureZipReadWrite(t *testing.T) {
+	testReadWrite(t, func(r io.Reader, basePath string) error {
+		return ReadZip(r, basePath, ReadOptions{Insecure: true})
+	}, func(w io.Writer, basePath string, options WriteOptions) error {
+		options.Insecure = true
+		return WriteZip(w, []string{basePath}, options)
+	})
+}
+
+// Reads the archive like the versions authenticating with the hash of the secret,
+// returning the content of the files, "/" for directories and the targets of links.
+func readBaselineZip(t *testing.T, r io.Reader) map[string]string {
+	reader, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	defer reader.Close()
+	entries := make(map[string]string)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entries[header.Name] = "/"
+		case tar.TypeSymlink:
+			entries[header.Name] = "-> " + header.Linkname
+		case tar.TypeReg:
+			content, err := io.ReadAll(tarReader)
+			require.NoError(t, err)
+			entries[header.Name] = string(content)
+		default:
+			t.Fatalf("unsupported file type for entry %s", header.Name)
+		}
+	}
+}
+
+func TestInsecureZipBaseline(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "insecure_zip")
+	sendPath, targetPath := createTree(t, testPath, map[string]testEntry{
+		"send/dir/file":     {content: []byte("file")},
+		"send/dir/sub/link": {link: "../file"},
+		"target":            {dir: true},
+	})
+	require.NoError(t, os.Link(filepath.Join(sendPath, "file"), filepath.Join(sendPath, "hard")))
+
+	// Hard links are sent as files, the older versions don't know them.
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true, Insecure: true}))
+	assert.Equal(t, map[string]string{
+		"dir":          "/",
+		"dir/file":     "file",
+		"dir/hard":     "file",
+		"dir/sub":      "/",
+		"dir/sub/link": "-> ../file",
+	}, readBaselineZip(t, &buffer))
+
+	// Written like the older versions do.
+	buffer.Reset()
+	zipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(zipWriter)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir", Mode: 0o755}))
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0o644, Size: 4}))
+	_, err := tarWriter.Write([]byte("file"))
+	require.NoError(t, err)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "dir/link", Linkname: "file"}))
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, ReadZip(&buffer, targetPath, ReadOptions{Quiet: true, Insecure: true}))
+
+	content, err := os.ReadFile(filepath.Join(targetPath, "dir", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(content))
+	assert.NoFileExists(t, partPath(filepath.Join(targetPath, "dir", "file")))
+
+	// Hashes aren't expected.
+	buffer.Reset()
+	require.NoError(t, WriteZip(&buffer, []string{sendPath}, WriteOptions{Quiet: true, Legacy: true}))
+	err = ReadZip(&buffer, targetPath, ReadOptions{Quiet: true, Insecure: true})
+	assert.Error(t, err)
 }
 
 func TestReadEmptyZip(t *testing.T) {
 	reader := strings.NewReader("")
-	err := ReadZip(reader, "")
+	err := ReadZip(reader, "", ReadOptions{Legacy: true})
 	assert.Error(t, err)
 	assert.Equal(t, io.EOF, err)
 
 	reader = strings.NewReader(string([]byte{0x12}))
-	err = ReadZip(reader, "")
+	err = ReadZip(reader, "", ReadOptions{Legacy: true})
 	assert.Error(t, err)
 	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	reader = strings.NewReader("")
+	err = ReadZip(reader, "", ReadOptions{})
+	assert.ErrorIs(t, err, io.EOF)
+
+	reader = strings.NewReader(string([]byte{0x12}))
+	err = ReadZip(reader, "", ReadOptions{})
+	assert.ErrorContains(t, err, "unsupported codec 18")
+}
+
+func TestMultiplePaths(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), project.Name, "test", "multiple_paths")
+	workspace.ResetDir(testPath)
+	sendPath := filepath.Join(testPath, "send")
+	workspace.ResetDir(filepath.Join(sendPath, "conf"))
+	workspace.ResetDir(filepath.Join(sendPath, "other", "a.log"))
+	for _, name := range []string{"a.log", "b.log", "conf/app.toml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(sendPath, name), []byte(name), 0o644))
+	}
+	targetPath := filepath.Join(testPath, "target")
+	workspace.ResetDir(targetPath)
+
+	paths := []string{filepath.Join(sendPath, "a.log"), filepath.Join(sendPath, "b.log"), filepath.Join(sendPath, "conf")}
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, paths, WriteOptions{Quiet: true}))
+	require.NoError(t, ReadZip(&buffer, targetPath, ReadOptions{
+		Approve: func(manifest Manifest) (Selection, error) {
+			assert.Equal(t, []string{"a.log", "b.log", "conf"}, manifest.TopLevelNames())
+			return Selection{All: true}, nil
+		},
+	}))
+	for _, name := range []string{"a.log", "b.log", "conf/app.toml"} {
+		content, err := os.ReadFile(filepath.Join(targetPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, name, string(content))
+	}
+
+	// Top-level names must differ.
+	paths = append(paths, filepath.Join(sendPath, "other", "a.log"))
+	err := WriteZip(io.Discard, paths, WriteOptions{Quiet: true})
+	assert.ErrorContains(t, err, "duplicate name a.log")
 }
@@ -0,0 +1,164 @@
+package trust
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"p2pcp/internal/auth"
+	"p2pcp/internal/node"
+	"p2pcp/pkg/config"
+	"path/filepath"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
+)
+
+const storeFileName = "trusted_peers.json"
+
+// A known peer, identified by its node ID.
+// Paired peers additionally share a long-term key used instead of a PIN/token.
+type Peer struct {
+	Name   string
+	ID     string
+	PeerID string `json:",omitempty"`
+	Key    []byte `json:",omitempty"`
+}
+
+func (p Peer) IsPaired() bool {
+	return p.PeerID != "" && len(p.Key) > 0
+}
+
+func (p Peer) GetPeerID() (peer.ID, error) {
+	peerID, err := peer.Decode(p.PeerID)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID of %s: %w", p.Name, err)
+	}
+	return peerID, nil
+}
+
+// Discovery topic of the pair, only known to both peers.
+func (p Peer) GetTopic() string {
+	return auth.PairingTopic(p.Key)
+}
+
+type Store struct {
+	Peers []Peer
+}
+
+func getStorePath() string {
+	return filepath.Join(config.GetConfigDir(), storeFileName)
+}
+
+func Load() (*Store, error) {
+	path := getStorePath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Store{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading trusted peers %s: %w", path, err)
+	}
+	var store Store
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("invalid trusted peers %s: %w", path, err)
+	}
+	return &store, nil
+}
+
+func (s *Store) Save() error {
+	path := getStorePath()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing trusted peers %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Store) Add(name string, id string) error {
+	if bytes, err := b58.Decode(id); err != nil || len(bytes) != 32 {
+		return fmt.Errorf("invalid node ID: %s", id)
+	}
+	if _, ok := s.FindByName(name); ok {
+		return fmt.Errorf("trusted peer %s already exists", name)
+	}
+	if peer, ok := s.FindByID(id); ok {
+		return fmt.Errorf("node ID %s is already trusted as %s", id, peer.Name)
+	}
+	s.Peers = append(s.Peers, Peer{Name: name, ID: id})
+	return nil
+}
+
+// Records a peer paired under the specified name, replacing a previous pairing with it.
+func (s *Store) Pair(name string, peerID peer.ID, key []byte) error {
+	id := node.GetNodeID(peerID).String()
+	if existing, ok := s.FindByName(name); ok && existing.ID != id {
+		return fmt.Errorf("trusted peer %s already exists", name)
+	}
+	if existing, ok := s.FindByID(id); ok && existing.Name != name {
+		return fmt.Errorf("node ID %s is already trusted as %s", id, existing.Name)
+	}
+	paired := Peer{Name: name, ID: id, PeerID: peerID.String(), Key: key}
+	index := slices.IndexFunc(s.Peers, func(p Peer) bool { return p.Name == name })
+	if index < 0 {
+		s.Peers = append(s.Peers, paired)
+	} else {
+		s.Peers[index] = paired
+	}
+	return nil
+}
+
+func (s *Store) Remove(name string) error {
+	index := slices.IndexFunc(s.Peers, func(p Peer) bool { return p.Name == name })
+	if index < 0 {
+		return fmt.Errorf("trusted peer %s not found", name)
+	}
+	s.Peers = slices.Delete(s.Peers, index, index+1)
+	return nil
+}
+
+func (s *Store) FindByName(name string) (Peer, bool) {
+	index := slices.IndexFunc(s.Peers, func(p Peer) bool { return p.Name == name })
+	if index < 0 {
+		return Peer{}, false
+	}
+	return s.Peers[index], true
+}
+
+func (s *Store) FindByID(id string) (Peer, bool) {
+	index := slices.IndexFunc(s.Peers, func(p Peer) bool { return p.ID == id })
+	if index < 0 {
+		return Peer{}, false
+	}
+	return s.Peers[index], true
+}
+
+// Records a paired peer in the store.
+func RecordPairing(name string, peerID peer.ID, key []byte) error {
+	store, err := Load()
+	if err != nil {
+		return err
+	}
+	if err := store.Pair(name, peerID, key); err != nil {
+		return err
+	}
+	return store.Save()
+}
+
+// Loads the paired peer with the specified name.
+func LoadPaired(name string) (Peer, error) {
+	store, err := Load()
+	if err != nil {
+		return Peer{}, err
+	}
+	paired, ok := store.FindByName(name)
+	if !ok || !paired.IsPaired() {
+		return Peer{}, fmt.Errorf("%s is not a paired device", name)
+	}
+	return paired, nil
+}
@@ -0,0 +1,103 @@
+package trust
+
+import (
+	"crypto/rand"
+	"os"
+	"p2pcp/internal/node"
+	"path/filepath"
+	"project/pkg/workspace"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testID1 = "4ZXm6Y8xqTo4XAcBRkkK61Yd1FyJzFsvn9dSLW5qCiGF"
+const testID2 = "5pRcAqx3S7rhL3iXn7H8bDYR1u4g9oRCcf3dm2sPbVHK"
+
+func TestStore(t *testing.T) {
+	configPath := filepath.Join(os.TempDir(), "p2pcp/test/trust")
+	workspace.ResetDir(configPath)
+	restore := workspace.SetEnv("XDG_CONFIG_HOME", configPath)
+	defer restore()
+	xdg.Reload()
+	defer xdg.Reload()
+
+	store, err := Load()
+	require.NoError(t, err)
+	assert.Empty(t, store.Peers)
+
+	require.NoError(t, store.Add("alice", testID1))
+	require.NoError(t, store.Add("bob", testID2))
+	assert.ErrorContains(t, store.Add("alice", testID2), "already exists")
+	assert.ErrorContains(t, store.Add("carol", testID1), "already trusted as alice")
+	assert.ErrorContains(t, store.Add("carol", "invalid"), "invalid node ID")
+	require.NoError(t, store.Save())
+
+	store, err = Load()
+	require.NoError(t, err)
+	peer, ok := store.FindByID(testID2)
+	require.True(t, ok)
+	assert.Equal(t, "bob", peer.Name)
+	peer, ok = store.FindByName("alice")
+	require.True(t, ok)
+	assert.Equal(t, testID1, peer.ID)
+
+	require.NoError(t, store.Remove("alice"))
+	assert.ErrorContains(t, store.Remove("alice"), "not found")
+	_, ok = store.FindByID(testID1)
+	assert.False(t, ok)
+}
+
+func newPeerID(t *testing.T) peer.ID {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	return id
+}
+
+func TestPair(t *testing.T) {
+	configPath := filepath.Join(os.TempDir(), "p2pcp/test/trust-pair")
+	workspace.ResetDir(configPath)
+	restore := workspace.SetEnv("XDG_CONFIG_HOME", configPath)
+	defer restore()
+	xdg.Reload()
+	defer xdg.Reload()
+
+	id1 := newPeerID(t)
+	id2 := newPeerID(t)
+
+	_, err := LoadPaired("alice")
+	assert.ErrorContains(t, err, "not a paired device")
+
+	require.NoError(t, RecordPairing("alice", id1, []byte("key1")))
+	assert.ErrorContains(t, RecordPairing("bob", id1, []byte("key2")), "already trusted as alice")
+	assert.ErrorContains(t, RecordPairing("alice", id2, []byte("key2")), "already exists")
+	// Pairing again replaces the key.
+	require.NoError(t, RecordPairing("alice", id1, []byte("key2")))
+
+	paired, err := LoadPaired("alice")
+	require.NoError(t, err)
+	assert.True(t, paired.IsPaired())
+	assert.Equal(t, node.GetNodeID(id1).String(), paired.ID)
+	assert.Equal(t, []byte("key2"), paired.Key)
+	peerID, err := paired.GetPeerID()
+	require.NoError(t, err)
+	assert.Equal(t, id1, peerID)
+
+	store, err := Load()
+	require.NoError(t, err)
+	assert.Len(t, store.Peers, 1)
+
+	// Plain trusted peers can't be used for pairing transfers.
+	require.NoError(t, store.Add("bob", testID2))
+	require.NoError(t, store.Save())
+	_, err = LoadPaired("bob")
+	assert.ErrorContains(t, err, "not a paired device")
+
+	assert.NotEqual(t, paired.GetTopic(), Peer{Key: []byte("key1")}.GetTopic())
+}
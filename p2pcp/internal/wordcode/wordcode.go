@@ -0,0 +1,82 @@
+package wordcode
+
+import (
+	_ "embed"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Encodes binary data as words, one per byte, followed by checksum words
+// so typos are caught before the data is used.
+
+const checksumSize = 2
+
+//go:embed words.txt
+var wordList string
+
+var words = strings.Fields(wordList)
+
+var wordIndex = func() map[string]byte {
+	index := make(map[string]byte, len(words))
+	for i, word := range words {
+		index[word] = byte(i)
+	}
+	return index
+}()
+
+func Word(b byte) string {
+	return words[b]
+}
+
+func checksum(data []byte) []byte {
+	hash := blake2b.Sum256(data)
+	return hash[:checksumSize]
+}
+
+// Number of words encoding data of the specified size.
+func EncodedLength(size int) int {
+	return size + checksumSize
+}
+
+func Encode(data []byte) string {
+	encoded := make([]string, 0, EncodedLength(len(data)))
+	for _, b := range slices.Concat(data, checksum(data)) {
+		encoded = append(encoded, Word(b))
+	}
+	return strings.Join(encoded, "-")
+}
+
+func split(code string) []string {
+	return strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-'
+	})
+}
+
+// Number of words in the code, separated by dashes or spaces.
+func Length(code string) int {
+	return len(split(code))
+}
+
+func Decode(code string) ([]byte, error) {
+	parts := split(code)
+	if len(parts) <= checksumSize {
+		return nil, fmt.Errorf("too few words")
+	}
+	decoded := make([]byte, len(parts))
+	for i, part := range parts {
+		b, ok := wordIndex[part]
+		if !ok {
+			return nil, fmt.Errorf("unknown word %q", part)
+		}
+		decoded[i] = b
+	}
+	data, sum := decoded[:len(decoded)-checksumSize], decoded[len(decoded)-checksumSize:]
+	if string(sum) != string(checksum(data)) {
+		return nil, fmt.Errorf("checksum mismatch, please check the words for typos")
+	}
+	return data, nil
+}
@@ -0,0 +1,61 @@
+package wordcode
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWordList(t *testing.T) {
+	assert.Len(t, words, 256)
+	assert.Len(t, wordIndex, 256)
+	for _, word := range words {
+		assert.Equal(t, strings.ToLower(word), word)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	code := Encode(data)
+	assert.Equal(t, EncodedLength(16), Length(code))
+
+	decoded, err := Decode(code)
+	require.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	// Case and separators don't matter.
+	decoded, err = Decode(strings.ToUpper(strings.ReplaceAll(code, "-", " ")))
+	require.NoError(t, err)
+	assert.Equal(t, data, decoded)
+}
+
+func TestEncodeKeepsData(t *testing.T) {
+	buffer := []byte{0, 1, 2, 3, 4, 5}
+	Encode(buffer[:4])
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5}, buffer)
+}
+
+func TestDecodeTypos(t *testing.T) {
+	code := Encode([]byte{0, 1, 2, 3})
+	parts := strings.Split(code, "-")
+
+	swapped := append([]string{parts[1], parts[0]}, parts[2:]...)
+	_, err := Decode(strings.Join(swapped, "-"))
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	replaced := append([]string{Word(255)}, parts[1:]...)
+	_, err = Decode(strings.Join(replaced, "-"))
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	_, err = Decode(strings.Join(append([]string{"aple"}, parts[1:]...), "-"))
+	assert.ErrorContains(t, err, "unknown word \"aple\"")
+
+	_, err = Decode(strings.Join(parts[:2], "-"))
+	assert.ErrorContains(t, err, "too few words")
+}
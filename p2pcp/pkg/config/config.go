@@ -14,20 +14,33 @@ import (
 )
 
 type Config struct {
-	BootstrapPeers []string
+	BootstrapPeers     []string
+	PersistentIdentity bool
+	PinLength          int    // Number of digits, words or characters of the PIN.
+	PinAlphabet        string // digits, words or base32
+	MaxAttempts        int    // Failed PIN attempts allowed before the sender aborts.
 }
 
 func NewConfig() Config {
 	return Config{
-		BootstrapPeers: nil,
+		BootstrapPeers:     nil,
+		PersistentIdentity: false,
+		PinLength:          6,
+		PinAlphabet:        "digits",
+		MaxAttempts:        3,
 	}
 }
 
+// Directory holding the config file and other persistent state.
+func GetConfigDir() string {
+	return filepath.Join(xdg.ConfigHome, project.Name)
+}
+
 func initializeConfig() {
 	xdg.Reload()
 	viper.SetConfigName("config")
 	viper.SetConfigType("json")
-	viper.AddConfigPath(filepath.Join(xdg.ConfigHome, project.Name))
+	viper.AddConfigPath(GetConfigDir())
 	defaultConfig := NewConfig()
 	jsonString, err := json.Marshal(defaultConfig)
 	errors.Unexpected(err, "initializeConfig: Marshal default config")
@@ -35,10 +35,16 @@ func TestLoadConfig(t *testing.T) {
 
 		config := GetConfig()
 		require.Equal(t, []string{"peer1", "peer2"}, config.BootstrapPeers)
+		require.False(t, config.PersistentIdentity)
+		require.Equal(t, 6, config.PinLength)
+		require.Equal(t, "digits", config.PinAlphabet)
+		require.Equal(t, 3, config.MaxAttempts)
+		require.Equal(t, appConfigPath, GetConfigDir())
 	}()
 
 	// Lowercase
-	config2 := "{ \"bootstrapPeers\": [\"peer1\", \"peer2\"] }"
+	config2 := "{ \"bootstrapPeers\": [\"peer1\", \"peer2\"], \"persistentIdentity\": true, " +
+		"\"pinLength\": 4, \"pinAlphabet\": \"words\", \"maxAttempts\": 5 }"
 	func() {
 		workspace.ResetDir(appConfigPath)
 		viper.Reset()
@@ -57,6 +63,10 @@ func TestLoadConfig(t *testing.T) {
 
 		config := GetConfig()
 		require.Equal(t, []string{"peer1", "peer2"}, config.BootstrapPeers)
+		require.True(t, config.PersistentIdentity)
+		require.Equal(t, 4, config.PinLength)
+		require.Equal(t, "words", config.PinAlphabet)
+		require.Equal(t, 5, config.MaxAttempts)
 	}()
 
 	// Invalid
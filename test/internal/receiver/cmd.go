@@ -44,7 +44,8 @@ func Run(ctx context.Context, receiverDir string, stdin string, targetPath strin
 		return fmt.Errorf("invalid command: %s", line)
 	}
 
-	args := append(cmd[1:], "--debug")
+	// Approve the transfer up front, stdin only carries the secret and the sender confirmation.
+	args := append(cmd[1:], "--debug", "--yes")
 	if len(targetPath) > 0 {
 		args = append(args, targetPath)
 	}